@@ -0,0 +1,313 @@
+package gorm_tools
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	xid "gitlab.shoplazza.site/common/common-xid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+	审计日志，记录嵌入BaseModel的模型每次更新前后变化的字段，需注册AuditPlugin:
+	db.Use(&gorm_tools.AuditPlugin{})
+
+	1. 模型实现Auditable接口后开启
+	2. 只记录按主键更新的记录（模型id非0），批量条件更新不记录
+	3. 字段加上 audit:"-" 标签或在ExcludeColumns中的列不记录，用于密码、密钥等字段
+	4. 操作人和请求id通过WithActor、WithRequestId写入ctx，db需WithContext(ctx)
+	5. 默认在同一事务中写入audit_logs表，写入失败时更新回滚；
+	   设置Sink后由Sink写入（如发送到kafka），Sink返回错误只记录日志；
+	   Sink在WithTx最外层事务提交后写入，回滚时不写入，不在事务中时在更新语句提交后写入；
+	   在db.Transaction等非WithTx开启的事务中无法得知是否提交，不写入Sink只记录错误日志，需要审计的事务应使用WithTx
+	6. EncryptedString字段按明文比较，变更记录中不包含明文和密文
+
+	CREATE TABLE `audit_logs` (
+	  `id` bigint unsigned NOT NULL,
+	  `table_name` varchar(64) NOT NULL,
+	  `record_id` bigint unsigned NOT NULL,
+	  `action` varchar(16) NOT NULL,
+	  `actor` varchar(128) NOT NULL DEFAULT '',
+	  `request_id` varchar(64) NOT NULL DEFAULT '',
+	  `changes` json DEFAULT NULL,
+	  `created_at` datetime(6) DEFAULT NULL,
+	  PRIMARY KEY (`id`),
+	  KEY `idx_table_record` (`table_name`,`record_id`)
+	);
+*/
+
+const (
+	DefaultAuditTable = "audit_logs"
+	AuditActionUpdate = "update"
+
+	auditOldValueKey = "gorm_tools:audit_old_value"
+	auditRecordKey   = "gorm_tools:audit_record"
+	auditMaskedValue = encryptedStringMask
+)
+
+var encryptedStringType = reflect.TypeOf(EncryptedString(""))
+
+type Auditable interface {
+	AuditEnabled() bool
+}
+
+type AuditRecord struct {
+	Id        uint64 `gorm:"column:id" json:"id"`
+	Table     string `gorm:"column:table_name" json:"table_name"`
+	RecordId  uint64 `gorm:"column:record_id" json:"record_id"`
+	Action    string `gorm:"column:action" json:"action"`
+	Actor     string `gorm:"column:actor" json:"actor"`
+	RequestId string `gorm:"column:request_id" json:"request_id"`
+	Changes   Json   `gorm:"column:changes" json:"changes"`
+	CreatedAt Time   `gorm:"column:created_at;autoCreateTime:false" json:"created_at"`
+}
+
+type AuditChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+type AuditSink interface {
+	Write(ctx context.Context, records []*AuditRecord) error
+}
+
+type AuditSinkFunc func(ctx context.Context, records []*AuditRecord) error
+
+func (f AuditSinkFunc) Write(ctx context.Context, records []*AuditRecord) error {
+	return f(ctx, records)
+}
+
+type (
+	actorKey     struct{}
+	requestIdKey struct{}
+)
+
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+func RequestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+type AuditPlugin struct {
+	Table          string // 默认audit_logs
+	Sink           AuditSink
+	ExcludeColumns []string
+}
+
+func (*AuditPlugin) Name() string {
+	return "gorm_tools:audit"
+}
+
+func (p *AuditPlugin) Initialize(db *gorm.DB) error {
+	if p.Table == "" {
+		p.Table = DefaultAuditTable
+	}
+
+	err := db.Callback().Update().Before("gorm:update").Register(p.Name()+":load_old", p.loadOld)
+	if err != nil {
+		return err
+	}
+
+	err = db.Callback().Update().After("gorm:update").Register(p.Name()+":record", p.record)
+	if err != nil {
+		return err
+	}
+
+	return db.Callback().Update().After("gorm:commit_or_rollback_transaction").Register(p.Name()+":write_sink", p.writeSink)
+}
+
+func (p *AuditPlugin) loadOld(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil || db.DryRun {
+		return
+	}
+
+	base := p.auditedModel(db)
+	if base == nil || base.Id == 0 {
+		return
+	}
+
+	old := reflect.New(db.Statement.Schema.ModelType)
+	err := db.Session(&gorm.Session{NewDB: true, SkipHooks: true}).
+		Unscoped().
+		Table(db.Statement.Table).
+		Where("id = ?", base.Id).
+		Take(old.Interface()).Error
+	if err != nil {
+		log.WithError(err).Errorf("audit load %s %d failed", db.Statement.Table, base.Id)
+		return
+	}
+
+	db.InstanceSet(auditOldValueKey, old.Elem())
+}
+
+func (p *AuditPlugin) record(db *gorm.DB) {
+	value, ok := db.InstanceGet(auditOldValueKey)
+	if !ok || db.Error != nil || db.RowsAffected == 0 {
+		return
+	}
+	old := value.(reflect.Value)
+
+	set, ok := db.Statement.Clauses["SET"].Expression.(clause.Set)
+	if !ok {
+		return
+	}
+
+	changes := make(map[string]AuditChange)
+	for _, assignment := range set {
+		field := db.Statement.Schema.LookUpField(assignment.Column.Name)
+		if field == nil || p.excluded(field.DBName) || field.Tag.Get("audit") == "-" {
+			continue
+		}
+
+		oldValue, _ := field.ValueOf(db.Statement.Context, old)
+		newValue := assignment.Value
+		if expr, ok := newValue.(clause.Expr); ok {
+			newValue = expr.SQL
+		}
+
+		// 每次加密的nonce不同，密文总是不同，按明文比较
+		if field.IndirectFieldType == encryptedStringType {
+			if plaintext(oldValue) != plaintext(newValue) {
+				changes[field.DBName] = AuditChange{Old: auditMaskedValue, New: auditMaskedValue}
+			}
+			continue
+		}
+
+		oldValue, newValue = auditValue(oldValue), auditValue(newValue)
+		if fmt.Sprint(oldValue) == fmt.Sprint(newValue) {
+			continue
+		}
+		changes[field.DBName] = AuditChange{Old: oldValue, New: newValue}
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+
+	bs, err := json.Marshal(changes)
+	if err != nil {
+		log.WithError(err).Error("audit marshal changes failed")
+		return
+	}
+
+	ctx := db.Statement.Context
+	record := &AuditRecord{
+		Id:        xid.Get(),
+		Table:     db.Statement.Table,
+		RecordId:  p.auditedModel(db).Id,
+		Action:    AuditActionUpdate,
+		Actor:     ActorFromContext(ctx),
+		RequestId: RequestIdFromContext(ctx),
+		Changes:   bs,
+		CreatedAt: Time(time.Now().UTC()),
+	}
+
+	if p.Sink != nil {
+		// 事务提交后由writeSink写入
+		db.InstanceSet(auditRecordKey, record)
+		return
+	}
+
+	// 与更新在同一事务中写入
+	err = db.Session(&gorm.Session{NewDB: true, SkipHooks: true}).Table(p.Table).Create(record).Error
+	if err != nil {
+		_ = db.AddError(fmt.Errorf("write audit log failed: %w", err))
+	}
+}
+
+func (p *AuditPlugin) writeSink(db *gorm.DB) {
+	value, ok := db.InstanceGet(auditRecordKey)
+	if !ok || db.Error != nil {
+		return
+	}
+	record := value.(*AuditRecord)
+
+	if _, inTx := db.Statement.ConnPool.(gorm.TxCommitter); inTx && txStateFromContext(db.Statement.Context) == nil {
+		log.WithField("record", record).Error("audit sink skipped, update is in a transaction not opened by WithTx")
+		return
+	}
+
+	AfterCommit(db.Statement.Context, func(ctx context.Context) {
+		if err := p.Sink.Write(ctx, []*AuditRecord{record}); err != nil {
+			log.WithError(err).WithField("record", record).Error("audit sink write failed")
+		}
+	})
+}
+
+func (p *AuditPlugin) auditedModel(db *gorm.DB) *BaseModel {
+	value := db.Statement.ReflectValue
+	if value.Kind() != reflect.Struct || !value.CanAddr() {
+		return nil
+	}
+
+	model := value.Addr().Interface()
+	if auditable, ok := model.(Auditable); !ok || !auditable.AuditEnabled() {
+		return nil
+	}
+
+	if b, ok := model.(baseModeler); ok {
+		return b.baseModel()
+	}
+	return nil
+}
+
+func (p *AuditPlugin) excluded(column string) bool {
+	for _, c := range p.ExcludeColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+func plaintext(value interface{}) string {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.String {
+		return fmt.Sprint(value)
+	}
+	return v.String()
+}
+
+// 统一转换成数据库中的值，便于比较和序列化
+func auditValue(value interface{}) interface{} {
+	if valuer, ok := value.(driver.Valuer); ok {
+		if v := reflect.ValueOf(valuer); v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil
+		}
+
+		dv, err := valuer.Value()
+		if err != nil {
+			return value
+		}
+		value = dv
+	}
+
+	if bs, ok := value.([]byte); ok {
+		return string(bs)
+	}
+	return value
+}
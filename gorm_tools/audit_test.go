@@ -0,0 +1,205 @@
+package gorm_tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+type testAccount struct {
+	BaseModel
+	Name     string          `gorm:"column:name"`
+	Secret   EncryptedString `gorm:"column:secret"`
+	Password string          `gorm:"column:password" audit:"-"`
+}
+
+func (*testAccount) AuditEnabled() bool {
+	return true
+}
+
+type memoryAuditSink struct {
+	mu      sync.Mutex
+	records []*AuditRecord
+}
+
+func (s *memoryAuditSink) Write(_ context.Context, records []*AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func (s *memoryAuditSink) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+func setTestKeyProvider() {
+	SetKeyProvider(&StaticKeyProvider{
+		CurrentKeyId: "k1",
+		Keys:         map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")},
+	})
+}
+
+func newAuditTestDB(t *testing.T, plugin *AuditPlugin) (*gorm.DB, *testAccount) {
+	t.Helper()
+	setTestKeyProvider()
+
+	db := newTestDB(t, &testAccount{})
+	if err := db.Table(DefaultAuditTable).AutoMigrate(&AuditRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	account := &testAccount{Name: "a", Secret: "s1", Password: "p1"}
+	if err := db.Create(account).Error; err != nil {
+		t.Fatal(err)
+	}
+	return db, account
+}
+
+func auditChanges(t *testing.T, record *AuditRecord) map[string]AuditChange {
+	t.Helper()
+
+	changes := map[string]AuditChange{}
+	if err := json.Unmarshal(record.Changes, &changes); err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+func TestAuditTable(t *testing.T) {
+	db, account := newAuditTestDB(t, &AuditPlugin{})
+
+	ctx := WithRequestId(WithActor(context.Background(), "admin"), "req-1")
+	if err := db.WithContext(ctx).Model(account).Updates(map[string]interface{}{"name": "b", "password": "p2"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var records []*AuditRecord
+	if err := db.Table(DefaultAuditTable).Find(&records).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("records = %d", len(records))
+	}
+
+	record := records[0]
+	if record.RecordId != account.Id || record.Actor != "admin" || record.RequestId != "req-1" || record.Action != AuditActionUpdate {
+		t.Fatalf("record = %+v", record)
+	}
+	changes := auditChanges(t, record)
+	if change, ok := changes["name"]; !ok || change.Old != "a" || change.New != "b" {
+		t.Fatalf("changes = %+v", changes)
+	}
+	if _, ok := changes["password"]; ok {
+		t.Fatal("excluded column recorded")
+	}
+}
+
+func TestAuditEncryptedString(t *testing.T) {
+	sink := &memoryAuditSink{}
+	db, account := newAuditTestDB(t, &AuditPlugin{Sink: sink})
+
+	// 明文没变不记录
+	if err := db.Model(account).Updates(&testAccount{Name: "b", Secret: "s1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if sink.len() != 1 {
+		t.Fatalf("records = %d", sink.len())
+	}
+	if change, ok := auditChanges(t, sink.records[0])["secret"]; ok {
+		t.Fatalf("unchanged encrypted string recorded: %+v", change)
+	}
+
+	if err := db.Model(account).Updates(&testAccount{Secret: "s2"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if sink.len() != 2 {
+		t.Fatalf("records = %d", sink.len())
+	}
+	change := auditChanges(t, sink.records[1])["secret"]
+	if change.Old != auditMaskedValue || change.New != auditMaskedValue {
+		t.Fatalf("secret change = %+v", change)
+	}
+}
+
+func TestAuditSinkAfterCommit(t *testing.T) {
+	sink := &memoryAuditSink{}
+	db, account := newAuditTestDB(t, &AuditPlugin{Sink: sink})
+
+	errRollback := errors.New("rollback")
+	err := WithTx(context.Background(), db, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Model(account).Update("name", "b").Error; err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatal(err)
+	}
+	if sink.len() != 0 {
+		t.Fatal("rolled back update recorded")
+	}
+
+	err = WithTx(context.Background(), db, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Model(account).Update("name", "c").Error; err != nil {
+			return err
+		}
+		if sink.len() != 0 {
+			t.Error("record written before commit")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.len() != 1 {
+		t.Fatalf("records = %d", sink.len())
+	}
+
+	// 不在事务中时语句执行成功后写入
+	if err := db.Model(account).Update("name", "d").Error; err != nil {
+		t.Fatal(err)
+	}
+	if sink.len() != 2 {
+		t.Fatalf("records = %d", sink.len())
+	}
+}
+
+func TestAuditSinkInGormTransaction(t *testing.T) {
+	sink := &memoryAuditSink{}
+	db, account := newAuditTestDB(t, &AuditPlugin{Sink: sink})
+
+	errRollback := errors.New("rollback")
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(account).Update("name", "b").Error; err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatal(err)
+	}
+	if sink.len() != 0 {
+		t.Fatal("rolled back update recorded")
+	}
+
+	// 无法得知是否提交，提交了也不写入
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return tx.Model(account).Update("name", "c").Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.len() != 0 {
+		t.Fatalf("records = %d", sink.len())
+	}
+}
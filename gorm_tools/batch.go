@@ -0,0 +1,229 @@
+package gorm_tools
+
+import (
+	"reflect"
+	"time"
+
+	xid "gitlab.shoplazza.site/common/common-xid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+/*
+	批量写入，按BatchSize分块执行，每块一条INSERT语句
+	嵌入BaseModel的模型会在写入前生成id和created_at、updated_at
+*/
+
+const DefaultBatchSize = 500
+
+type (
+	BatchOpts struct {
+		batchSize     int
+		updateColumns []string
+		stopOnError   bool
+	}
+
+	funcBatchOption struct {
+		f func(opts *BatchOpts)
+	}
+
+	BatchOption interface {
+		apply(opts *BatchOpts)
+	}
+)
+
+func (fdo *funcBatchOption) apply(do *BatchOpts) {
+	fdo.f(do)
+}
+
+func newBatchOption(f func(opts *BatchOpts)) *funcBatchOption {
+	return &funcBatchOption{
+		f: f,
+	}
+}
+
+func BatchSize(size int) BatchOption {
+	return newBatchOption(func(opts *BatchOpts) {
+		opts.batchSize = size
+	})
+}
+
+// UpdateColumns Upsert冲突时更新的列，默认更新除主键、created_at和软删除字段外的所有列
+func UpdateColumns(columns ...string) BatchOption {
+	return newBatchOption(func(opts *BatchOpts) {
+		opts.updateColumns = append(opts.updateColumns, columns...)
+	})
+}
+
+// StopOnError 某一块写入失败后不再写入后面的块，默认继续写入
+func StopOnError() BatchOption {
+	return newBatchOption(func(opts *BatchOpts) {
+		opts.stopOnError = true
+	})
+}
+
+type BatchResult struct {
+	Chunk        int // 第几块，从0开始
+	Offset       int // 该块第一行在rows中的下标
+	Size         int
+	RowsAffected int64
+	Err          error
+}
+
+type BatchResults []BatchResult
+
+// Err 返回第一个失败块的错误
+func (results BatchResults) Err() error {
+	for _, result := range results {
+		if result.Err != nil {
+			return result.Err
+		}
+	}
+	return nil
+}
+
+func (results BatchResults) RowsAffected() int64 {
+	var rowsAffected int64
+	for _, result := range results {
+		rowsAffected += result.RowsAffected
+	}
+	return rowsAffected
+}
+
+// Failed 返回失败的块
+func (results BatchResults) Failed() BatchResults {
+	var failed BatchResults
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// BulkInsert 分块批量插入
+func BulkInsert[T any](db *gorm.DB, rows []T, opts ...BatchOption) BatchResults {
+	return batchCreate(db, rows, nil, newBatchOpts(opts))
+}
+
+// Upsert 分块批量插入，唯一键冲突时 ON DUPLICATE KEY UPDATE
+// 冲突的行不会回填数据库中已有的id
+func Upsert[T any](db *gorm.DB, rows []T, opts ...BatchOption) BatchResults {
+	batchOpts := newBatchOpts(opts)
+	if len(rows) == 0 {
+		return nil
+	}
+
+	columns := batchOpts.updateColumns
+	if len(columns) == 0 {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(&rows[0]); err != nil {
+			return BatchResults{{Size: len(rows), Err: err}}
+		}
+
+		for _, field := range stmt.Schema.Fields {
+			// 软删除字段不更新，否则会恢复已删除的行
+			if field.DBName == "" || !field.Creatable || field.PrimaryKey || field.DBName == "created_at" || isSoftDeleteField(field) {
+				continue
+			}
+			columns = append(columns, field.DBName)
+		}
+	} else if baseModelOf(&rows[0]) != nil {
+		columns = appendMissing(columns, "updated_at")
+	}
+
+	return batchCreate(db, rows, &clause.OnConflict{DoUpdates: clause.AssignmentColumns(columns)}, batchOpts)
+}
+
+func batchCreate[T any](db *gorm.DB, rows []T, onConflict *clause.OnConflict, batchOpts *BatchOpts) BatchResults {
+	now := Time(time.Now().UTC())
+	for i := range rows {
+		if base := baseModelOf(&rows[i]); base != nil {
+			prepareBaseModel(base, now)
+		}
+	}
+
+	results := make(BatchResults, 0, (len(rows)+batchOpts.batchSize-1)/batchOpts.batchSize)
+	for offset := 0; offset < len(rows); offset += batchOpts.batchSize {
+		end := offset + batchOpts.batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		tx := db.Session(&gorm.Session{})
+		if onConflict != nil {
+			tx = tx.Clauses(*onConflict)
+		}
+		chunk := rows[offset:end]
+		tx = tx.Create(&chunk)
+
+		results = append(results, BatchResult{
+			Chunk:        len(results),
+			Offset:       offset,
+			Size:         end - offset,
+			RowsAffected: tx.RowsAffected,
+			Err:          tx.Error,
+		})
+
+		if tx.Error != nil && batchOpts.stopOnError {
+			break
+		}
+	}
+
+	return results
+}
+
+func newBatchOpts(opts []BatchOption) *BatchOpts {
+	batchOpts := &BatchOpts{}
+	for _, opt := range opts {
+		opt.apply(batchOpts)
+	}
+
+	if batchOpts.batchSize <= 0 {
+		batchOpts.batchSize = DefaultBatchSize
+	}
+	return batchOpts
+}
+
+func prepareBaseModel(base *BaseModel, now Time) {
+	if base.Id == 0 {
+		base.Id = xid.Get()
+	}
+	if base.CreatedAt == nil {
+		createdAt := now
+		base.CreatedAt = &createdAt
+	}
+	if base.UpdatedAt == nil {
+		updatedAt := now
+		base.UpdatedAt = &updatedAt
+	}
+}
+
+func isSoftDeleteField(field *schema.Field) bool {
+	_, ok := reflect.New(field.IndirectFieldType).Interface().(schema.DeleteClausesInterface)
+	return ok
+}
+
+// T可能是模型或模型指针
+func baseModelOf[T any](row *T) *BaseModel {
+	if b, ok := interface{}(row).(baseModeler); ok {
+		return b.baseModel()
+	}
+
+	if v := reflect.ValueOf(*row); v.Kind() == reflect.Ptr && !v.IsNil() {
+		if b, ok := v.Interface().(baseModeler); ok {
+			return b.baseModel()
+		}
+	}
+	return nil
+}
+
+func appendMissing(columns []string, column string) []string {
+	for _, c := range columns {
+		if c == column {
+			return columns
+		}
+	}
+	return append(columns, column)
+}
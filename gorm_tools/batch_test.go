@@ -0,0 +1,101 @@
+package gorm_tools
+
+import (
+	"testing"
+)
+
+type testProduct struct {
+	BaseModel
+	Sku  string `gorm:"column:sku;uniqueIndex"`
+	Name string `gorm:"column:name"`
+}
+
+func TestBulkInsert(t *testing.T) {
+	db := newTestDB(t, &testProduct{})
+
+	rows := []*testProduct{{Sku: "a"}, {Sku: "b"}, {Sku: "c"}, {Sku: "a"}, {Sku: "d"}}
+	results := BulkInsert(db, rows, BatchSize(2))
+	if len(results) != 3 {
+		t.Fatalf("chunks = %d", len(results))
+	}
+
+	failed := results.Failed()
+	if len(failed) != 1 || failed[0].Chunk != 1 || failed[0].Offset != 2 || failed[0].Err == nil {
+		t.Fatalf("failed = %+v", failed)
+	}
+	if results.RowsAffected() != 3 {
+		t.Fatalf("rows affected = %d", results.RowsAffected())
+	}
+
+	for _, row := range rows {
+		if row.Id == 0 || row.CreatedAt == nil || row.UpdatedAt == nil {
+			t.Fatalf("base model not prepared: %+v", row.BaseModel)
+		}
+	}
+}
+
+func TestBulkInsertStopOnError(t *testing.T) {
+	db := newTestDB(t, &testProduct{})
+
+	rows := []testProduct{{Sku: "a"}, {Sku: "a"}, {Sku: "b"}}
+	results := BulkInsert(db, rows, BatchSize(1), StopOnError())
+	if len(results) != 2 || results.Err() == nil {
+		t.Fatalf("results = %+v", results)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	db := newTestDB(t, &testProduct{})
+
+	if err := BulkInsert(db, []*testProduct{{Sku: "a", Name: "old"}, {Sku: "b", Name: "old"}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Where("sku = ?", "b").Delete(&testProduct{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Upsert(db, []*testProduct{{Sku: "a", Name: "new"}, {Sku: "b", Name: "new"}, {Sku: "c", Name: "new"}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var products []*testProduct
+	if err := db.Order("sku").Find(&products).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || products[0].Sku != "a" || products[1].Sku != "c" {
+		t.Fatalf("soft deleted row revived: %+v", products)
+	}
+	for _, product := range products {
+		if product.Name != "new" {
+			t.Fatalf("name = %s", product.Name)
+		}
+	}
+
+	var deleted testProduct
+	if err := db.Unscoped().Where("sku = ?", "b").First(&deleted).Error; err != nil {
+		t.Fatal(err)
+	}
+	if deleted.Name != "new" || !deleted.DeletedAt.Valid {
+		t.Fatalf("deleted = %+v", deleted)
+	}
+}
+
+func TestUpsertUpdateColumns(t *testing.T) {
+	db := newTestDB(t, &testProduct{})
+
+	if err := BulkInsert(db, []*testProduct{{Sku: "a", Name: "old"}}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Upsert(db, []*testProduct{{Sku: "a", Name: "new"}}, UpdateColumns("sku")).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var product testProduct
+	if err := db.Where("sku = ?", "a").First(&product).Error; err != nil {
+		t.Fatal(err)
+	}
+	if product.Name != "old" {
+		t.Fatalf("name = %s", product.Name)
+	}
+}
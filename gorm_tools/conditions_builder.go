@@ -2,7 +2,10 @@ package gorm_tools
 
 import (
 	"fmt"
+	"strings"
+
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 const DefaultPageSize = 20
@@ -14,6 +17,13 @@ const (
 	Asc  Direction = 2
 )
 
+const (
+	LockingStrengthUpdate    = "UPDATE"
+	LockingStrengthShare     = "SHARE"
+	LockingOptionsNoWait     = "NOWAIT"
+	LockingOptionsSkipLocked = "SKIP LOCKED"
+)
+
 func (d Direction) string() string {
 	if d == Desc {
 		return "DESC"
@@ -25,11 +35,25 @@ func (d Direction) string() string {
 type (
 	Opts struct {
 		ids            []uint64
+		idsSet         bool
 		unscoped       bool
 		offset, limit  int
 		orderBy        string
+		noDefaultOrder bool
 		whereStatement string
 		args           []interface{}
+		selects        []string
+		omits          []string
+		joins          []statement
+		preloads       []statement
+		groupBy        []string
+		having         []statement
+		locking        *clause.Locking
+	}
+
+	statement struct {
+		query string
+		args  []interface{}
 	}
 
 	funcOption struct {
@@ -51,9 +75,20 @@ func newFuncQueryOption(f func(opts *Opts)) *funcOption {
 	}
 }
 
+func (opts *Opts) where(statement string, args ...interface{}) {
+	if opts.whereStatement != "" {
+		opts.whereStatement += " AND "
+	}
+
+	opts.whereStatement += statement
+	opts.args = append(opts.args, args...)
+}
+
+// Ids 按主键过滤，传入空数组时不返回任何记录
 func Ids(ids []uint64) Option {
 	return newFuncQueryOption(func(opts *Opts) {
 		opts.ids = ids
+		opts.idsSet = true
 	})
 }
 
@@ -94,114 +129,219 @@ func OrderBy(column string, directions ...Direction) Option {
 
 func Equal(column string, value interface{}) Option {
 	return newFuncQueryOption(func(opts *Opts) {
-		if opts.whereStatement != "" {
-			opts.whereStatement += " AND "
-		}
-
-		opts.whereStatement += fmt.Sprintf("%s = ?", column)
-		opts.args = append(opts.args, value)
+		opts.where(fmt.Sprintf("%s = ?", column), value)
 	})
 }
 
 func NotEqual(column string, value interface{}) Option {
 	return newFuncQueryOption(func(opts *Opts) {
-		if opts.whereStatement != "" {
-			opts.whereStatement += " AND "
-		}
-
-		opts.whereStatement += fmt.Sprintf("%s != ?", column)
-		opts.args = append(opts.args, value)
+		opts.where(fmt.Sprintf("%s != ?", column), value)
 	})
 }
 
 func Gt(column string, value interface{}) Option {
 	return newFuncQueryOption(func(opts *Opts) {
-		if opts.whereStatement != "" {
-			opts.whereStatement += " AND "
-		}
-
-		opts.whereStatement += fmt.Sprintf("%s > ?", column)
-		opts.args = append(opts.args, value)
+		opts.where(fmt.Sprintf("%s > ?", column), value)
 	})
 }
 
 func Gte(column string, value interface{}) Option {
 	return newFuncQueryOption(func(opts *Opts) {
-		if opts.whereStatement != "" {
-			opts.whereStatement += " AND "
-		}
-
-		opts.whereStatement += fmt.Sprintf("%s >= ?", column)
-		opts.args = append(opts.args, value)
+		opts.where(fmt.Sprintf("%s >= ?", column), value)
 	})
 }
 
 func Lt(column string, value interface{}) Option {
 	return newFuncQueryOption(func(opts *Opts) {
-		if opts.whereStatement != "" {
-			opts.whereStatement += " AND "
-		}
-
-		opts.whereStatement += fmt.Sprintf("%s < ?", column)
-		opts.args = append(opts.args, value)
+		opts.where(fmt.Sprintf("%s < ?", column), value)
 	})
 }
 
 func Lte(column string, value interface{}) Option {
 	return newFuncQueryOption(func(opts *Opts) {
-		if opts.whereStatement != "" {
-			opts.whereStatement += " AND "
-		}
-
-		opts.whereStatement += fmt.Sprintf("%s <= ?", column)
-		opts.args = append(opts.args, value)
+		opts.where(fmt.Sprintf("%s <= ?", column), value)
 	})
 }
 
 func In(column string, array interface{}) Option {
 	return newFuncQueryOption(func(opts *Opts) {
-		if opts.whereStatement != "" {
-			opts.whereStatement += " AND "
-		}
-
-		opts.whereStatement += fmt.Sprintf("%s in (?)", column)
-		opts.args = append(opts.args, array)
+		opts.where(fmt.Sprintf("%s in (?)", column), array)
 	})
 }
 
+// Unscoped 查询时包含已软删除的记录
 func Unscoped() Option {
 	return newFuncQueryOption(func(opts *Opts) {
 		opts.unscoped = true
 	})
 }
 
-func DB(db *gorm.DB, optList []Option) *gorm.DB {
+// NoDefaultOrder 未指定OrderBy时不再默认按id排序
+func NoDefaultOrder() Option {
+	return newFuncQueryOption(func(opts *Opts) {
+		opts.noDefaultOrder = true
+	})
+}
+
+func Select(columns ...string) Option {
+	return newFuncQueryOption(func(opts *Opts) {
+		opts.selects = append(opts.selects, columns...)
+	})
+}
+
+func Omit(columns ...string) Option {
+	return newFuncQueryOption(func(opts *Opts) {
+		opts.omits = append(opts.omits, columns...)
+	})
+}
+
+func Joins(query string, args ...interface{}) Option {
+	return newFuncQueryOption(func(opts *Opts) {
+		opts.joins = append(opts.joins, statement{query: query, args: args})
+	})
+}
+
+func Preload(association string, args ...interface{}) Option {
+	return newFuncQueryOption(func(opts *Opts) {
+		opts.preloads = append(opts.preloads, statement{query: association, args: args})
+	})
+}
+
+func GroupBy(columns ...string) Option {
+	return newFuncQueryOption(func(opts *Opts) {
+		opts.groupBy = append(opts.groupBy, columns...)
+	})
+}
+
+func Having(query string, args ...interface{}) Option {
+	return newFuncQueryOption(func(opts *Opts) {
+		opts.having = append(opts.having, statement{query: query, args: args})
+	})
+}
+
+// Locking 加锁读，strength如LockingStrengthUpdate，options如LockingOptionsNoWait
+func Locking(strength string, options ...string) Option {
+	return newFuncQueryOption(func(opts *Opts) {
+		opts.lock().Strength = strength
+		if len(options) != 0 {
+			opts.lock().Options = options[0]
+		}
+	})
+}
+
+// ForUpdate SELECT ... FOR UPDATE
+func ForUpdate() Option {
+	return Locking(LockingStrengthUpdate)
+}
+
+// ForShare SELECT ... FOR SHARE
+func ForShare() Option {
+	return Locking(LockingStrengthShare)
+}
+
+// NoWait 锁被占用时立即返回错误，未指定加锁方式时默认FOR UPDATE
+func NoWait() Option {
+	return newFuncQueryOption(func(opts *Opts) {
+		opts.lock().Options = LockingOptionsNoWait
+	})
+}
+
+// SkipLocked 跳过已被锁定的行，未指定加锁方式时默认FOR UPDATE
+func SkipLocked() Option {
+	return newFuncQueryOption(func(opts *Opts) {
+		opts.lock().Options = LockingOptionsSkipLocked
+	})
+}
+
+func (opts *Opts) lock() *clause.Locking {
+	if opts.locking == nil {
+		opts.locking = &clause.Locking{Strength: LockingStrengthUpdate}
+	}
+	return opts.locking
+}
+
+func NewOpts(optList []Option) *Opts {
 	opts := &Opts{}
 	for _, opt := range optList {
 		opt.apply(opts)
 	}
+	return opts
+}
+
+// DB 将查询条件编译到db上，db的ctx中有WithTx开启的事务时在事务中执行
+func DB(db *gorm.DB, optList []Option) *gorm.DB {
+	return NewOpts(optList).Compile(db)
+}
+
+func (opts *Opts) Compile(db *gorm.DB) *gorm.DB {
+	db = joinTx(db)
 
-	if len(opts.ids) != 0 {
-		db = db.Where("id in (?)", opts.ids)
+	if opts.unscoped {
+		db = db.Unscoped()
 	}
 
-	if opts.limit != 0 {
-		db = db.Limit(opts.limit)
+	if len(opts.selects) != 0 {
+		db = db.Select(opts.selects)
 	}
 
-	if opts.offset != 0 {
-		db = db.Offset(opts.offset)
+	if len(opts.omits) != 0 {
+		db = db.Omit(opts.omits...)
 	}
 
-	if opts.orderBy != "" {
-		db = db.Order(opts.orderBy)
-	} else {
-		db = db.Order("id")
+	for _, join := range opts.joins {
+		db = db.Joins(join.query, join.args...)
+	}
+
+	for _, preload := range opts.preloads {
+		db = db.Preload(preload.query, preload.args...)
+	}
+
+	if opts.idsSet {
+		if len(opts.ids) == 0 {
+			db = db.Where("1 = 0")
+		} else {
+			// 带上表名，Joins时不会有歧义
+			db = db.Where(clause.IN{Column: clause.Column{Table: clause.CurrentTable, Name: "id"}, Values: idValues(opts.ids)})
+		}
 	}
 
 	if opts.whereStatement != "" {
 		db = db.Where(opts.whereStatement, opts.args...)
 	}
 
+	if len(opts.groupBy) != 0 {
+		db = db.Group(strings.Join(opts.groupBy, ","))
+	}
+
+	for _, having := range opts.having {
+		db = db.Having(having.query, having.args...)
+	}
+
+	if opts.orderBy != "" {
+		db = db.Order(opts.orderBy)
+	} else if !opts.noDefaultOrder {
+		db = db.Order(clause.OrderByColumn{Column: clause.Column{Table: clause.CurrentTable, Name: "id"}})
+	}
+
+	if opts.limit != 0 {
+		db = db.Limit(opts.limit)
+	}
+
+	if opts.offset != 0 {
+		db = db.Offset(opts.offset)
+	}
+
+	if opts.locking != nil {
+		db = db.Clauses(*opts.locking)
+	}
+
 	return db
 }
+
+func idValues(ids []uint64) []interface{} {
+	values := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, id)
+	}
+	return values
+}
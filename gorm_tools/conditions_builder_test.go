@@ -0,0 +1,208 @@
+package gorm_tools
+
+import (
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type testUser struct {
+	BaseModel
+	Name   string       `gorm:"column:name"`
+	Age    int          `gorm:"column:age"`
+	Orders []*testOrder `gorm:"foreignKey:UserId"`
+}
+
+type testOrder struct {
+	BaseModel
+	UserId uint64 `gorm:"column:user_id"`
+	Amount int    `gorm:"column:amount"`
+}
+
+func seedUsers(t *testing.T, db *gorm.DB) []*testUser {
+	t.Helper()
+
+	users := []*testUser{{Name: "a", Age: 10}, {Name: "b", Age: 20}, {Name: "c", Age: 20}}
+	if err := db.Create(users).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users {
+		orders := []*testOrder{{UserId: user.Id, Amount: user.Age}, {UserId: user.Id, Amount: user.Age * 2}}
+		if err := db.Create(orders).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return users
+}
+
+func TestCompileIds(t *testing.T) {
+	db := newTestDB(t, &testUser{}, &testOrder{})
+	users := seedUsers(t, db)
+
+	var found []*testUser
+	if err := DB(db, []Option{Ids([]uint64{})}).Find(&found).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Fatalf("empty ids should match nothing, got %d", len(found))
+	}
+
+	if err := DB(db, []Option{Ids([]uint64{users[0].Id, users[2].Id})}).Find(&found).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].Id != users[0].Id || found[1].Id != users[2].Id {
+		t.Fatalf("unexpected users %+v", found)
+	}
+}
+
+func TestCompileUnscoped(t *testing.T) {
+	db := newTestDB(t, &testUser{}, &testOrder{})
+	users := seedUsers(t, db)
+	if err := db.Delete(users[0]).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	if err := DB(db.Model(&testUser{}), nil).Count(&count).Error; err != nil || count != 2 {
+		t.Fatalf("scoped count %d, err %v", count, err)
+	}
+	if err := DB(db.Model(&testUser{}), []Option{Unscoped()}).Count(&count).Error; err != nil || count != 3 {
+		t.Fatalf("unscoped count %d, err %v", count, err)
+	}
+}
+
+func TestCompileOrder(t *testing.T) {
+	db := newTestDB(t, &testUser{}, &testOrder{})
+	seedUsers(t, db)
+
+	var found []*testUser
+	if err := DB(db, []Option{OrderBy("name", Desc)}).Find(&found).Error; err != nil {
+		t.Fatal(err)
+	}
+	if found[0].Name != "c" || found[2].Name != "a" {
+		t.Fatalf("unexpected order %s %s", found[0].Name, found[2].Name)
+	}
+
+	sql := db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+		return DB(tx, nil).Find(&[]*testUser{})
+	})
+	if !strings.Contains(sql, "ORDER BY `test_users`.`id`") {
+		t.Fatalf("default order missing: %s", sql)
+	}
+
+	sql = db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+		return DB(tx, []Option{NoDefaultOrder()}).Find(&[]*testUser{})
+	})
+	if strings.Contains(sql, "ORDER BY") {
+		t.Fatalf("unexpected order: %s", sql)
+	}
+}
+
+func TestCompileSelectOmit(t *testing.T) {
+	db := newTestDB(t, &testUser{}, &testOrder{})
+	seedUsers(t, db)
+
+	var found []*testUser
+	if err := DB(db, []Option{Select("id", "name")}).Find(&found).Error; err != nil {
+		t.Fatal(err)
+	}
+	if found[0].Name == "" || found[0].Age != 0 {
+		t.Fatalf("select not applied: %+v", found[0])
+	}
+
+	if err := DB(db, []Option{Omit("name")}).Find(&found).Error; err != nil {
+		t.Fatal(err)
+	}
+	if found[0].Name != "" || found[0].Age == 0 {
+		t.Fatalf("omit not applied: %+v", found[0])
+	}
+}
+
+func TestCompileJoinsWithIds(t *testing.T) {
+	db := newTestDB(t, &testUser{}, &testOrder{})
+	users := seedUsers(t, db)
+
+	// 两张表都有id，ids和默认排序需要带表名
+	var found []*testUser
+	err := DB(db, []Option{
+		Joins("JOIN test_orders ON test_orders.user_id = test_users.id"),
+		Ids([]uint64{users[1].Id}),
+		Gt("test_orders.amount", 20),
+	}).Find(&found).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Id != users[1].Id {
+		t.Fatalf("unexpected users %+v", found)
+	}
+}
+
+func TestCompilePreload(t *testing.T) {
+	db := newTestDB(t, &testUser{}, &testOrder{})
+	users := seedUsers(t, db)
+
+	var found []*testUser
+	if err := DB(db, []Option{Ids([]uint64{users[0].Id}), Preload("Orders", "amount > ?", 10)}).Find(&found).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || len(found[0].Orders) != 1 || found[0].Orders[0].Amount != 20 {
+		t.Fatalf("unexpected preload %+v", found)
+	}
+}
+
+func TestCompileGroupByHaving(t *testing.T) {
+	db := newTestDB(t, &testUser{}, &testOrder{})
+	seedUsers(t, db)
+
+	var rows []struct {
+		Age   int
+		Total int
+	}
+	err := DB(db.Model(&testUser{}).Select("age, count(*) AS total"), []Option{
+		GroupBy("age"),
+		Having("count(*) > ?", 1),
+		NoDefaultOrder(),
+	}).Scan(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Age != 20 || rows[0].Total != 2 {
+		t.Fatalf("unexpected rows %+v", rows)
+	}
+}
+
+func TestCompilePagination(t *testing.T) {
+	db := newTestDB(t, &testUser{}, &testOrder{})
+	seedUsers(t, db)
+
+	var found []*testUser
+	if err := DB(db, []Option{OrderBy("name"), Pagination(2, 2)}).Find(&found).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Name != "c" {
+		t.Fatalf("unexpected page %+v", found)
+	}
+}
+
+func TestCompileLocking(t *testing.T) {
+	db := newTestDB(t, &testUser{})
+
+	// sqlite不支持加锁读，生成sql时会忽略FOR子句，只检查子句
+	locking := func(opts ...Option) clause.Locking {
+		stmt := DB(db.Session(&gorm.Session{DryRun: true}), opts).Find(&[]*testUser{}).Statement
+		locking, _ := stmt.Clauses["FOR"].Expression.(clause.Locking)
+		return locking
+	}
+
+	if l := locking(ForUpdate(), NoWait()); l.Strength != LockingStrengthUpdate || l.Options != LockingOptionsNoWait {
+		t.Fatalf("unexpected locking %+v", l)
+	}
+	if l := locking(SkipLocked()); l.Strength != LockingStrengthUpdate || l.Options != LockingOptionsSkipLocked {
+		t.Fatalf("unexpected locking %+v", l)
+	}
+	if l := locking(ForShare()); l.Strength != LockingStrengthShare || l.Options != "" {
+		t.Fatalf("unexpected locking %+v", l)
+	}
+}
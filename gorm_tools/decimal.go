@@ -0,0 +1,196 @@
+package gorm_tools
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal 定点数，用于金额等不能有精度损失的字段，数据库DECIMAL列以字符串读写，json序列化为字符串
+type Decimal struct {
+	unscaled *big.Int // 数值乘以10^scale
+	scale    int32
+}
+
+func NewDecimal(unscaled int64, scale int32) Decimal {
+	return Decimal{unscaled: big.NewInt(unscaled), scale: scale}
+}
+
+func NewDecimalFromString(s string) (Decimal, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Decimal{}, fmt.Errorf("can't convert empty string to decimal")
+	}
+
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i != -1 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if strings.ContainsAny(fracPart, "+-") {
+		return Decimal{}, fmt.Errorf("can't convert %s to decimal", s)
+	}
+
+	unscaled, ok := new(big.Int).SetString(intPart+fracPart, 10)
+	if !ok {
+		return Decimal{}, fmt.Errorf("can't convert %s to decimal", s)
+	}
+
+	return Decimal{unscaled: unscaled, scale: int32(len(fracPart))}, nil
+}
+
+func MustDecimal(s string) Decimal {
+	d, err := NewDecimalFromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d Decimal) value() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return d.unscaled
+}
+
+func (d Decimal) Scale() int32 {
+	return d.scale
+}
+
+// rescale 放大到更大的scale，不丢失精度
+func (d Decimal) rescale(scale int32) *big.Int {
+	if scale <= d.scale {
+		return d.value()
+	}
+
+	exp := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-d.scale)), nil)
+	return new(big.Int).Mul(d.value(), exp)
+}
+
+func maxScale(d1, d2 Decimal) int32 {
+	if d1.scale > d2.scale {
+		return d1.scale
+	}
+	return d2.scale
+}
+
+func (d Decimal) Add(d2 Decimal) Decimal {
+	scale := maxScale(d, d2)
+	return Decimal{unscaled: new(big.Int).Add(d.rescale(scale), d2.rescale(scale)), scale: scale}
+}
+
+func (d Decimal) Sub(d2 Decimal) Decimal {
+	scale := maxScale(d, d2)
+	return Decimal{unscaled: new(big.Int).Sub(d.rescale(scale), d2.rescale(scale)), scale: scale}
+}
+
+func (d Decimal) Mul(d2 Decimal) Decimal {
+	return Decimal{unscaled: new(big.Int).Mul(d.value(), d2.value()), scale: d.scale + d2.scale}
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{unscaled: new(big.Int).Neg(d.value()), scale: d.scale}
+}
+
+// Round 四舍五入到scale位小数
+func (d Decimal) Round(scale int32) Decimal {
+	if scale >= d.scale {
+		return Decimal{unscaled: d.rescale(scale), scale: scale}
+	}
+
+	exp := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d.scale-scale)), nil)
+	quo, rem := new(big.Int).QuoRem(d.value(), exp, new(big.Int))
+
+	// |rem| * 2 >= exp 时进位，远离0方向
+	if new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(exp) >= 0 {
+		if d.value().Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	return Decimal{unscaled: quo, scale: scale}
+}
+
+func (d Decimal) Cmp(d2 Decimal) int {
+	scale := maxScale(d, d2)
+	return d.rescale(scale).Cmp(d2.rescale(scale))
+}
+
+func (d Decimal) Equals(d2 Decimal) bool {
+	return d.Cmp(d2) == 0
+}
+
+func (d Decimal) Sign() int {
+	return d.value().Sign()
+}
+
+func (d Decimal) IsZero() bool {
+	return d.Sign() == 0
+}
+
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+func (d Decimal) String() string {
+	s := new(big.Int).Abs(d.value()).String()
+	if d.scale > 0 {
+		if len(s) <= int(d.scale) {
+			s = strings.Repeat("0", int(d.scale)-len(s)+1) + s
+		}
+		s = s[:len(s)-int(d.scale)] + "." + s[len(s)-int(d.scale):]
+	} else if d.scale < 0 {
+		s += strings.Repeat("0", int(-d.scale))
+	}
+
+	if d.value().Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+func (d *Decimal) Scan(value interface{}) (err error) {
+	switch v := value.(type) {
+	case nil:
+		*d = Decimal{}
+		return nil
+	case []byte:
+		*d, err = NewDecimalFromString(string(v))
+	case string:
+		*d, err = NewDecimalFromString(v)
+	case int64:
+		*d = NewDecimal(v, 0)
+	case float64:
+		*d, err = NewDecimalFromString(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		return fmt.Errorf("can't convert %v to decimal", value)
+	}
+	return
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// UnmarshalJSON 支持字符串和数字
+func (d *Decimal) UnmarshalJSON(bs []byte) (err error) {
+	s := string(bs)
+	if s == "null" || s == `""` {
+		return nil
+	}
+
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	*d, err = NewDecimalFromString(s)
+	return
+}
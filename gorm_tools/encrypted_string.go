@@ -0,0 +1,187 @@
+package gorm_tools
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	EncryptedString 入库时AES-GCM加密，查询时解密，内存中和json序列化都是明文
+	fmt、日志打印时只输出掩码，需要明文时用Plaintext()
+	密文格式: v1:<密钥id>:<base64(nonce+密文)>，密钥id用于密钥轮换后解密旧数据
+	使用前需SetKeyProvider，密钥长度16、24或32字节
+*/
+
+const (
+	encryptedStringVersion = "v1"
+	encryptedStringMask    = "******"
+)
+
+var ErrKeyProviderNotSet = errors.New("encryption key provider not set")
+
+type KeyProvider interface {
+	// CurrentKey 加密使用的密钥
+	CurrentKey() (keyId string, key []byte, err error)
+	// Key 解密时按密钥id取密钥
+	Key(keyId string) ([]byte, error)
+}
+
+// StaticKeyProvider 固定密钥，Keys中保留旧密钥用于解密
+type StaticKeyProvider struct {
+	CurrentKeyId string
+	Keys         map[string][]byte
+}
+
+func (p *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := p.Key(p.CurrentKeyId)
+	return p.CurrentKeyId, key, err
+}
+
+func (p *StaticKeyProvider) Key(keyId string) ([]byte, error) {
+	key, ok := p.Keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %s not found", keyId)
+	}
+	return key, nil
+}
+
+var (
+	keyProvider   KeyProvider
+	keyProviderMu sync.RWMutex
+)
+
+func SetKeyProvider(provider KeyProvider) {
+	keyProviderMu.Lock()
+	defer keyProviderMu.Unlock()
+	keyProvider = provider
+}
+
+func getKeyProvider() (KeyProvider, error) {
+	keyProviderMu.RLock()
+	defer keyProviderMu.RUnlock()
+	if keyProvider == nil {
+		return nil, ErrKeyProviderNotSet
+	}
+	return keyProvider, nil
+}
+
+type EncryptedString string
+
+func (s EncryptedString) Value() (driver.Value, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	provider, err := getKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	keyId, key, err := provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(s), nil)
+	return strings.Join([]string{encryptedStringVersion, keyId, base64.StdEncoding.EncodeToString(sealed)}, ":"), nil
+}
+
+func (s *EncryptedString) Scan(value interface{}) error {
+	var ciphertext string
+	switch v := value.(type) {
+	case nil:
+		*s = ""
+		return nil
+	case []byte:
+		ciphertext = string(v)
+	case string:
+		ciphertext = v
+	default:
+		return fmt.Errorf("can't convert %T to EncryptedString", value)
+	}
+
+	if ciphertext == "" {
+		*s = ""
+		return nil
+	}
+
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != encryptedStringVersion {
+		return errors.New("invalid encrypted string format")
+	}
+
+	provider, err := getKeyProvider()
+	if err != nil {
+		return err
+	}
+
+	key, err := provider.Key(parts[1])
+	if err != nil {
+		return err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return errors.New("invalid encrypted string length")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return err
+	}
+
+	*s = EncryptedString(plaintext)
+	return nil
+}
+
+// String 只返回掩码，避免%v、%s及日志字段泄露明文
+func (s EncryptedString) String() string {
+	if s == "" {
+		return ""
+	}
+	return encryptedStringMask
+}
+
+func (s EncryptedString) GoString() string {
+	return strconv.Quote(s.String())
+}
+
+func (s EncryptedString) Plaintext() string {
+	return string(s)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
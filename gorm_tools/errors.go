@@ -1,20 +1,185 @@
 package gorm_tools
 
 import (
+	"context"
+	"database/sql/driver"
 	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
 
 	"github.com/go-sql-driver/mysql"
 	"gorm.io/gorm"
 )
 
-func IsDuplicateError(err error) bool {
-	mysqlErr, ok := err.(*mysql.MySQLError)
-	if ok {
-		if mysqlErr.Number == 1062 {
-			return true
+var (
+	ErrStaleObject    = errors.New("stale object, record has been modified")
+	ErrTenantMissing  = errors.New("store id not found in context")
+	ErrTenantMismatch = errors.New("store id mismatch with context")
+)
+
+var (
+	ErrDuplicateEntry      = errors.New("duplicate entry")
+	ErrDeadlock            = errors.New("deadlock found")
+	ErrLockTimeout         = errors.New("lock wait timeout")
+	ErrForeignKeyViolation = errors.New("foreign key constraint fails")
+	ErrDataTooLong         = errors.New("data too long")
+	ErrConnectionLost      = errors.New("database connection lost")
+	ErrReadOnly            = errors.New("database is read only")
+	ErrTimeout             = errors.New("database timeout")
+)
+
+// mysql错误码 https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+var mysqlErrors = map[uint16]error{
+	1062: ErrDuplicateEntry, // ER_DUP_ENTRY
+	1586: ErrDuplicateEntry, // ER_DUP_ENTRY_WITH_KEY_NAME
+	1213: ErrDeadlock,       // ER_LOCK_DEADLOCK
+	1205: ErrLockTimeout,    // ER_LOCK_WAIT_TIMEOUT
+	3572: ErrLockTimeout,    // ER_LOCK_NOWAIT
+
+	1216: ErrForeignKeyViolation, // ER_NO_REFERENCED_ROW
+	1217: ErrForeignKeyViolation, // ER_ROW_IS_REFERENCED
+	1451: ErrForeignKeyViolation, // ER_ROW_IS_REFERENCED_2
+	1452: ErrForeignKeyViolation, // ER_NO_REFERENCED_ROW_2
+	1406: ErrDataTooLong,         // ER_DATA_TOO_LONG
+
+	1053: ErrConnectionLost, // ER_SERVER_SHUTDOWN
+	1927: ErrConnectionLost, // ER_CONNECTION_KILLED
+	2006: ErrConnectionLost, // CR_SERVER_GONE_ERROR
+	2013: ErrConnectionLost, // CR_SERVER_LOST
+
+	1792: ErrReadOnly, // ER_CANT_EXECUTE_IN_READ_ONLY_TRANSACTION
+	1836: ErrReadOnly, // ER_READ_ONLY_MODE
+	3024: ErrTimeout,  // ER_QUERY_TIMEOUT
+}
+
+// ER_OPTION_PREVENTS_STATEMENT，其他选项(如--secure-file-priv)也会返回，需按错误信息判断是否为只读
+const mysqlOptionPreventsStatement = 1290
+
+// 可重试的错误码，重试时需要重新执行整个事务
+// 连接断开时无法确定COMMIT是否成功，NOWAIT加锁失败需要立即返回，都不重试
+var retryableErrors = map[uint16]bool{
+	1213: true, // ER_LOCK_DEADLOCK
+	1205: true, // ER_LOCK_WAIT_TIMEOUT
+}
+
+var (
+	duplicateKeyRegexp = regexp.MustCompile(`for key '([^']+)'`)
+	constraintRegexp   = regexp.MustCompile("CONSTRAINT `([^`]+)`")
+)
+
+// DBError 归类后的数据库错误，errors.Is(err, ErrXxx)判断类型，errors.As可取到原始错误
+type DBError struct {
+	Kind      error
+	Number    uint16 // mysql错误码，非mysql错误为0
+	Key       string // 唯一索引或外键约束名
+	Retryable bool
+	Err       error
+}
+
+func (e *DBError) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("%s(%s): %s", e.Kind.Error(), e.Key, e.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s", e.Kind.Error(), e.Err.Error())
+}
+
+func (e *DBError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyError 将数据库错误归类为*DBError，无法归类时返回nil
+func ClassifyError(err error) *DBError {
+	if err == nil {
+		return nil
+	}
+
+	var dbErr *DBError
+	if errors.As(err, &dbErr) {
+		return dbErr
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		kind, ok := mysqlErrors[mysqlErr.Number]
+		if mysqlErr.Number == mysqlOptionPreventsStatement && strings.Contains(mysqlErr.Message, "read-only") {
+			kind, ok = ErrReadOnly, true
+		}
+		if !ok {
+			return nil
+		}
+
+		return newDBError(kind, mysqlErr.Number, errorKey(kind, mysqlErr.Message), err)
+	}
+
+	switch {
+	case errors.Is(err, mysql.ErrInvalidConn), errors.Is(err, driver.ErrBadConn):
+		return newDBError(ErrConnectionLost, 0, "", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return newDBError(ErrTimeout, 0, "", err)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return newDBError(ErrTimeout, 0, "", err)
 		}
+		return newDBError(ErrConnectionLost, 0, "", err)
 	}
-	return false
+
+	return nil
+}
+
+func newDBError(kind error, number uint16, key string, err error) *DBError {
+	return &DBError{
+		Kind:      kind,
+		Number:    number,
+		Key:       key,
+		Retryable: retryableErrors[number],
+		Err:       err,
+	}
+}
+
+func errorKey(kind error, message string) string {
+	switch kind {
+	case ErrDuplicateEntry:
+		// mysql 8.0: Duplicate entry 'x' for key 'table.key'
+		if matches := duplicateKeyRegexp.FindStringSubmatch(message); len(matches) == 2 {
+			key := matches[1]
+			if i := strings.LastIndex(key, "."); i != -1 {
+				key = key[i+1:]
+			}
+			return key
+		}
+	case ErrForeignKeyViolation:
+		if matches := constraintRegexp.FindStringSubmatch(message); len(matches) == 2 {
+			return matches[1]
+		}
+	}
+	return ""
+}
+
+func isError(err, kind error) bool {
+	dbErr := ClassifyError(err)
+	return dbErr != nil && dbErr.Kind == kind
+}
+
+func IsDuplicateError(err error) bool {
+	return isError(err, ErrDuplicateEntry)
+}
+
+// DuplicateKey 返回冲突的唯一索引名，非唯一索引冲突时返回空
+func DuplicateKey(err error) string {
+	dbErr := ClassifyError(err)
+	if dbErr == nil || dbErr.Kind != ErrDuplicateEntry {
+		return ""
+	}
+	return dbErr.Key
 }
 
 func IsRecordNotFoundError(err error) bool {
@@ -25,12 +190,40 @@ func IsRecordNotFoundError(err error) bool {
 	return errors.Is(err, gorm.ErrRecordNotFound)
 }
 
+func IsDeadlockError(err error) bool {
+	return isError(err, ErrDeadlock)
+}
+
 func LockTimeoutError(err error) bool {
-	mysqlErr, ok := err.(*mysql.MySQLError)
-	if ok {
-		if mysqlErr.Number == 1205 {
-			return true
-		}
-	}
-	return false
+	return isError(err, ErrLockTimeout)
+}
+
+func IsForeignKeyError(err error) bool {
+	return isError(err, ErrForeignKeyViolation)
+}
+
+func IsDataTooLongError(err error) bool {
+	return isError(err, ErrDataTooLong)
+}
+
+func IsConnectionLostError(err error) bool {
+	return isError(err, ErrConnectionLost)
+}
+
+func IsReadOnlyError(err error) bool {
+	return isError(err, ErrReadOnly)
+}
+
+func IsTimeoutError(err error) bool {
+	return isError(err, ErrTimeout)
+}
+
+// IsRetryableError 死锁、锁等待超时等重新执行整个事务即可成功的错误
+func IsRetryableError(err error) bool {
+	dbErr := ClassifyError(err)
+	return dbErr != nil && dbErr.Retryable
+}
+
+func IsStaleObjectError(err error) bool {
+	return errors.Is(err, ErrStaleObject)
 }
@@ -0,0 +1,63 @@
+package gorm_tools
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		name      string
+		err       error
+		kind      error
+		retryable bool
+	}{
+		{"deadlock", &mysql.MySQLError{Number: 1213}, ErrDeadlock, true},
+		{"lock wait timeout", &mysql.MySQLError{Number: 1205}, ErrLockTimeout, true},
+		{"nowait", &mysql.MySQLError{Number: 3572}, ErrLockTimeout, false},
+		{"server gone", &mysql.MySQLError{Number: 2006}, ErrConnectionLost, false},
+		{"bad conn", mysql.ErrInvalidConn, ErrConnectionLost, false},
+		{"read only", &mysql.MySQLError{Number: 1290, Message: "The MySQL server is running with the --read-only option so it cannot execute this statement"}, ErrReadOnly, false},
+		{"read only mode", &mysql.MySQLError{Number: 1836}, ErrReadOnly, false},
+		{"wrapped", fmt.Errorf("update: %w", &mysql.MySQLError{Number: 1213}), ErrDeadlock, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dbErr := ClassifyError(c.err)
+			if dbErr == nil {
+				t.Fatal("not classified")
+			}
+			if !errors.Is(dbErr, c.kind) {
+				t.Fatalf("kind = %v, want %v", dbErr.Kind, c.kind)
+			}
+			if IsRetryableError(c.err) != c.retryable {
+				t.Fatalf("retryable = %v, want %v", !c.retryable, c.retryable)
+			}
+		})
+	}
+}
+
+func TestClassifyErrorOptionPreventsStatement(t *testing.T) {
+	// 1290 其他选项导致的错误不是只读
+	err := &mysql.MySQLError{Number: 1290, Message: "The MySQL server is running with the --secure-file-priv option so it cannot execute this statement"}
+	if IsReadOnlyError(err) {
+		t.Fatal("secure-file-priv classified as read only")
+	}
+	if ClassifyError(err) != nil {
+		t.Fatal("unexpected classification")
+	}
+}
+
+func TestDuplicateKey(t *testing.T) {
+	err := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a' for key 'users.idx_name'"}
+	if !IsDuplicateError(err) {
+		t.Fatal("not duplicate")
+	}
+	if key := DuplicateKey(err); key != "idx_name" {
+		t.Fatalf("key = %s", key)
+	}
+}
@@ -0,0 +1,191 @@
+package gorm_tools
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jiangfans/handy/monitor"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+/*
+	sql监控，需先monitor.Configure开启DBEnabled，再注册MetricsPlugin:
+	metrics := &gorm_tools.MetricsPlugin{DBName: "main"}
+	db.Use(metrics)
+	defer metrics.Close()
+
+	1. 按表和操作类型统计执行次数和耗时，按归类后的错误类型统计错误数，查询不到记录记为not_found
+	2. 定时上报连接池状态，Close后停止；同一个插件注册到多个db时Close一次全部停止
+	3. 耗时超过SlowThreshold的sql打印日志，只打印占位符sql，参数只打印类型
+*/
+
+const (
+	DefaultSlowThreshold     = time.Second
+	DefaultPoolStatsInterval = 15 * time.Second
+
+	metricsStartAtKey = "gorm_tools:metrics_start_at"
+)
+
+var errorTypes = map[error]string{
+	ErrDuplicateEntry:      "duplicate_entry",
+	ErrDeadlock:            "deadlock",
+	ErrLockTimeout:         "lock_timeout",
+	ErrForeignKeyViolation: "foreign_key",
+	ErrDataTooLong:         "data_too_long",
+	ErrConnectionLost:      "connection_lost",
+	ErrReadOnly:            "read_only",
+	ErrTimeout:             "timeout",
+}
+
+type callbackRegister interface {
+	Register(name string, fn func(*gorm.DB)) error
+}
+
+type MetricsPlugin struct {
+	DBName            string        // 连接池指标的db标签
+	SlowThreshold     time.Duration // 默认1s，小于0时不打印慢查询
+	PoolStatsInterval time.Duration
+
+	stop      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+func (*MetricsPlugin) Name() string {
+	return "gorm_tools:metrics"
+}
+
+func (p *MetricsPlugin) Initialize(db *gorm.DB) error {
+	if p.SlowThreshold == 0 {
+		p.SlowThreshold = DefaultSlowThreshold
+	}
+	if p.PoolStatsInterval <= 0 {
+		p.PoolStatsInterval = DefaultPoolStatsInterval
+	}
+
+	callback := db.Callback()
+	register := []struct {
+		operation     string
+		before, after callbackRegister
+	}{
+		{"create", callback.Create().Before("*"), callback.Create().After("*")},
+		{"query", callback.Query().Before("*"), callback.Query().After("*")},
+		{"update", callback.Update().Before("*"), callback.Update().After("*")},
+		{"delete", callback.Delete().Before("*"), callback.Delete().After("*")},
+		{"row", callback.Row().Before("*"), callback.Row().After("*")},
+		{"raw", callback.Raw().Before("*"), callback.Raw().After("*")},
+	}
+
+	for _, r := range register {
+		if err := r.before.Register(p.Name()+":before_"+r.operation, p.before); err != nil {
+			return err
+		}
+		if err := r.after.Register(p.Name()+":after_"+r.operation, p.after(r.operation)); err != nil {
+			return err
+		}
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	p.startOnce.Do(func() {
+		p.stop = make(chan struct{})
+	})
+
+	p.wg.Add(1)
+	go p.reportPoolStats(sqlDB)
+	return nil
+}
+
+// Close 停止上报连接池状态，等待上报的goroutine退出
+func (p *MetricsPlugin) Close() {
+	p.stopOnce.Do(func() {
+		if p.stop != nil {
+			close(p.stop)
+		}
+	})
+	p.wg.Wait()
+}
+
+func (p *MetricsPlugin) before(db *gorm.DB) {
+	db.InstanceSet(metricsStartAtKey, time.Now())
+}
+
+func (p *MetricsPlugin) after(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		value, ok := db.InstanceGet(metricsStartAtKey)
+		if !ok {
+			return
+		}
+		startAt := value.(time.Time)
+		table := db.Statement.Table
+
+		monitor.ReportDBQueryTotal(table, operation)
+		monitor.ReportDBQueryTimeCost(startAt, table, operation)
+
+		if db.Error != nil {
+			monitor.ReportDBQueryErrorTotal(table, operation, errorType(db.Error))
+		}
+
+		if elapsed := time.Since(startAt); p.SlowThreshold > 0 && elapsed >= p.SlowThreshold {
+			log.WithFields(log.Fields{
+				"table":     table,
+				"operation": operation,
+				"elapsed":   elapsed.Milliseconds(),
+				"rows":      db.RowsAffected,
+				"vars":      redactVars(db.Statement.Vars),
+			}).Warn("slow sql: " + db.Statement.SQL.String())
+		}
+	}
+}
+
+func errorType(err error) string {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "not_found"
+	}
+
+	if dbErr := ClassifyError(err); dbErr != nil {
+		if t, ok := errorTypes[dbErr.Kind]; ok {
+			return t
+		}
+	}
+
+	if errors.Is(err, ErrStaleObject) {
+		return "stale_object"
+	}
+	return "other"
+}
+
+// 参数可能包含隐私数据，只保留类型
+func redactVars(vars []interface{}) string {
+	types := make([]string, 0, len(vars))
+	for _, v := range vars {
+		types = append(types, fmt.Sprintf("%T", v))
+	}
+	return "[" + strings.Join(types, " ") + "]"
+}
+
+func (p *MetricsPlugin) reportPoolStats(sqlDB *sql.DB) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.PoolStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		monitor.ReportDBPoolStats(p.DBName, sqlDB.Stats())
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
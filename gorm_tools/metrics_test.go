@@ -0,0 +1,177 @@
+package gorm_tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jiangfans/handy/monitor"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"gorm.io/gorm"
+)
+
+const testMetricsNamespace = "gorm_tools_test"
+
+var configureMetricsOnce sync.Once
+
+// 进程内只能配置一次，指标在测试间累计，断言时比较差值
+func configureTestMetrics(t *testing.T) {
+	t.Helper()
+
+	var err error
+	configureMetricsOnce.Do(func() {
+		err = monitor.Configure(&monitor.Config{Namespace: testMetricsNamespace, DBEnabled: true})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value float64
+	for _, family := range families {
+		if family.GetName() != testMetricsNamespace+"_"+name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if v, ok := labels[label.GetName()]; ok && v == label.GetValue() {
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				value += metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return value
+}
+
+func TestErrorType(t *testing.T) {
+	cases := map[string]error{
+		"not_found":       fmt.Errorf("find user: %w", gorm.ErrRecordNotFound),
+		"duplicate_entry": &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a' for key 'users.uk_name'"},
+		"deadlock":        &mysql.MySQLError{Number: 1213, Message: "Deadlock found"},
+		"timeout":         fmt.Errorf("query: %w", context.DeadlineExceeded),
+		"stale_object":    ErrStaleObject,
+		"other":           errors.New("syntax error"),
+	}
+
+	for want, err := range cases {
+		if got := errorType(err); got != want {
+			t.Errorf("errorType(%v) = %s, want %s", err, got, want)
+		}
+	}
+}
+
+func TestRedactVars(t *testing.T) {
+	if vars := redactVars([]interface{}{"secret@example.com", 18, nil, time.Time{}}); vars != "[string int <nil> time.Time]" {
+		t.Fatalf("vars = %s", vars)
+	}
+}
+
+func TestMetricsPlugin(t *testing.T) {
+	configureTestMetrics(t)
+
+	db := newTestDB(t, &testProduct{})
+	plugin := &MetricsPlugin{DBName: "metrics_test", SlowThreshold: -1}
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close()
+
+	queryLabels := map[string]string{"table": "test_products", "operation": "query"}
+	notFoundLabels := map[string]string{"table": "test_products", "operation": "query", "error_type": "not_found"}
+	otherLabels := map[string]string{"table": "test_products", "operation": "create", "error_type": "other"}
+	queries, notFound, other := metricValue(t, "built_in_db_query_total", queryLabels),
+		metricValue(t, "built_in_db_query_error_total", notFoundLabels),
+		metricValue(t, "built_in_db_query_error_total", otherLabels)
+
+	if err := db.Create(&testProduct{Sku: "a"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// sqlite的唯一键冲突无法归类
+	if err := db.Create(&testProduct{Sku: "a"}).Error; err == nil {
+		t.Fatal("duplicate sku")
+	}
+	var product testProduct
+	if err := db.First(&product, "sku = ?", "b").Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v", err)
+	}
+
+	if got := metricValue(t, "built_in_db_query_total", queryLabels) - queries; got != 1 {
+		t.Fatalf("queries = %v", got)
+	}
+	if got := metricValue(t, "built_in_db_query_error_total", notFoundLabels) - notFound; got != 1 {
+		t.Fatalf("not found = %v", got)
+	}
+	if got := metricValue(t, "built_in_db_query_error_total", otherLabels) - other; got != 1 {
+		t.Fatalf("other = %v", got)
+	}
+	if got := metricValue(t, "built_in_db_pool_stats", map[string]string{"db": "metrics_test", "stat": "max_open"}); got != 1 {
+		t.Fatalf("max open = %v", got)
+	}
+}
+
+func TestMetricsSlowQuery(t *testing.T) {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	db := newTestDB(t, &testProduct{})
+	plugin := &MetricsPlugin{SlowThreshold: time.Nanosecond}
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close()
+
+	var products []*testProduct
+	if err := db.Where("sku = ?", "secret-sku").Find(&products).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil || !strings.HasPrefix(entry.Message, "slow sql: SELECT") || entry.Data["vars"] != "[string]" {
+		t.Fatalf("entry = %+v", entry)
+	}
+	if strings.Contains(fmt.Sprint(entry.Message, entry.Data), "secret-sku") {
+		t.Fatalf("vars not redacted: %+v", entry)
+	}
+}
+
+func TestMetricsPluginClose(t *testing.T) {
+	plugin := &MetricsPlugin{PoolStatsInterval: time.Millisecond}
+	for i := 0; i < 2; i++ {
+		if err := newTestDB(t).Use(plugin); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		plugin.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("pool stats goroutines not stopped")
+	}
+	// 重复Close不会panic
+	plugin.Close()
+}
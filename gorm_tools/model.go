@@ -17,41 +17,60 @@ var _ = faker.AddProvider("primary_id", func(v reflect.Value) (interface{}, erro
 	return value, nil
 })
 
+// BaseModel 创建时生成id，created_at、updated_at由TimestampPlugin维护，没有注册TimestampPlugin时由hook兜底
 type BaseModel struct {
 	// id
 	Id uint64 `gorm:"column:id" faker:"primary_id" json:"id" example:"94344029373746188"`
 	// 创建时间
-	CreatedAt *Time `gorm:"column:created_at" faker:"-" json:"created_at" example:"2022-10-24T00:00:00Z"`
+	CreatedAt *Time `gorm:"column:created_at;autoCreateTime:false" faker:"-" json:"created_at" example:"2022-10-24T00:00:00Z"`
 	// 更新时间
-	UpdatedAt *Time          `gorm:"column:updated_at" faker:"-" json:"updated_at" example:"2022-10-24T00:00:00Z"`
+	UpdatedAt *Time          `gorm:"column:updated_at;autoUpdateTime:false" faker:"-" json:"updated_at" example:"2022-10-24T00:00:00Z"`
 	DeletedAt gorm.DeletedAt `gorm:"column:deleted_at" faker:"-" json:"-"`
 }
 
+func (b *BaseModel) baseModel() *BaseModel {
+	return b
+}
+
+type baseModeler interface {
+	baseModel() *BaseModel
+}
+
 func (b *BaseModel) BeforeCreate(tx *gorm.DB) (err error) {
-	now := time.Now()
 	if b.Id == 0 {
 		tx.Statement.SetColumn("id", xid.Get())
 	}
 
-	createdAt, updatedAt := Time(now), Time(now)
-	tx.Statement.SetColumn("created_at", &createdAt)
-	tx.Statement.SetColumn("updated_at", &updatedAt)
+	if !hasTimestampPlugin(tx) {
+		now := Time(time.Now().UTC())
+		if b.CreatedAt == nil {
+			tx.Statement.SetColumn(createdAtColumn, &now)
+		}
+		if b.UpdatedAt == nil {
+			tx.Statement.SetColumn(updatedAtColumn, &now)
+		}
+	}
 	return
 }
 
-func (b *BaseModel) AfterUpdate(tx *gorm.DB) (err error) {
-	tx.Statement.SetColumn("updated_at", Time(time.Now()))
+func (b *BaseModel) BeforeUpdate(tx *gorm.DB) (err error) {
+	if !hasTimestampPlugin(tx) {
+		(&TimestampPlugin{}).update(tx)
+	}
 	return
 }
 
 // ________
 
+// CreatedAt created_at由TimestampPlugin维护，没有注册TimestampPlugin时由hook兜底
 type CreatedAt struct {
 	// 创建时间
-	CreatedAt Time `gorm:"column:created_at" faker:"-" json:"created_at" example:"2021-11-01T00:00:00Z"`
+	CreatedAt Time `gorm:"column:created_at;autoCreateTime:false" faker:"-" json:"created_at" example:"2021-11-01T00:00:00Z"`
 }
 
 func (c *CreatedAt) BeforeCreate(tx *gorm.DB) (err error) {
-	tx.Statement.SetColumn("created_at", Time(time.Now()))
+	if !hasTimestampPlugin(tx) && time.Time(c.CreatedAt).IsZero() {
+		tx.Statement.SetColumn(createdAtColumn, Time(time.Now().UTC()))
+	}
 	return
 }
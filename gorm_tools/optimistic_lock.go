@@ -0,0 +1,127 @@
+package gorm_tools
+
+import (
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+	乐观锁，模型嵌入VersionedModel（或BaseModel加OptimisticLock）并注册OptimisticLockPlugin后生效:
+	db.Use(gorm_tools.OptimisticLockPlugin{})
+
+	更新时追加 WHERE version = ? 并将version加1，未更新到记录时返回ErrStaleObject
+	version为0（未从数据库加载的模型）时不做检查
+
+	Version不直接放在BaseModel中，否则所有嵌入BaseModel的表都要加version列
+*/
+
+const (
+	versionColumn            = "version"
+	optimisticLockVersionKey = "gorm_tools:optimistic_lock_version"
+)
+
+type OptimisticLock struct {
+	// 版本号
+	Version int64 `gorm:"column:version" faker:"-" json:"version" example:"1"`
+}
+
+// VersionedModel 带乐观锁版本号的BaseModel
+type VersionedModel struct {
+	BaseModel
+	OptimisticLock
+}
+
+func (l *OptimisticLock) optimisticLock() *OptimisticLock {
+	return l
+}
+
+type optimisticLocker interface {
+	optimisticLock() *OptimisticLock
+}
+
+type OptimisticLockPlugin struct{}
+
+func (OptimisticLockPlugin) Name() string {
+	return "gorm_tools:optimistic_lock"
+}
+
+func (p OptimisticLockPlugin) Initialize(db *gorm.DB) error {
+	err := db.Callback().Create().Before("gorm:create").Register(p.Name()+":init_version", initVersion)
+	if err != nil {
+		return err
+	}
+
+	err = db.Callback().Update().Before("gorm:update").Register(p.Name()+":check_version", checkVersion)
+	if err != nil {
+		return err
+	}
+
+	return db.Callback().Update().After("gorm:update").Before("gorm:after_update").Register(p.Name()+":stale_object", staleObject)
+}
+
+func initVersion(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+
+	eachStruct(db.Statement.ReflectValue, func(value reflect.Value) {
+		if l := lockerOf(value); l != nil && l.Version == 0 {
+			l.Version = 1
+		}
+	})
+}
+
+func checkVersion(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+
+	l := lockerOf(db.Statement.ReflectValue)
+	if l == nil || l.Version == 0 {
+		return
+	}
+
+	version := l.Version
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: versionColumn}, Value: version},
+	}})
+
+	if len(db.Statement.Selects) != 0 {
+		db.Statement.Selects = append(db.Statement.Selects, versionColumn)
+	}
+	db.Statement.SetColumn(versionColumn, version+1, true)
+	db.InstanceSet(optimisticLockVersionKey, version)
+}
+
+func staleObject(db *gorm.DB) {
+	version, ok := db.InstanceGet(optimisticLockVersionKey)
+	if !ok || db.DryRun {
+		return
+	}
+
+	if db.Error == nil && db.RowsAffected != 0 {
+		return
+	}
+
+	// 更新失败，还原内存中的版本号
+	if l := lockerOf(db.Statement.ReflectValue); l != nil {
+		l.Version = version.(int64)
+	}
+
+	if db.Error == nil {
+		_ = db.AddError(ErrStaleObject)
+	}
+}
+
+func lockerOf(value reflect.Value) *OptimisticLock {
+	if value.Kind() != reflect.Struct || !value.CanAddr() {
+		return nil
+	}
+
+	if l, ok := value.Addr().Interface().(optimisticLocker); ok {
+		return l.optimisticLock()
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package gorm_tools
+
+import (
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+type testStock struct {
+	VersionedModel
+	Sku      string `gorm:"column:sku"`
+	Quantity int    `gorm:"column:quantity"`
+}
+
+func newOptimisticLockTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db := newTestDB(t, &testStock{})
+	if err := db.Use(OptimisticLockPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func createStock(t *testing.T, db *gorm.DB) *testStock {
+	t.Helper()
+
+	stock := &testStock{Sku: "a", Quantity: 10}
+	if err := db.Create(stock).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stock.Version != 1 {
+		t.Fatalf("version = %d", stock.Version)
+	}
+	return stock
+}
+
+func loadStock(t *testing.T, db *gorm.DB, id uint64) *testStock {
+	t.Helper()
+
+	var stock testStock
+	if err := db.First(&stock, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &stock
+}
+
+func TestOptimisticLockSave(t *testing.T) {
+	db := newOptimisticLockTestDB(t)
+	id := createStock(t, db).Id
+
+	first, second := loadStock(t, db, id), loadStock(t, db, id)
+
+	first.Quantity = 9
+	if err := db.Save(first).Error; err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != 2 {
+		t.Fatalf("version = %d", first.Version)
+	}
+
+	second.Quantity = 8
+	if err := db.Save(second).Error; !errors.Is(err, ErrStaleObject) || !IsStaleObjectError(err) {
+		t.Fatalf("err = %v", err)
+	}
+	// 失败后版本号不变，可以重新加载后再更新
+	if second.Version != 1 {
+		t.Fatalf("version = %d", second.Version)
+	}
+
+	stock := loadStock(t, db, id)
+	if stock.Quantity != 9 || stock.Version != 2 {
+		t.Fatalf("stock = %+v", stock)
+	}
+}
+
+func TestOptimisticLockUpdates(t *testing.T) {
+	db := newOptimisticLockTestDB(t)
+	id := createStock(t, db).Id
+
+	first, second := loadStock(t, db, id), loadStock(t, db, id)
+
+	if err := db.Model(first).Updates(map[string]interface{}{"quantity": 7}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(second).Updates(&testStock{Quantity: 6}).Error; !errors.Is(err, ErrStaleObject) {
+		t.Fatalf("err = %v", err)
+	}
+	if err := db.Model(second).Update("quantity", 6).Error; !errors.Is(err, ErrStaleObject) {
+		t.Fatalf("err = %v", err)
+	}
+
+	stock := loadStock(t, db, id)
+	if stock.Quantity != 7 || stock.Version != 2 {
+		t.Fatalf("stock = %+v", stock)
+	}
+
+	// Select时也要更新version
+	if err := db.Model(stock).Select("quantity").Updates(&testStock{Quantity: 5}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stock = loadStock(t, db, id); stock.Quantity != 5 || stock.Version != 3 {
+		t.Fatalf("stock = %+v", stock)
+	}
+}
+
+func TestOptimisticLockZeroVersion(t *testing.T) {
+	db := newOptimisticLockTestDB(t)
+	id := createStock(t, db).Id
+
+	// 未从数据库加载的模型不检查版本
+	stock := &testStock{}
+	stock.Id = id
+	if err := db.Model(stock).Updates(map[string]interface{}{"quantity": 3}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stock = loadStock(t, db, id); stock.Quantity != 3 || stock.Version != 1 {
+		t.Fatalf("stock = %+v", stock)
+	}
+}
@@ -0,0 +1,124 @@
+package gorm_tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	xid "gitlab.shoplazza.site/common/common-xid"
+	"gorm.io/gorm"
+)
+
+/*
+	事务发件箱，事件与业务数据在同一事务中写入outbox_events表，由outbox.Relay投递到kafka/sqs
+
+	CREATE TABLE `outbox_events` (
+	  `id` bigint unsigned NOT NULL,
+	  `topic` varchar(255) NOT NULL,
+	  `key` varchar(255) NOT NULL DEFAULT '',
+	  `payload` json DEFAULT NULL,
+	  `headers` json DEFAULT NULL,
+	  `status` tinyint NOT NULL DEFAULT 0,
+	  `attempts` int NOT NULL DEFAULT 0,
+	  `last_error` varchar(1024) NOT NULL DEFAULT '',
+	  `next_retry_at` datetime(6) NOT NULL,
+	  `sent_at` datetime(6) DEFAULT NULL,
+	  `created_at` datetime(6) DEFAULT NULL,
+	  PRIMARY KEY (`id`),
+	  KEY `idx_status_next_retry_at` (`status`,`next_retry_at`)
+	);
+*/
+
+const DefaultOutboxTable = "outbox_events"
+
+const (
+	OutboxStatusPending int8 = 0
+	OutboxStatusSent    int8 = 1
+	OutboxStatusFailed  int8 = 2 // 超过最大重试次数
+)
+
+var ErrOutboxWithoutTx = errors.New("outbox event must be added in a transaction")
+
+type OutboxEvent struct {
+	Id          uint64 `gorm:"column:id" json:"id"`
+	Topic       string `gorm:"column:topic" json:"topic"`
+	Key         string `gorm:"column:key" json:"key"`
+	Payload     Json   `gorm:"column:payload" json:"payload"`
+	Headers     Json   `gorm:"column:headers" json:"headers"`
+	Status      int8   `gorm:"column:status" json:"status"`
+	Attempts    int    `gorm:"column:attempts" json:"attempts"`
+	LastError   string `gorm:"column:last_error" json:"last_error"`
+	NextRetryAt *Time  `gorm:"column:next_retry_at" json:"next_retry_at"`
+	SentAt      *Time  `gorm:"column:sent_at" json:"sent_at"`
+	CreatedAt   *Time  `gorm:"column:created_at;autoCreateTime:false" json:"created_at"`
+}
+
+func (*OutboxEvent) TableName() string {
+	return DefaultOutboxTable
+}
+
+// HeaderMap 解析Headers
+func (e *OutboxEvent) HeaderMap() (map[string]string, error) {
+	headers := make(map[string]string)
+	if e.Headers.IsNull() {
+		return headers, nil
+	}
+
+	err := json.Unmarshal(e.Headers, &headers)
+	return headers, err
+}
+
+// NewOutboxEvent payload按json序列化
+func NewOutboxEvent(topic, key string, payload interface{}, headers map[string]string) (*OutboxEvent, error) {
+	payloadBs, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &OutboxEvent{
+		Topic:   topic,
+		Key:     key,
+		Payload: payloadBs,
+	}
+
+	if len(headers) != 0 {
+		headersBs, err := json.Marshal(headers)
+		if err != nil {
+			return nil, err
+		}
+		event.Headers = headersBs
+	}
+
+	return event, nil
+}
+
+// AddOutboxEvent 在当前事务中写入事件，ctx中的事务（WithTx）优先，否则db须为事务
+func AddOutboxEvent(ctx context.Context, db *gorm.DB, events ...*OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	tx := DBFromContext(ctx, db)
+	if _, ok := tx.Statement.ConnPool.(gorm.TxCommitter); !ok {
+		return ErrOutboxWithoutTx
+	}
+
+	now := Time(time.Now().UTC())
+	for _, event := range events {
+		if event.Id == 0 {
+			event.Id = xid.Get()
+		}
+		event.Status = OutboxStatusPending
+		if event.CreatedAt == nil {
+			createdAt := now
+			event.CreatedAt = &createdAt
+		}
+		if event.NextRetryAt == nil {
+			nextRetryAt := now
+			event.NextRetryAt = &nextRetryAt
+		}
+	}
+
+	return tx.Create(events).Error
+}
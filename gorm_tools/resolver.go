@@ -0,0 +1,276 @@
+package gorm_tools
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jiangfans/handy/monitor"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+/*
+	读写分离，查询按权重路由到健康的从库，需注册ResolverPlugin:
+	resolver := &gorm_tools.ResolverPlugin{Replicas: []gorm_tools.Replica{{Name: "replica1", DB: sqlDB, Weight: 1}}}
+	db.Use(resolver)
+	defer resolver.Close()
+
+	以下情况走主库:
+	1. 事务中
+	2. 加锁读（FOR UPDATE、FOR SHARE）
+	3. ctx经过UsePrimary
+	4. ctx经过WithReadYourWrites（或middlewares.ReadYourWrites），且同一ctx最近ReadYourWritesWindow内有写操作
+	5. 没有健康的从库
+*/
+
+const (
+	DefaultReadYourWritesWindow = 3 * time.Second
+	DefaultHealthCheckInterval  = 5 * time.Second
+	DefaultHealthCheckTimeout   = time.Second
+
+	primaryTarget = "primary"
+)
+
+const (
+	routeReasonReplica        = "replica"
+	routeReasonTransaction    = "transaction"
+	routeReasonLocking        = "locking"
+	routeReasonForced         = "forced"
+	routeReasonReadYourWrites = "read_your_writes"
+	routeReasonNoReplica      = "no_healthy_replica"
+)
+
+type Replica struct {
+	Name   string
+	DB     gorm.ConnPool // 一般为*sql.DB
+	Weight int           // 默认1
+}
+
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+type replica struct {
+	Replica
+	healthy int32
+}
+
+type (
+	usePrimaryKey     struct{}
+	readYourWritesKey struct{}
+)
+
+type writeMarker struct {
+	lastWrite int64 // unix nano
+}
+
+// UsePrimary 强制走主库
+func UsePrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, usePrimaryKey{}, true)
+}
+
+// WithReadYourWrites 同一ctx写入后一段时间内的读走主库，一般每个请求调用一次
+func WithReadYourWrites(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(readYourWritesKey{}).(*writeMarker); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, readYourWritesKey{}, &writeMarker{})
+}
+
+type ResolverPlugin struct {
+	Replicas             []Replica
+	ReadYourWritesWindow time.Duration
+	HealthCheckInterval  time.Duration
+	HealthCheckTimeout   time.Duration
+
+	replicas []*replica
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func (*ResolverPlugin) Name() string {
+	return "gorm_tools:resolver"
+}
+
+func (p *ResolverPlugin) Initialize(db *gorm.DB) error {
+	if len(p.Replicas) == 0 {
+		return errors.New("resolver replicas can't be empty")
+	}
+
+	if p.ReadYourWritesWindow <= 0 {
+		p.ReadYourWritesWindow = DefaultReadYourWritesWindow
+	}
+	if p.HealthCheckInterval <= 0 {
+		p.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if p.HealthCheckTimeout <= 0 {
+		p.HealthCheckTimeout = DefaultHealthCheckTimeout
+	}
+
+	for _, r := range p.Replicas {
+		if r.DB == nil {
+			return errors.New("resolver replica db can't be nil")
+		}
+		if r.Weight <= 0 {
+			r.Weight = 1
+		}
+		p.replicas = append(p.replicas, &replica{Replica: r, healthy: 1})
+	}
+
+	callback := db.Callback()
+	if err := callback.Query().Before("gorm:query").Register(p.Name()+":query", p.route); err != nil {
+		return err
+	}
+	if err := callback.Row().Before("gorm:row").Register(p.Name()+":row", p.route); err != nil {
+		return err
+	}
+	if err := callback.Create().After("gorm:create").Register(p.Name()+":create", p.markWrite); err != nil {
+		return err
+	}
+	if err := callback.Update().After("gorm:update").Register(p.Name()+":update", p.markWrite); err != nil {
+		return err
+	}
+	if err := callback.Delete().After("gorm:delete").Register(p.Name()+":delete", p.markWrite); err != nil {
+		return err
+	}
+	if err := callback.Raw().After("gorm:raw").Register(p.Name()+":raw", p.markWrite); err != nil {
+		return err
+	}
+
+	p.stop = make(chan struct{})
+	go p.healthCheck()
+	return nil
+}
+
+// Close 停止健康检查，不关闭从库连接
+func (p *ResolverPlugin) Close() {
+	p.once.Do(func() {
+		if p.stop != nil {
+			close(p.stop)
+		}
+	})
+}
+
+func (p *ResolverPlugin) route(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+
+	target, reason := p.resolve(db)
+	monitor.ReportDBRouteTotal(target, reason)
+	if target == primaryTarget {
+		return
+	}
+
+	for _, r := range p.replicas {
+		if r.Name == target {
+			db.Statement.ConnPool = r.DB
+			return
+		}
+	}
+}
+
+func (p *ResolverPlugin) resolve(db *gorm.DB) (target, reason string) {
+	if _, ok := db.Statement.ConnPool.(gorm.TxCommitter); ok {
+		return primaryTarget, routeReasonTransaction
+	}
+
+	if _, ok := db.Statement.Clauses["FOR"]; ok {
+		return primaryTarget, routeReasonLocking
+	}
+
+	ctx := db.Statement.Context
+	if forced, _ := ctx.Value(usePrimaryKey{}).(bool); forced {
+		return primaryTarget, routeReasonForced
+	}
+
+	if marker, ok := ctx.Value(readYourWritesKey{}).(*writeMarker); ok {
+		if lastWrite := atomic.LoadInt64(&marker.lastWrite); lastWrite != 0 &&
+			time.Since(time.Unix(0, lastWrite)) < p.ReadYourWritesWindow {
+			return primaryTarget, routeReasonReadYourWrites
+		}
+	}
+
+	if r := p.pick(); r != nil {
+		return r.Name, routeReasonReplica
+	}
+	return primaryTarget, routeReasonNoReplica
+}
+
+// 按权重随机选择健康的从库
+func (p *ResolverPlugin) pick() *replica {
+	var total int
+	for _, r := range p.replicas {
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			total += r.Weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.Intn(total)
+	for _, r := range p.replicas {
+		if atomic.LoadInt32(&r.healthy) != 1 {
+			continue
+		}
+
+		if n < r.Weight {
+			return r
+		}
+		n -= r.Weight
+	}
+	return nil
+}
+
+func (p *ResolverPlugin) markWrite(db *gorm.DB) {
+	if marker, ok := db.Statement.Context.Value(readYourWritesKey{}).(*writeMarker); ok {
+		atomic.StoreInt64(&marker.lastWrite, time.Now().UnixNano())
+	}
+}
+
+func (p *ResolverPlugin) healthCheck() {
+	ticker := time.NewTicker(p.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		p.checkReplicas()
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *ResolverPlugin) checkReplicas() {
+	for _, r := range p.replicas {
+		pg, ok := r.DB.(pinger)
+		if !ok {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), p.HealthCheckTimeout)
+		err := pg.PingContext(ctx)
+		cancel()
+
+		var healthy int32 = 1
+		if err != nil {
+			healthy = 0
+		}
+
+		if atomic.SwapInt32(&r.healthy, healthy) != healthy {
+			if healthy == 1 {
+				log.Infof("db replica %s recovered", r.Name)
+			} else {
+				log.WithError(err).Errorf("db replica %s unhealthy", r.Name)
+			}
+		}
+		monitor.ReportDBReplicaUp(r.Name, healthy == 1)
+	}
+}
@@ -0,0 +1,192 @@
+package gorm_tools
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// testReplica 可以控制ping结果的从库
+type testReplica struct {
+	*sql.DB
+	down  int32
+	pings int32
+}
+
+func (r *testReplica) PingContext(ctx context.Context) error {
+	atomic.AddInt32(&r.pings, 1)
+	if atomic.LoadInt32(&r.down) == 1 {
+		return errors.New("replica down")
+	}
+	return r.DB.PingContext(ctx)
+}
+
+// openNamedTestDB 文件数据库，主库和从库是两个不同的库，记录name区分查询落在哪个库
+func openNamedTestDB(t *testing.T, name string) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), name+".db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	if err := db.AutoMigrate(&testUser{}); err != nil {
+		t.Fatal(err)
+	}
+	user := &testUser{Name: name}
+	user.Id = 1
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newResolverTestDB(t *testing.T, window time.Duration) (*gorm.DB, *ResolverPlugin, *testReplica) {
+	t.Helper()
+
+	db := openNamedTestDB(t, primaryTarget)
+	replicaDB, err := openNamedTestDB(t, "replica").DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replica := &testReplica{DB: replicaDB}
+	plugin := &ResolverPlugin{
+		Replicas:             []Replica{{Name: "replica", DB: replica}},
+		ReadYourWritesWindow: window,
+		HealthCheckInterval:  time.Hour,
+	}
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(plugin.Close)
+
+	// 等第一次健康检查结束，之后由测试手动检查
+	for atomic.LoadInt32(&replica.pings) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return db, plugin, replica
+}
+
+func routedTo(t *testing.T, db *gorm.DB) string {
+	t.Helper()
+
+	var user testUser
+	if err := db.First(&user, 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user.Name
+}
+
+func TestResolverRoute(t *testing.T) {
+	db, _, _ := newResolverTestDB(t, time.Hour)
+	ctx := context.Background()
+
+	if target := routedTo(t, db.WithContext(ctx)); target != "replica" {
+		t.Fatalf("query routed to %s", target)
+	}
+
+	var count int64
+	if err := db.Model(&testUser{}).Where("name = ?", "replica").Count(&count).Error; err != nil || count != 1 {
+		t.Fatalf("count routed to primary, count = %d, err = %v", count, err)
+	}
+
+	if target := routedTo(t, db.Clauses(clause.Locking{Strength: LockingStrengthUpdate})); target != primaryTarget {
+		t.Fatalf("locking read routed to %s", target)
+	}
+	if target := routedTo(t, db.WithContext(UsePrimary(ctx))); target != primaryTarget {
+		t.Fatalf("forced read routed to %s", target)
+	}
+
+	_ = db.Transaction(func(tx *gorm.DB) error {
+		if target := routedTo(t, tx); target != primaryTarget {
+			t.Errorf("transaction read routed to %s", target)
+		}
+		return nil
+	})
+	_ = WithTx(ctx, db, func(ctx context.Context, tx *gorm.DB) error {
+		if target := routedTo(t, DB(db.WithContext(ctx), nil)); target != primaryTarget {
+			t.Errorf("WithTx read routed to %s", target)
+		}
+		return nil
+	})
+}
+
+func TestResolverReadYourWrites(t *testing.T) {
+	db, _, _ := newResolverTestDB(t, 50*time.Millisecond)
+	ctx := WithReadYourWrites(context.Background())
+
+	if target := routedTo(t, db.WithContext(ctx)); target != "replica" {
+		t.Fatalf("read before write routed to %s", target)
+	}
+
+	if err := db.WithContext(ctx).Model(&testUser{}).Where("id = ?", 1).Update("age", 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if target := routedTo(t, db.WithContext(ctx)); target != primaryTarget {
+		t.Fatalf("read after write routed to %s", target)
+	}
+	// 其他请求不受影响
+	if target := routedTo(t, db.WithContext(WithReadYourWrites(context.Background()))); target != "replica" {
+		t.Fatalf("other request routed to %s", target)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if target := routedTo(t, db.WithContext(ctx)); target != "replica" {
+		t.Fatalf("read after window routed to %s", target)
+	}
+}
+
+func TestResolverHealthCheck(t *testing.T) {
+	db, plugin, replica := newResolverTestDB(t, time.Hour)
+
+	atomic.StoreInt32(&replica.down, 1)
+	plugin.checkReplicas()
+	if target := routedTo(t, db); target != primaryTarget {
+		t.Fatalf("read with unhealthy replica routed to %s", target)
+	}
+
+	atomic.StoreInt32(&replica.down, 0)
+	plugin.checkReplicas()
+	if target := routedTo(t, db); target != "replica" {
+		t.Fatalf("read after recovery routed to %s", target)
+	}
+}
+
+func TestResolverPick(t *testing.T) {
+	plugin := &ResolverPlugin{replicas: []*replica{
+		{Replica: Replica{Name: "a", Weight: 3}, healthy: 1},
+		{Replica: Replica{Name: "b", Weight: 1}, healthy: 1},
+		{Replica: Replica{Name: "c", Weight: 100}, healthy: 0},
+	}}
+
+	picked := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		picked[plugin.pick().Name]++
+	}
+	if picked["c"] != 0 {
+		t.Fatalf("unhealthy replica picked: %v", picked)
+	}
+	if ratio := float64(picked["a"]) / 4000; ratio < 0.7 || ratio > 0.8 {
+		t.Fatalf("picked = %v", picked)
+	}
+
+	plugin.replicas[0].healthy, plugin.replicas[1].healthy = 0, 0
+	if r := plugin.pick(); r != nil {
+		t.Fatalf("picked %s without healthy replica", r.Name)
+	}
+}
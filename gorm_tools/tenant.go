@@ -0,0 +1,244 @@
+package gorm_tools
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+/*
+	多租户隔离，有store_id字段的模型自动按ctx中的店铺id过滤，需注册TenantScopePlugin:
+	db.Use(&gorm_tools.TenantScopePlugin{})
+
+	1. 查询、更新、删除自动追加 WHERE store_id = ?；更新、删除没有其他条件且没有主键时返回gorm.ErrMissingWhereClause
+	2. 创建、更新时store_id为空则设置为ctx中的店铺id，不一致时返回ErrTenantMismatch，不能把记录改到其他店铺
+	3. ctx中没有店铺id时返回ErrTenantMissing，确实需要跨店铺操作时用WithoutTenantScope(ctx)
+	4. 店铺id由middlewares.StoreId从请求头store-id写入ctx，db需WithContext(ctx)，ctx可以是*gin.Context或其Request.Context()
+	5. Raw、Exec的sql不做处理
+*/
+
+const DefaultTenantColumn = "store_id"
+
+// StoreIdContextKey *gin.Context等只支持字符串key的ctx中店铺id的key，gin.Context.Value(key)会从c.Keys中查找
+const StoreIdContextKey = "gorm_tools:store_id"
+
+type (
+	storeIdKey         struct{}
+	skipTenantScopeKey struct{}
+)
+
+func WithStoreId(ctx context.Context, storeId uint64) context.Context {
+	return context.WithValue(ctx, storeIdKey{}, storeId)
+}
+
+func StoreIdFromContext(ctx context.Context) (uint64, bool) {
+	storeId, ok := ctx.Value(storeIdKey{}).(uint64)
+	if !ok {
+		storeId, ok = ctx.Value(StoreIdContextKey).(uint64)
+	}
+	return storeId, ok && storeId != 0
+}
+
+// WithoutTenantScope 跳过店铺隔离，用于后台任务等跨店铺操作
+func WithoutTenantScope(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipTenantScopeKey{}, true)
+}
+
+func tenantScopeSkipped(ctx context.Context) bool {
+	skip, _ := ctx.Value(skipTenantScopeKey{}).(bool)
+	return skip
+}
+
+type TenantScopePlugin struct {
+	Column string // 默认store_id
+}
+
+func (*TenantScopePlugin) Name() string {
+	return "gorm_tools:tenant_scope"
+}
+
+func (p *TenantScopePlugin) Initialize(db *gorm.DB) error {
+	if p.Column == "" {
+		p.Column = DefaultTenantColumn
+	}
+
+	callback := db.Callback()
+	if err := callback.Create().Before("gorm:create").Register(p.Name()+":create", p.create); err != nil {
+		return err
+	}
+	if err := callback.Query().Before("gorm:query").Register(p.Name()+":query", p.where); err != nil {
+		return err
+	}
+	if err := callback.Update().Before("gorm:update").Register(p.Name()+":update", p.update); err != nil {
+		return err
+	}
+	if err := callback.Delete().Before("gorm:delete").Register(p.Name()+":delete", p.delete); err != nil {
+		return err
+	}
+	return callback.Row().Before("gorm:row").Register(p.Name()+":row", p.where)
+}
+
+// 返回模型的店铺字段和ctx中的店铺id，不需要隔离时field为nil
+func (p *TenantScopePlugin) tenant(db *gorm.DB) (field *schema.Field, storeId uint64) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return nil, 0
+	}
+
+	field = db.Statement.Schema.LookUpField(p.Column)
+	if field == nil || tenantScopeSkipped(db.Statement.Context) {
+		return nil, 0
+	}
+
+	storeId, ok := StoreIdFromContext(db.Statement.Context)
+	if !ok {
+		_ = db.AddError(ErrTenantMissing)
+		return nil, 0
+	}
+	return field, storeId
+}
+
+func (p *TenantScopePlugin) where(db *gorm.DB) {
+	field, storeId := p.tenant(db)
+	if field == nil {
+		return
+	}
+
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: storeId},
+	}})
+}
+
+func (p *TenantScopePlugin) update(db *gorm.DB) {
+	field, storeId := p.tenant(db)
+	if field == nil {
+		return
+	}
+
+	if missingWhereConditions(db) {
+		_ = db.AddError(gorm.ErrMissingWhereClause)
+		return
+	}
+
+	if dest, ok := db.Statement.Dest.(map[string]interface{}); ok {
+		for _, key := range []string{field.DBName, field.Name} {
+			if value, ok := dest[key]; ok && !sameStoreId(value, storeId) {
+				_ = db.AddError(ErrTenantMismatch)
+				return
+			}
+		}
+	} else if db.Statement.Dest != db.Statement.Model {
+		p.setStoreId(db, field, storeId, reflect.Indirect(reflect.ValueOf(db.Statement.Dest)))
+	} else {
+		// Save时Dest与Model相同
+		p.setStoreId(db, field, storeId, db.Statement.ReflectValue)
+	}
+	p.where(db)
+}
+
+func (p *TenantScopePlugin) delete(db *gorm.DB) {
+	field, _ := p.tenant(db)
+	if field == nil {
+		return
+	}
+
+	if missingWhereConditions(db) {
+		_ = db.AddError(gorm.ErrMissingWhereClause)
+		return
+	}
+	p.where(db)
+}
+
+// missingWhereConditions 与gorm的ErrMissingWhereClause检查一致，避免追加店铺条件后变成更新、删除整个店铺
+func missingWhereConditions(db *gorm.DB) bool {
+	if db.AllowGlobalUpdate {
+		return false
+	}
+
+	if where, ok := db.Statement.Clauses["WHERE"]; ok {
+		if w, ok := where.Expression.(clause.Where); ok && len(w.Exprs) > 0 {
+			return false
+		}
+	}
+
+	// 按主键更新、删除时gorm会追加主键条件
+	hasPrimaryKey := false
+	values := []reflect.Value{db.Statement.ReflectValue}
+	if db.Statement.Dest != nil {
+		values = append(values, reflect.Indirect(reflect.ValueOf(db.Statement.Dest)))
+	}
+	for _, value := range values {
+		eachStruct(value, func(value reflect.Value) {
+			if value.Type() != db.Statement.Schema.ModelType {
+				return
+			}
+			for _, field := range db.Statement.Schema.PrimaryFields {
+				if _, isZero := field.ValueOf(db.Statement.Context, value); !isZero {
+					hasPrimaryKey = true
+				}
+			}
+		})
+	}
+	return !hasPrimaryKey
+}
+
+func (p *TenantScopePlugin) create(db *gorm.DB) {
+	field, storeId := p.tenant(db)
+	if field == nil {
+		return
+	}
+
+	if dest, ok := db.Statement.Dest.(map[string]interface{}); ok {
+		if value, ok := dest[field.DBName]; ok {
+			if !sameStoreId(value, storeId) {
+				_ = db.AddError(ErrTenantMismatch)
+			}
+			return
+		}
+		dest[field.DBName] = storeId
+		return
+	}
+
+	p.setStoreId(db, field, storeId, db.Statement.ReflectValue)
+}
+
+// setStoreId 模型的店铺id为空时设置为ctx中的店铺id，不一致时返回ErrTenantMismatch
+func (p *TenantScopePlugin) setStoreId(db *gorm.DB, field *schema.Field, storeId uint64, values reflect.Value) {
+	eachStruct(values, func(value reflect.Value) {
+		if value.Type() != db.Statement.Schema.ModelType {
+			return
+		}
+
+		current, isZero := field.ValueOf(db.Statement.Context, value)
+		if isZero {
+			if value.CanAddr() {
+				_ = db.AddError(field.Set(db.Statement.Context, value, storeId))
+			}
+			return
+		}
+
+		if !sameStoreId(current, storeId) {
+			_ = db.AddError(ErrTenantMismatch)
+		}
+	})
+}
+
+func sameStoreId(value interface{}, storeId uint64) bool {
+	return storeIdString(value) == strconv.FormatUint(storeId, 10)
+}
+
+func storeIdString(value interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(value))
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.String:
+		return v.String()
+	}
+	return ""
+}
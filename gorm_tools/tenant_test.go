@@ -0,0 +1,150 @@
+package gorm_tools
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+type testTenantProduct struct {
+	BaseModel
+	StoreId uint64 `gorm:"column:store_id"`
+	Name    string `gorm:"column:name"`
+}
+
+func newTenantTestDB(t *testing.T) (*gorm.DB, []*testTenantProduct) {
+	t.Helper()
+
+	db := newTestDB(t, &testTenantProduct{})
+	if err := db.Use(&TenantScopePlugin{}); err != nil {
+		t.Fatal(err)
+	}
+
+	products := []*testTenantProduct{{StoreId: 1, Name: "a"}, {StoreId: 1, Name: "b"}, {StoreId: 2, Name: "c"}}
+	if err := db.WithContext(WithoutTenantScope(context.Background())).Create(products).Error; err != nil {
+		t.Fatal(err)
+	}
+	return db, products
+}
+
+func tenantNames(t *testing.T, db *gorm.DB) map[string]uint64 {
+	t.Helper()
+
+	var products []*testTenantProduct
+	if err := db.WithContext(WithoutTenantScope(context.Background())).Find(&products).Error; err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]uint64{}
+	for _, product := range products {
+		names[product.Name] = product.StoreId
+	}
+	return names
+}
+
+func TestTenantQuery(t *testing.T) {
+	db, _ := newTenantTestDB(t)
+
+	var products []*testTenantProduct
+	if err := db.WithContext(WithStoreId(context.Background(), 1)).Find(&products).Error; err != nil || len(products) != 2 {
+		t.Fatalf("products = %d, err = %v", len(products), err)
+	}
+
+	if err := db.WithContext(context.Background()).Find(&products).Error; !errors.Is(err, ErrTenantMissing) {
+		t.Fatalf("err = %v", err)
+	}
+	if err := db.WithContext(context.Background()).Model(&testTenantProduct{}).Where("name = ?", "a").Update("name", "x").Error; !errors.Is(err, ErrTenantMissing) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestTenantUpdate(t *testing.T) {
+	db, products := newTenantTestDB(t)
+	ctx := WithStoreId(context.Background(), 1)
+
+	// 其他店铺的记录更新不到
+	result := db.WithContext(ctx).Model(products[2]).Update("name", "x")
+	if result.Error != nil || result.RowsAffected != 0 {
+		t.Fatalf("rows = %d, err = %v", result.RowsAffected, result.Error)
+	}
+	if err := db.WithContext(ctx).Model(&testTenantProduct{}).Where("name <> ?", "").Update("name", "y").Error; err != nil {
+		t.Fatal(err)
+	}
+	if names := tenantNames(t, db); names["y"] != 1 || names["c"] != 2 || len(names) != 2 {
+		t.Fatalf("names = %v", names)
+	}
+
+	// 没有条件时不会更新整个店铺
+	if err := db.WithContext(ctx).Model(&testTenantProduct{}).Update("name", "z").Error; !errors.Is(err, gorm.ErrMissingWhereClause) {
+		t.Fatalf("err = %v", err)
+	}
+
+	// 不能改到其他店铺
+	if err := db.WithContext(ctx).Model(products[0]).Updates(map[string]interface{}{"store_id": 2}).Error; !errors.Is(err, ErrTenantMismatch) {
+		t.Fatalf("err = %v", err)
+	}
+	if err := db.WithContext(ctx).Model(products[0]).Updates(&testTenantProduct{StoreId: 2}).Error; !errors.Is(err, ErrTenantMismatch) {
+		t.Fatalf("err = %v", err)
+	}
+	product := &testTenantProduct{StoreId: 2, Name: "moved"}
+	product.Id = products[0].Id
+	if err := db.WithContext(ctx).Save(product).Error; !errors.Is(err, ErrTenantMismatch) {
+		t.Fatalf("err = %v", err)
+	}
+
+	// Save时店铺id为空使用ctx中的
+	product.StoreId = 0
+	if err := db.WithContext(ctx).Save(product).Error; err != nil {
+		t.Fatal(err)
+	}
+	if names := tenantNames(t, db); names["moved"] != 1 {
+		t.Fatalf("names = %v", names)
+	}
+}
+
+func TestTenantDelete(t *testing.T) {
+	db, products := newTenantTestDB(t)
+	ctx := WithStoreId(context.Background(), 1)
+
+	if err := db.WithContext(ctx).Delete(&testTenantProduct{}).Error; !errors.Is(err, gorm.ErrMissingWhereClause) {
+		t.Fatalf("err = %v", err)
+	}
+
+	result := db.WithContext(ctx).Delete(products[2])
+	if result.Error != nil || result.RowsAffected != 0 {
+		t.Fatalf("rows = %d, err = %v", result.RowsAffected, result.Error)
+	}
+	if err := db.WithContext(ctx).Delete(&testTenantProduct{}, products[0].Id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WithContext(ctx).Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&testTenantProduct{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if names := tenantNames(t, db); len(names) != 1 || names["c"] != 2 {
+		t.Fatalf("names = %v", names)
+	}
+}
+
+func TestTenantCreate(t *testing.T) {
+	db, _ := newTenantTestDB(t)
+	ctx := WithStoreId(context.Background(), 1)
+
+	product := &testTenantProduct{Name: "d"}
+	if err := db.WithContext(ctx).Create(product).Error; err != nil || product.StoreId != 1 {
+		t.Fatalf("store id = %d, err = %v", product.StoreId, err)
+	}
+	if err := db.WithContext(ctx).Create(&testTenantProduct{StoreId: 2, Name: "e"}).Error; !errors.Is(err, ErrTenantMismatch) {
+		t.Fatalf("err = %v", err)
+	}
+	err := db.WithContext(ctx).Model(&testTenantProduct{}).Create(map[string]interface{}{"id": 100, "store_id": 2, "name": "f"}).Error
+	if !errors.Is(err, ErrTenantMismatch) {
+		t.Fatalf("err = %v", err)
+	}
+	if err := db.WithContext(context.Background()).Create(&testTenantProduct{Name: "g"}).Error; !errors.Is(err, ErrTenantMissing) {
+		t.Fatalf("err = %v", err)
+	}
+	if names := tenantNames(t, db); len(names) != 4 || names["d"] != 1 {
+		t.Fatalf("names = %v", names)
+	}
+}
@@ -0,0 +1,156 @@
+package gorm_tools
+
+import (
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+/*
+	维护created_at、updated_at，需注册TimestampPlugin:
+	db.Use(&gorm_tools.TimestampPlugin{})
+	没有注册时BaseModel、CreatedAt的hook按默认配置兜底，但不支持map创建
+
+	1. 创建时created_at、updated_at为空才设置，导入数据时可以保留原有时间
+	2. 更新前设置updated_at，包括Update、Updates(struct/map)、Save
+	3. 显式传入updated_at时（map中包含updated_at，或Updates的结构体与Model不同且updated_at非空）不覆盖
+	4. UpdateColumn、UpdateColumns默认不更新updated_at，TouchOnUpdateColumn为true时更新
+*/
+
+const (
+	timestampPluginName = "gorm_tools:timestamp"
+
+	createdAtColumn = "created_at"
+	updatedAtColumn = "updated_at"
+)
+
+var (
+	timeType    = reflect.TypeOf(Time{})
+	timePtrType = reflect.TypeOf(&Time{})
+)
+
+type TimestampPlugin struct {
+	TouchOnUpdateColumn bool
+	NowFunc             func() time.Time
+}
+
+func (*TimestampPlugin) Name() string {
+	return timestampPluginName
+}
+
+func (p *TimestampPlugin) Initialize(db *gorm.DB) error {
+	err := db.Callback().Create().Before("gorm:create").Register(p.Name()+":create", p.create)
+	if err != nil {
+		return err
+	}
+
+	return db.Callback().Update().Before("gorm:update").Register(p.Name()+":update", p.update)
+}
+
+func (p *TimestampPlugin) now() time.Time {
+	if p.NowFunc != nil {
+		return p.NowFunc().UTC()
+	}
+	return time.Now().UTC()
+}
+
+func (p *TimestampPlugin) create(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+
+	now := p.now()
+	for _, column := range []string{createdAtColumn, updatedAtColumn} {
+		field := db.Statement.Schema.LookUpField(column)
+		if field == nil {
+			continue
+		}
+
+		if dest, ok := db.Statement.Dest.(map[string]interface{}); ok {
+			if !mapHasField(dest, field) {
+				dest[field.DBName] = timestampValue(field, now)
+			}
+			continue
+		}
+
+		eachStruct(db.Statement.ReflectValue, func(value reflect.Value) {
+			if _, isZero := field.ValueOf(db.Statement.Context, value); isZero {
+				_ = db.AddError(field.Set(db.Statement.Context, value, timestampValue(field, now)))
+			}
+		})
+	}
+}
+
+func (p *TimestampPlugin) update(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+
+	if db.Statement.SkipHooks && !p.TouchOnUpdateColumn {
+		return
+	}
+
+	field := db.Statement.Schema.LookUpField(updatedAtColumn)
+	if field == nil {
+		return
+	}
+
+	switch dest := db.Statement.Dest.(type) {
+	case map[string]interface{}:
+		if mapHasField(dest, field) {
+			return
+		}
+	default:
+		if db.Statement.Dest != db.Statement.Model {
+			destValue := reflect.Indirect(reflect.ValueOf(dest))
+			if destValue.Kind() == reflect.Struct && destValue.Type() == db.Statement.Schema.ModelType {
+				if _, isZero := field.ValueOf(db.Statement.Context, destValue); !isZero {
+					return
+				}
+			}
+		}
+	}
+
+	if len(db.Statement.Selects) != 0 {
+		db.Statement.Selects = append(db.Statement.Selects, field.DBName)
+	}
+	db.Statement.SetColumn(field.DBName, timestampValue(field, p.now()), true)
+}
+
+func hasTimestampPlugin(db *gorm.DB) bool {
+	_, ok := db.Config.Plugins[timestampPluginName]
+	return ok
+}
+
+func timestampValue(field *schema.Field, now time.Time) interface{} {
+	switch field.FieldType {
+	case timeType:
+		return Time(now)
+	case timePtrType:
+		t := Time(now)
+		return &t
+	default:
+		return now
+	}
+}
+
+func mapHasField(m map[string]interface{}, field *schema.Field) bool {
+	if _, ok := m[field.DBName]; ok {
+		return true
+	}
+	_, ok := m[field.Name]
+	return ok
+}
+
+func eachStruct(value reflect.Value, f func(value reflect.Value)) {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			eachStruct(reflect.Indirect(value.Index(i)), f)
+		}
+	case reflect.Struct:
+		f(value)
+	}
+}
@@ -0,0 +1,159 @@
+package gorm_tools
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type testEvent struct {
+	CreatedAt
+	Id   uint64 `gorm:"column:id"`
+	Name string `gorm:"column:name"`
+}
+
+var testNow = time.Date(2022, 10, 24, 8, 0, 0, 0, time.UTC)
+
+func newTimestampTestDB(t *testing.T, plugin *TimestampPlugin) *gorm.DB {
+	t.Helper()
+
+	db := newTestDB(t, &testUser{}, &testEvent{})
+	if plugin != nil {
+		if err := db.Use(plugin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func reloadUser(t *testing.T, db *gorm.DB, id uint64) *testUser {
+	t.Helper()
+
+	var user testUser
+	if err := db.First(&user, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.CreatedAt == nil || user.UpdatedAt == nil {
+		t.Fatalf("timestamps not set: %+v", user.BaseModel)
+	}
+	return &user
+}
+
+func TestTimestampCreate(t *testing.T) {
+	for name, plugin := range map[string]*TimestampPlugin{
+		"plugin":   {NowFunc: func() time.Time { return testNow }},
+		"fallback": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := newTimestampTestDB(t, plugin)
+
+			users := []*testUser{{Name: "a"}, {Name: "b"}}
+			if err := db.Create(&users).Error; err != nil {
+				t.Fatal(err)
+			}
+			for _, user := range users {
+				user = reloadUser(t, db, user.Id)
+				if plugin != nil && !time.Time(*user.CreatedAt).Equal(testNow) {
+					t.Fatalf("created_at = %v", time.Time(*user.CreatedAt))
+				}
+			}
+
+			event := &testEvent{Id: 1}
+			if err := db.Create(event).Error; err != nil {
+				t.Fatal(err)
+			}
+			if time.Time(event.CreatedAt.CreatedAt).IsZero() {
+				t.Fatal("created_at not set")
+			}
+		})
+	}
+}
+
+func TestTimestampCreateKeepsExplicit(t *testing.T) {
+	for name, plugin := range map[string]*TimestampPlugin{
+		"plugin":   {},
+		"fallback": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := newTimestampTestDB(t, plugin)
+
+			// 导入数据时保留原有时间
+			imported := Time(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+			user := &testUser{Name: "a", BaseModel: BaseModel{CreatedAt: &imported, UpdatedAt: &imported}}
+			if err := db.Create(user).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			user = reloadUser(t, db, user.Id)
+			if !time.Time(*user.CreatedAt).Equal(time.Time(imported)) || !time.Time(*user.UpdatedAt).Equal(time.Time(imported)) {
+				t.Fatalf("timestamps overwritten: %+v", user.BaseModel)
+			}
+		})
+	}
+}
+
+func TestTimestampUpdate(t *testing.T) {
+	for name, plugin := range map[string]*TimestampPlugin{
+		"plugin":   {},
+		"fallback": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := newTimestampTestDB(t, plugin)
+
+			old := Time(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+			user := &testUser{Name: "a", BaseModel: BaseModel{CreatedAt: &old, UpdatedAt: &old}}
+			if err := db.Create(user).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.Model(user).Updates(map[string]interface{}{"name": "b"}).Error; err != nil {
+				t.Fatal(err)
+			}
+			updated := reloadUser(t, db, user.Id)
+			if !time.Time(*updated.UpdatedAt).After(time.Time(old)) {
+				t.Fatalf("updated_at not touched by Updates(map): %v", time.Time(*updated.UpdatedAt))
+			}
+			if !time.Time(*updated.CreatedAt).Equal(time.Time(old)) {
+				t.Fatalf("created_at changed: %v", time.Time(*updated.CreatedAt))
+			}
+
+			// 显式传入updated_at时不覆盖
+			explicit := Time(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+			if err := db.Model(user).Updates(map[string]interface{}{"name": "c", "updated_at": &explicit}).Error; err != nil {
+				t.Fatal(err)
+			}
+			updated = reloadUser(t, db, user.Id)
+			if !time.Time(*updated.UpdatedAt).Equal(time.Time(explicit)) {
+				t.Fatalf("explicit updated_at overwritten: %v", time.Time(*updated.UpdatedAt))
+			}
+
+			// UpdateColumn默认不更新updated_at
+			if err := db.Model(user).UpdateColumn("name", "d").Error; err != nil {
+				t.Fatal(err)
+			}
+			updated = reloadUser(t, db, user.Id)
+			if updated.Name != "d" || !time.Time(*updated.UpdatedAt).Equal(time.Time(explicit)) {
+				t.Fatalf("UpdateColumn touched updated_at: %v", time.Time(*updated.UpdatedAt))
+			}
+		})
+	}
+}
+
+func TestTimestampTouchOnUpdateColumn(t *testing.T) {
+	db := newTimestampTestDB(t, &TimestampPlugin{TouchOnUpdateColumn: true, NowFunc: func() time.Time { return testNow }})
+
+	old := Time(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	user := &testUser{Name: "a", BaseModel: BaseModel{CreatedAt: &old, UpdatedAt: &old}}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Model(user).UpdateColumn("name", "b").Error; err != nil {
+		t.Fatal(err)
+	}
+	updated := reloadUser(t, db, user.Id)
+	if !time.Time(*updated.UpdatedAt).Equal(testNow) {
+		t.Fatalf("updated_at = %v", time.Time(*updated.UpdatedAt))
+	}
+}
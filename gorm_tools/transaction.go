@@ -0,0 +1,215 @@
+package gorm_tools
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+/*
+	事务封装:
+	1. 死锁(1213)、锁等待超时(1205)时整体重试
+	2. 嵌套调用WithTx时使用savepoint
+	3. 事务通过ctx传递，gorm_tools.DB(db.WithContext(ctx), opts)和DBFromContext会自动使用ctx中的事务
+	   直接用db.WithContext(ctx)查询不会加入事务，仓储代码应通过这两个方法取db
+	4. AfterCommit注册的回调在最外层事务提交后执行
+*/
+
+const (
+	DefaultTxMaxRetries  = 3
+	DefaultTxBackoffBase = 50 * time.Millisecond
+	DefaultTxBackoffMax  = time.Second
+)
+
+type TxFunc func(ctx context.Context, tx *gorm.DB) error
+
+type (
+	TxOpts struct {
+		maxRetries  int
+		backoffBase time.Duration
+		backoffMax  time.Duration
+		sqlOptions  *sql.TxOptions
+	}
+
+	funcTxOption struct {
+		f func(opts *TxOpts)
+	}
+
+	TxOption interface {
+		apply(opts *TxOpts)
+	}
+)
+
+func (fdo *funcTxOption) apply(do *TxOpts) {
+	fdo.f(do)
+}
+
+func newTxOption(f func(opts *TxOpts)) *funcTxOption {
+	return &funcTxOption{
+		f: f,
+	}
+}
+
+// TxMaxRetries 最大重试次数，0为不重试
+func TxMaxRetries(retries int) TxOption {
+	return newTxOption(func(opts *TxOpts) {
+		opts.maxRetries = retries
+	})
+}
+
+// TxBackoff 重试间隔，按base指数增长并加随机抖动，不超过max
+func TxBackoff(base, max time.Duration) TxOption {
+	return newTxOption(func(opts *TxOpts) {
+		opts.backoffBase = base
+		opts.backoffMax = max
+	})
+}
+
+func TxSqlOptions(sqlOptions *sql.TxOptions) TxOption {
+	return newTxOption(func(opts *TxOpts) {
+		opts.sqlOptions = sqlOptions
+	})
+}
+
+type txKey struct{}
+
+type txState struct {
+	db          *gorm.DB
+	pool        gorm.ConnPool // 开启事务前的连接池，用于判断是否同一个库
+	mu          sync.Mutex
+	afterCommit []func(ctx context.Context)
+}
+
+func (s *txState) addAfterCommit(f ...func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.afterCommit = append(s.afterCommit, f...)
+}
+
+func (s *txState) runAfterCommit(ctx context.Context) {
+	for _, f := range s.afterCommit {
+		runAfterCommit(ctx, f)
+	}
+}
+
+func runAfterCommit(ctx context.Context, f func(ctx context.Context)) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.WithField("stack", string(debug.Stack())).Errorf("after commit hook paniced: %v", e)
+		}
+	}()
+
+	f(ctx)
+}
+
+func txStateFromContext(ctx context.Context) *txState {
+	state, _ := ctx.Value(txKey{}).(*txState)
+	return state
+}
+
+// DBFromContext ctx中存在事务时返回该事务，否则返回db
+func DBFromContext(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if state := txStateFromContext(ctx); state != nil {
+		return state.db.WithContext(ctx)
+	}
+	return db.WithContext(ctx)
+}
+
+// joinTx db的ctx中有同一个库上WithTx开启的事务时，在该事务中执行，保留db上已有的条件
+func joinTx(db *gorm.DB) *gorm.DB {
+	state := txStateFromContext(db.Statement.Context)
+	if state == nil || db.Statement.ConnPool != state.pool {
+		return db
+	}
+
+	tx := db.Session(&gorm.Session{Context: db.Statement.Context})
+	tx.Statement.ConnPool = state.db.Statement.ConnPool
+	return tx
+}
+
+// callTxFunc tx也带上事务ctx，插件可以通过Statement.Context注册AfterCommit
+func callTxFunc(ctx context.Context, state *txState, fn TxFunc) error {
+	txCtx := context.WithValue(ctx, txKey{}, state)
+	return fn(txCtx, state.db.WithContext(txCtx))
+}
+
+// AfterCommit 注册最外层事务提交后执行的回调，事务回滚时不执行；ctx中没有事务时立即执行
+func AfterCommit(ctx context.Context, f func(ctx context.Context)) {
+	if state := txStateFromContext(ctx); state != nil {
+		state.addAfterCommit(f)
+		return
+	}
+
+	runAfterCommit(ctx, f)
+}
+
+func WithTx(ctx context.Context, db *gorm.DB, fn TxFunc, opts ...TxOption) error {
+	txOpts := &TxOpts{
+		maxRetries:  DefaultTxMaxRetries,
+		backoffBase: DefaultTxBackoffBase,
+		backoffMax:  DefaultTxBackoffMax,
+	}
+	for _, opt := range opts {
+		opt.apply(txOpts)
+	}
+
+	if parent := txStateFromContext(ctx); parent != nil {
+		// 嵌套事务，gorm会自动使用savepoint，失败时只回滚到savepoint，由最外层决定是否重试
+		state := &txState{pool: parent.pool}
+		err := parent.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			state.db = tx
+			return callTxFunc(ctx, state, fn)
+		})
+		if err != nil {
+			return err
+		}
+
+		parent.addAfterCommit(state.afterCommit...)
+		return nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		state := &txState{pool: db.Statement.ConnPool}
+		err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			state.db = tx
+			return callTxFunc(ctx, state, fn)
+		}, txOpts.sqlOptions)
+		if err == nil {
+			state.runAfterCommit(ctx)
+			return nil
+		}
+
+		if attempt >= txOpts.maxRetries || !IsRetryableError(err) {
+			return err
+		}
+
+		backoff := txOpts.backoff(attempt)
+		log.WithError(err).Warnf("transaction failed, retry %d after %s", attempt+1, backoff)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (opts *TxOpts) backoff(attempt int) time.Duration {
+	backoff := opts.backoffBase << uint(attempt)
+	if backoff <= 0 || backoff > opts.backoffMax {
+		backoff = opts.backoffMax
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	// 加随机抖动，避免冲突的事务同时重试
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
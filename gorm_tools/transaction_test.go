@@ -0,0 +1,121 @@
+package gorm_tools
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestWithTxRetry(t *testing.T) {
+	db := newTestDB(t)
+
+	cases := []struct {
+		name     string
+		number   uint16
+		attempts int
+	}{
+		{"deadlock", 1213, 3},
+		{"lock wait timeout", 1205, 3},
+		{"nowait", 3572, 1},
+		{"duplicate", 1062, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attempts := 0
+			err := WithTx(context.Background(), db, func(ctx context.Context, tx *gorm.DB) error {
+				attempts++
+				return &mysql.MySQLError{Number: c.number, Message: c.name}
+			}, TxMaxRetries(2), TxBackoff(time.Millisecond, time.Millisecond))
+
+			var mysqlErr *mysql.MySQLError
+			if !errors.As(err, &mysqlErr) || mysqlErr.Number != c.number {
+				t.Fatalf("err = %v", err)
+			}
+			if attempts != c.attempts {
+				t.Fatalf("attempts = %d, want %d", attempts, c.attempts)
+			}
+		})
+	}
+}
+
+func TestWithTxAfterCommit(t *testing.T) {
+	db := newTestDB(t)
+
+	var committed []string
+	err := WithTx(context.Background(), db, func(ctx context.Context, tx *gorm.DB) error {
+		AfterCommit(ctx, func(context.Context) { committed = append(committed, "outer") })
+
+		_ = WithTx(ctx, db, func(ctx context.Context, tx *gorm.DB) error {
+			AfterCommit(ctx, func(context.Context) { committed = append(committed, "rollback") })
+			return errors.New("rollback")
+		})
+
+		return WithTx(ctx, db, func(ctx context.Context, tx *gorm.DB) error {
+			AfterCommit(ctx, func(context.Context) { committed = append(committed, "inner") })
+			if len(committed) != 0 {
+				t.Fatal("after commit hook runs before commit")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(committed) != 2 || committed[0] != "outer" || committed[1] != "inner" {
+		t.Fatalf("committed = %v", committed)
+	}
+}
+
+func TestWithTxJoinedByDB(t *testing.T) {
+	// 文件数据库，事务外的语句会使用其他连接，不会自动加入事务
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "tx.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	if err := db.AutoMigrate(&testUser{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rollback := errors.New("rollback")
+	err = WithTx(context.Background(), db, func(ctx context.Context, tx *gorm.DB) error {
+		// 仓储代码只拿到原始db和ctx
+		if err := DB(db.WithContext(ctx), nil).Create(&testUser{Name: "a"}).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		if err := DB(db.WithContext(ctx).Model(&testUser{}), []Option{Equal("name", "a")}).Count(&count).Error; err != nil {
+			return err
+		}
+		if count != 1 {
+			t.Errorf("count in tx = %d", count)
+		}
+
+		if err := DBFromContext(ctx, db).Create(&testUser{Name: "b"}).Error; err != nil {
+			return err
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatalf("err = %v", err)
+	}
+
+	var count int64
+	if err := db.Model(&testUser{}).Count(&count).Error; err != nil || count != 0 {
+		t.Fatalf("count = %d, err = %v", count, err)
+	}
+}
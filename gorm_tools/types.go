@@ -3,9 +3,13 @@ package gorm_tools
 import (
 	"bytes"
 	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -16,64 +20,104 @@ type Time time.Time
 
 const ISO8601 = "2006-01-02T15:04:05Z"
 
+const dbTimeLayout = "2006-01-02 15:04:05.999999"
+
+// Scan和UnmarshalJSON支持的格式，不带时区的按0时区解析
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// timeOutputLayout 请求处理中并发读取，用atomic.Value保存
+var timeOutputLayout atomic.Value
+
+// SetTimePrecision 设置MarshalJSON和String输出的秒小数位数，0-9，默认0，多出的位数截断
+// 并发安全，但修改后输出格式会变化，应在初始化时调用
+func SetTimePrecision(precision int) {
+	if precision <= 0 {
+		timeOutputLayout.Store(ISO8601)
+		return
+	}
+	if precision > 9 {
+		precision = 9
+	}
+	timeOutputLayout.Store("2006-01-02T15:04:05." + strings.Repeat("0", precision) + "Z")
+}
+
+func outputLayout() string {
+	if layout, ok := timeOutputLayout.Load().(string); ok {
+		return layout
+	}
+	return ISO8601
+}
+
+func ParseTime(s string) (Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.HasPrefix(s, "0000-00-00") {
+		return Time{}, nil
+	}
+
+	for _, layout := range timeLayouts {
+		if tt, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return Time(tt.UTC()), nil
+		}
+	}
+	return Time{}, fmt.Errorf("parse %s failed", s)
+}
+
 func (t Time) Value() (v driver.Value, err error) {
 	if time.Time(t).IsZero() {
 		return nil, nil
 	}
 
-	return time.Time(t).UTC().Format("2006-01-02 15:04:05.999999"), nil
+	return time.Time(t).UTC().Format(dbTimeLayout), nil
 }
 
+// Scan 支持time.Time、字符串和unix秒
 func (t *Time) Scan(value interface{}) (err error) {
-	if value == nil {
-		*t = Time(time.Time{}.UTC())
-	}
-
-	var tt time.Time
-
-	switch value.(type) {
+	switch v := value.(type) {
+	case nil:
+		*t = Time{}
 	case time.Time:
-		tt = value.(time.Time).In(time.UTC)
+		*t = Time(v.UTC())
 	case []byte:
-		valueStr := string(value.([]byte))
-		if valueStr == "0000-00-00 00:00:00" {
-			// zero value
-			tt = time.Time{}.In(time.UTC)
-		} else {
-			tt, err = time.ParseInLocation("2006-01-02 15:04:05.999999", valueStr, time.UTC)
-			if err != nil {
-				return fmt.Errorf("parse %s failed", valueStr)
-			}
-		}
+		*t, err = ParseTime(string(v))
+	case string:
+		*t, err = ParseTime(v)
+	case int64:
+		*t = Time(time.Unix(v, 0).UTC())
 	default:
 		return fmt.Errorf("can't convert %v to time", value)
 	}
-
-	*t = Time(tt)
 	return
 }
 
 func (t Time) MarshalJSON() (value []byte, err error) {
-	ts := time.Time(t).UTC().Format(ISO8601)
-	return []byte(fmt.Sprintf(`"%s"`, ts)), nil
+	return []byte(fmt.Sprintf(`"%s"`, t.String())), nil
 }
 
+// UnmarshalJSON 支持RFC3339（含小数秒和时区偏移）和null
 func (t *Time) UnmarshalJSON(bytes []byte) (err error) {
-	if len(bytes) == 0 || string(bytes) == `""` {
+	s := string(bytes)
+	if len(bytes) == 0 || s == `""` || s == "null" {
 		return nil
 	}
 
-	ret, err := time.ParseInLocation(fmt.Sprintf(`"%s"`, ISO8601), string(bytes), time.UTC)
+	s, err = strconv.Unquote(s)
 	if err != nil {
-		return err
+		return fmt.Errorf("parse %s failed", string(bytes))
 	}
 
-	*t = Time(ret)
+	*t, err = ParseTime(s)
 	return
 }
 
 func (t Time) String() string {
-	return time.Time(t).UTC().Format(ISO8601)
+	return time.Time(t).UTC().Format(outputLayout())
 }
 
 func (t *Time) Unix() int64 {
@@ -136,18 +180,17 @@ func NewUUIDBinary() UUIDBinary {
 
 // _________________________________
 
+// StringArray 以逗号分隔存储，元素中的逗号和反斜杠用反斜杠转义，
+// Scan时自动识别json数组，兼容未转义的旧数据
 type StringArray []string
 
 func (a *StringArray) Scan(src interface{}) error {
-	if bs, ok := src.([]byte); ok {
-		if string(bs) == "" {
-			*a = make(StringArray, 0)
-		} else {
-			*a = strings.SplitN(string(bs), ",", -1)
-		}
-		return nil
+	arr, err := scanStringArray(src)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("cannot convert %T to StringArray", src)
+	*a = arr
+	return nil
 }
 
 func (a StringArray) Value() (driver.Value, error) {
@@ -155,7 +198,127 @@ func (a StringArray) Value() (driver.Value, error) {
 		return "", nil
 	}
 
-	return strings.Join(a, ","), nil
+	parts := make([]string, 0, len(a))
+	for _, item := range a {
+		parts = append(parts, stringArrayEscaper.Replace(item))
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func (a StringArray) MarshalJSON() ([]byte, error) {
+	return marshalStringArray(a)
+}
+
+func (a *StringArray) UnmarshalJSON(data []byte) error {
+	arr, err := unmarshalStringArray(data)
+	if err != nil {
+		return err
+	}
+	*a = arr
+	return nil
+}
+
+// JSONStringArray 以json数组存储，空数组存为[]，Scan时同样兼容逗号分隔的旧数据
+type JSONStringArray []string
+
+func (a *JSONStringArray) Scan(src interface{}) error {
+	arr, err := scanStringArray(src)
+	if err != nil {
+		return err
+	}
+	*a = arr
+	return nil
+}
+
+func (a JSONStringArray) Value() (driver.Value, error) {
+	bs, err := marshalStringArray(a)
+	if err != nil {
+		return nil, err
+	}
+	return string(bs), nil
+}
+
+func (a JSONStringArray) MarshalJSON() ([]byte, error) {
+	return marshalStringArray(a)
+}
+
+func (a *JSONStringArray) UnmarshalJSON(data []byte) error {
+	arr, err := unmarshalStringArray(data)
+	if err != nil {
+		return err
+	}
+	*a = arr
+	return nil
+}
+
+func scanStringArray(src interface{}) ([]string, error) {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		return make([]string, 0), nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return nil, fmt.Errorf("cannot convert %T to StringArray", src)
+	}
+
+	if s == "" {
+		return make([]string, 0), nil
+	}
+
+	if strings.HasPrefix(s, "[") {
+		var arr []string
+		if err := json.Unmarshal([]byte(s), &arr); err == nil {
+			return arr, nil
+		}
+	}
+
+	return splitEscaped(s), nil
+}
+
+func marshalStringArray(arr []string) ([]byte, error) {
+	if arr == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(arr)
+}
+
+func unmarshalStringArray(data []byte) ([]string, error) {
+	if string(data) == "null" {
+		return make([]string, 0), nil
+	}
+
+	var arr []string
+	if err := json.Unmarshal(data, &arr); err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
+
+var stringArrayEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`)
+
+// 按未转义的逗号分隔，只有\,和\\视为转义，其他反斜杠原样保留
+func splitEscaped(s string) []string {
+	var (
+		items []string
+		item  strings.Builder
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == ',' || s[i+1] == '\\'):
+			item.WriteByte(s[i+1])
+			i++
+		case s[i] == ',':
+			items = append(items, item.String())
+			item.Reset()
+		default:
+			item.WriteByte(s[i])
+		}
+	}
+	return append(items, item.String())
 }
 
 // _________________________________
@@ -174,12 +337,14 @@ func (j *Json) Scan(value interface{}) error {
 		*j = nil
 		return nil
 	}
-	s, ok := value.([]byte)
-
-	if !ok {
+	switch s := value.(type) {
+	case []byte:
+		*j = append((*j)[0:0], s...)
+	case string:
+		*j = append((*j)[0:0], s...)
+	default:
 		return errors.New("invalid scan source")
 	}
-	*j = append((*j)[0:0], s...)
 	return nil
 }
 
@@ -209,3 +374,396 @@ func (j Json) Equals(j1 Json) bool {
 func (j Json) String() string {
 	return string(j)
 }
+
+// _________________________________
+
+// JSONOf 带类型的json字段，如 Extra JSONOf[map[string]string]
+type JSONOf[T any] struct {
+	Data T
+}
+
+func NewJSONOf[T any](data T) JSONOf[T] {
+	return JSONOf[T]{Data: data}
+}
+
+func (j JSONOf[T]) Value() (driver.Value, error) {
+	bs, err := json.Marshal(j.Data)
+	if err != nil {
+		return nil, err
+	}
+	return string(bs), nil
+}
+
+func (j *JSONOf[T]) Scan(value interface{}) error {
+	var bs []byte
+	switch v := value.(type) {
+	case nil:
+		*j = JSONOf[T]{}
+		return nil
+	case []byte:
+		bs = v
+	case string:
+		bs = []byte(v)
+	default:
+		return fmt.Errorf("can't convert %T to JSONOf", value)
+	}
+
+	var data T
+	if len(bs) > 0 {
+		if err := json.Unmarshal(bs, &data); err != nil {
+			return err
+		}
+	}
+	j.Data = data
+	return nil
+}
+
+func (j JSONOf[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.Data)
+}
+
+func (j *JSONOf[T]) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &j.Data)
+}
+
+// _________________________________
+
+// IntArray 和StringArray一样以逗号分隔存储
+type IntArray []int64
+
+func (a *IntArray) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		*a = make(IntArray, 0)
+		return nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return fmt.Errorf("cannot convert %T to IntArray", src)
+	}
+
+	if s == "" {
+		*a = make(IntArray, 0)
+		return nil
+	}
+
+	parts := strings.Split(s, ",")
+	arr := make(IntArray, 0, len(parts))
+	for _, part := range parts {
+		i, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			return fmt.Errorf("parse %s failed", s)
+		}
+		arr = append(arr, i)
+	}
+	*a = arr
+	return nil
+}
+
+func (a IntArray) Value() (driver.Value, error) {
+	if len(a) == 0 {
+		return "", nil
+	}
+
+	parts := make([]string, 0, len(a))
+	for _, i := range a {
+		parts = append(parts, strconv.FormatInt(i, 10))
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func (a IntArray) MarshalJSON() ([]byte, error) {
+	if a == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]int64(a))
+}
+
+// _________________________________
+
+type ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64 | ~string
+}
+
+// Set 无重复元素的集合，以有序json数组存储
+type Set[T ordered] map[T]struct{}
+
+func NewSet[T ordered](items ...T) Set[T] {
+	s := make(Set[T], len(items))
+	s.Add(items...)
+	return s
+}
+
+func (s Set[T]) Add(items ...T) {
+	for _, item := range items {
+		s[item] = struct{}{}
+	}
+}
+
+func (s Set[T]) Remove(items ...T) {
+	for _, item := range items {
+		delete(s, item)
+	}
+}
+
+func (s Set[T]) Contains(item T) bool {
+	_, ok := s[item]
+	return ok
+}
+
+func (s Set[T]) Len() int {
+	return len(s)
+}
+
+// Slice 升序排列的元素
+func (s Set[T]) Slice() []T {
+	items := make([]T, 0, len(s))
+	for item := range s {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i] < items[j]
+	})
+	return items
+}
+
+func (s Set[T]) Value() (driver.Value, error) {
+	bs, err := json.Marshal(s.Slice())
+	if err != nil {
+		return nil, err
+	}
+	return string(bs), nil
+}
+
+func (s *Set[T]) Scan(value interface{}) error {
+	var bs []byte
+	switch v := value.(type) {
+	case nil:
+		*s = make(Set[T])
+		return nil
+	case []byte:
+		bs = v
+	case string:
+		bs = []byte(v)
+	default:
+		return fmt.Errorf("can't convert %T to Set", value)
+	}
+
+	if len(bs) == 0 {
+		*s = make(Set[T])
+		return nil
+	}
+	return s.UnmarshalJSON(bs)
+}
+
+func (s Set[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Slice())
+}
+
+func (s *Set[T]) UnmarshalJSON(data []byte) error {
+	var items []T
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	*s = NewSet(items...)
+	return nil
+}
+
+// _________________________________
+
+const DateLayout = "2006-01-02"
+
+// Date 只有日期的字段，对应数据库DATE类型
+type Date time.Time
+
+func NewDate(year int, month time.Month, day int) Date {
+	return Date(time.Date(year, month, day, 0, 0, 0, 0, time.UTC))
+}
+
+func ParseDate(s string) (Date, error) {
+	t, err := time.ParseInLocation(DateLayout, s, time.UTC)
+	if err != nil {
+		return Date{}, err
+	}
+	return Date(t), nil
+}
+
+func (d Date) Value() (driver.Value, error) {
+	if time.Time(d).IsZero() {
+		return nil, nil
+	}
+	return d.String(), nil
+}
+
+func (d *Date) Scan(value interface{}) (err error) {
+	switch v := value.(type) {
+	case nil:
+		*d = Date{}
+	case time.Time:
+		*d = NewDate(v.Date())
+	case []byte:
+		*d, err = parseDateValue(string(v))
+	case string:
+		*d, err = parseDateValue(v)
+	default:
+		return fmt.Errorf("can't convert %v to date", value)
+	}
+	return
+}
+
+// 兼容sqlite等以datetime字符串返回的驱动
+func parseDateValue(s string) (Date, error) {
+	if s == "" || strings.HasPrefix(s, "0000-00-00") {
+		return Date{}, nil
+	}
+	if len(s) > len(DateLayout) {
+		s = s[:len(DateLayout)]
+	}
+	return ParseDate(s)
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	if time.Time(d).IsZero() {
+		return []byte(`""`), nil
+	}
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+func (d *Date) UnmarshalJSON(data []byte) (err error) {
+	s := string(data)
+	if s == "null" || s == `""` {
+		return nil
+	}
+
+	s, err = strconv.Unquote(s)
+	if err != nil {
+		return err
+	}
+	*d, err = ParseDate(s)
+	return
+}
+
+func (d Date) String() string {
+	return time.Time(d).Format(DateLayout)
+}
+
+func (d Date) Time() time.Time {
+	return time.Time(d)
+}
+
+func (d Date) IsZero() bool {
+	return time.Time(d).IsZero()
+}
+
+func (d Date) AddDate(years int, months int, days int) Date {
+	return Date(time.Time(d).AddDate(years, months, days))
+}
+
+// _________________________________
+
+// NullTime 可为NULL的Time，json序列化为null
+type NullTime struct {
+	Time  Time
+	Valid bool
+}
+
+func NewNullTime(t time.Time) NullTime {
+	return NullTime{Time: Time(t), Valid: true}
+}
+
+func (t NullTime) Value() (driver.Value, error) {
+	if !t.Valid {
+		return nil, nil
+	}
+	return t.Time.Value()
+}
+
+func (t *NullTime) Scan(value interface{}) error {
+	if value == nil {
+		*t = NullTime{}
+		return nil
+	}
+
+	if err := t.Time.Scan(value); err != nil {
+		return err
+	}
+	t.Valid = true
+	return nil
+}
+
+func (t NullTime) MarshalJSON() ([]byte, error) {
+	if !t.Valid {
+		return []byte("null"), nil
+	}
+	return t.Time.MarshalJSON()
+}
+
+func (t *NullTime) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*t = NullTime{}
+		return nil
+	}
+
+	if err := t.Time.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	t.Valid = !t.Time.IsZero()
+	return nil
+}
+
+// _________________________________
+
+// NullDate 可为NULL的Date，json序列化为null
+type NullDate struct {
+	Date  Date
+	Valid bool
+}
+
+func NewNullDate(d Date) NullDate {
+	return NullDate{Date: d, Valid: true}
+}
+
+func (d NullDate) Value() (driver.Value, error) {
+	if !d.Valid {
+		return nil, nil
+	}
+	return d.Date.Value()
+}
+
+func (d *NullDate) Scan(value interface{}) error {
+	if value == nil {
+		*d = NullDate{}
+		return nil
+	}
+
+	if err := d.Date.Scan(value); err != nil {
+		return err
+	}
+	d.Valid = true
+	return nil
+}
+
+func (d NullDate) MarshalJSON() ([]byte, error) {
+	if !d.Valid {
+		return []byte("null"), nil
+	}
+	return d.Date.MarshalJSON()
+}
+
+func (d *NullDate) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*d = NullDate{}
+		return nil
+	}
+
+	if err := d.Date.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	d.Valid = !d.Date.IsZero()
+	return nil
+}
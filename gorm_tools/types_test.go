@@ -0,0 +1,519 @@
+package gorm_tools
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type valueScanner[T any] interface {
+	*T
+	sql.Scanner
+	driver.Valuer
+}
+
+// valueRoundTrip Value后分别按string和[]byte（mysql驱动）Scan回来
+func valueRoundTrip[T any, PT valueScanner[T]](t *testing.T, v T) []T {
+	t.Helper()
+
+	dv, err := PT(&v).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srcs := []interface{}{dv}
+	if s, ok := dv.(string); ok {
+		srcs = append(srcs, []byte(s))
+	}
+
+	results := make([]T, 0, len(srcs))
+	for _, src := range srcs {
+		var got T
+		if err := PT(&got).Scan(src); err != nil {
+			t.Fatalf("scan %#v: %v", src, err)
+		}
+		results = append(results, got)
+	}
+	return results
+}
+
+func jsonRoundTrip[T any](t *testing.T, v T) (T, string) {
+	t.Helper()
+
+	bs, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got T
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatalf("unmarshal %s: %v", bs, err)
+	}
+	return got, string(bs)
+}
+
+func TestJSONOfRoundTrip(t *testing.T) {
+	type extra struct {
+		Name string            `json:"name"`
+		Tags map[string]string `json:"tags"`
+	}
+
+	for _, v := range []JSONOf[extra]{
+		NewJSONOf(extra{Name: "a", Tags: map[string]string{"k": "v"}}),
+		{},
+	} {
+		for _, got := range valueRoundTrip(t, v) {
+			if !reflect.DeepEqual(got, v) {
+				t.Fatalf("value round trip: %+v != %+v", got, v)
+			}
+		}
+
+		if got, _ := jsonRoundTrip(t, v); !reflect.DeepEqual(got, v) {
+			t.Fatalf("json round trip: %+v != %+v", got, v)
+		}
+	}
+
+	var null JSONOf[extra]
+	if err := null.Scan(nil); err != nil || null.Data.Name != "" {
+		t.Fatalf("scan nil: %+v, %v", null, err)
+	}
+}
+
+func TestDecimalRoundTrip(t *testing.T) {
+	for _, s := range []string{"0", "1", "-1", "0.01", "-0.5", "123456789012345678901234567890.123456789"} {
+		v := MustDecimal(s)
+
+		for _, got := range valueRoundTrip(t, v) {
+			if !got.Equals(v) || got.String() != s {
+				t.Fatalf("value round trip: %s != %s", got, s)
+			}
+		}
+
+		got, bs := jsonRoundTrip(t, v)
+		if !got.Equals(v) || bs != `"`+s+`"` {
+			t.Fatalf("json round trip: %s != %s", bs, s)
+		}
+	}
+
+	var d Decimal
+	if err := json.Unmarshal([]byte("12.5"), &d); err != nil || d.String() != "12.5" {
+		t.Fatalf("unmarshal number: %s, %v", d, err)
+	}
+	if err := d.Scan(int64(3)); err != nil || d.String() != "3" {
+		t.Fatalf("scan int64: %s, %v", d, err)
+	}
+	if err := d.Scan(nil); err != nil || !d.IsZero() {
+		t.Fatalf("scan nil: %s, %v", d, err)
+	}
+}
+
+func TestIntArrayRoundTrip(t *testing.T) {
+	for _, v := range []IntArray{{1, -2, 3}, {}} {
+		for _, got := range valueRoundTrip(t, v) {
+			if !reflect.DeepEqual(got, v) {
+				t.Fatalf("value round trip: %v != %v", got, v)
+			}
+		}
+
+		if got, _ := jsonRoundTrip(t, v); !reflect.DeepEqual(got, v) {
+			t.Fatalf("json round trip: %v != %v", got, v)
+		}
+	}
+
+	if bs, _ := json.Marshal(IntArray(nil)); string(bs) != "[]" {
+		t.Fatalf("marshal nil: %s", bs)
+	}
+
+	var a IntArray
+	if err := a.Scan(nil); err != nil || a == nil || len(a) != 0 {
+		t.Fatalf("scan nil: %v, %v", a, err)
+	}
+	if err := a.Scan("1,x"); err == nil {
+		t.Fatal("scan invalid")
+	}
+}
+
+func TestStringArrayRoundTrip(t *testing.T) {
+	for _, v := range []StringArray{{"a", "b,c", `d\e`, `f\`, ""}, {}} {
+		for _, got := range valueRoundTrip(t, v) {
+			if !reflect.DeepEqual(got, v) {
+				t.Fatalf("value round trip: %q != %q", got, v)
+			}
+		}
+
+		if got, _ := jsonRoundTrip(t, v); !reflect.DeepEqual(got, v) {
+			t.Fatalf("json round trip: %q != %q", got, v)
+		}
+	}
+
+	if dv, _ := (StringArray{"a", "b,c"}).Value(); dv != `a,b\,c` {
+		t.Fatalf("value = %v", dv)
+	}
+	if bs, _ := json.Marshal(StringArray(nil)); string(bs) != "[]" {
+		t.Fatalf("marshal nil: %s", bs)
+	}
+
+	// 兼容json数组和未转义的旧数据
+	var a StringArray
+	for src, want := range map[string]StringArray{
+		`["a","b,c"]`: {"a", "b,c"},
+		`a,b\c`:       {"a", `b\c`},
+		`[a,b`:        {"[a", "b"},
+	} {
+		if err := a.Scan(src); err != nil || !reflect.DeepEqual(a, want) {
+			t.Fatalf("scan %s: %q, %v", src, a, err)
+		}
+	}
+}
+
+func TestJSONStringArrayRoundTrip(t *testing.T) {
+	for _, v := range []JSONStringArray{{"a", "b,c", `d\e`}, {}} {
+		for _, got := range valueRoundTrip(t, v) {
+			if !reflect.DeepEqual(got, v) {
+				t.Fatalf("value round trip: %q != %q", got, v)
+			}
+		}
+
+		if got, _ := jsonRoundTrip(t, v); !reflect.DeepEqual(got, v) {
+			t.Fatalf("json round trip: %q != %q", got, v)
+		}
+	}
+
+	for _, c := range []struct {
+		v    JSONStringArray
+		want string
+	}{
+		{JSONStringArray{"a", "b,c"}, `["a","b,c"]`},
+		{JSONStringArray{}, "[]"},
+		{nil, "[]"},
+	} {
+		if dv, err := c.v.Value(); err != nil || dv != c.want {
+			t.Fatalf("value = %v, want %s", dv, c.want)
+		}
+	}
+
+	var a JSONStringArray
+	if err := a.Scan("a,b"); err != nil || !reflect.DeepEqual(a, JSONStringArray{"a", "b"}) {
+		t.Fatalf("scan legacy: %q, %v", a, err)
+	}
+}
+
+func TestSetRoundTrip(t *testing.T) {
+	for _, v := range []Set[string]{NewSet("b", "a", "c"), NewSet[string]()} {
+		for _, got := range valueRoundTrip(t, v) {
+			if !reflect.DeepEqual(got, v) {
+				t.Fatalf("value round trip: %v != %v", got, v)
+			}
+		}
+
+		if got, _ := jsonRoundTrip(t, v); !reflect.DeepEqual(got, v) {
+			t.Fatalf("json round trip: %v != %v", got, v)
+		}
+	}
+
+	// 有序存储，便于比较和建索引
+	if dv, _ := NewSet(3, 1, 2, 1).Value(); dv != "[1,2,3]" {
+		t.Fatalf("value = %v", dv)
+	}
+
+	var s Set[int]
+	if err := s.Scan(nil); err != nil || s == nil || s.Len() != 0 {
+		t.Fatalf("scan nil: %v, %v", s, err)
+	}
+}
+
+func TestEncryptedStringRoundTrip(t *testing.T) {
+	setTestKeyProvider()
+
+	for _, v := range []EncryptedString{"secret", "中文", ""} {
+		for _, got := range valueRoundTrip(t, v) {
+			if got != v {
+				t.Fatalf("value round trip: %s != %s", got.Plaintext(), v.Plaintext())
+			}
+		}
+
+		if got, _ := jsonRoundTrip(t, v); got != v {
+			t.Fatalf("json round trip: %s != %s", got.Plaintext(), v.Plaintext())
+		}
+	}
+
+	// 每次加密nonce不同
+	v1, _ := EncryptedString("secret").Value()
+	v2, _ := EncryptedString("secret").Value()
+	if v1 == v2 || v1 == "secret" {
+		t.Fatalf("ciphertext = %v, %v", v1, v2)
+	}
+
+	// 密钥轮换后旧数据仍能解密
+	SetKeyProvider(&StaticKeyProvider{
+		CurrentKeyId: "k2",
+		Keys: map[string][]byte{
+			"k1": []byte("0123456789abcdef0123456789abcdef"),
+			"k2": []byte("fedcba9876543210"),
+		},
+	})
+	defer setTestKeyProvider()
+
+	var got EncryptedString
+	if err := got.Scan(v1); err != nil || got != "secret" {
+		t.Fatalf("scan with rotated key: %s, %v", got.Plaintext(), err)
+	}
+	if err := got.Scan("v1:k1:invalid"); err == nil {
+		t.Fatal("scan invalid ciphertext")
+	}
+}
+
+func TestDateRoundTrip(t *testing.T) {
+	for _, v := range []Date{NewDate(2022, 10, 24), {}} {
+		for _, got := range valueRoundTrip(t, v) {
+			if !got.Time().Equal(v.Time()) {
+				t.Fatalf("value round trip: %s != %s", got, v)
+			}
+		}
+
+		if got, _ := jsonRoundTrip(t, v); !got.Time().Equal(v.Time()) {
+			t.Fatalf("json round trip: %s != %s", got, v)
+		}
+	}
+
+	var d Date
+	for _, src := range []interface{}{"2022-10-24 00:00:00", time.Date(2022, 10, 24, 23, 0, 0, 0, time.UTC)} {
+		if err := d.Scan(src); err != nil || d.String() != "2022-10-24" {
+			t.Fatalf("scan %v: %s, %v", src, d, err)
+		}
+	}
+}
+
+func TestNullTimeRoundTrip(t *testing.T) {
+	for _, v := range []NullTime{NewNullTime(time.Date(2022, 10, 24, 8, 30, 0, 123456000, time.UTC)), {}} {
+		for _, got := range valueRoundTrip(t, v) {
+			if got.Valid != v.Valid || !time.Time(got.Time).Equal(time.Time(v.Time)) {
+				t.Fatalf("value round trip: %+v != %+v", got, v)
+			}
+		}
+	}
+
+	// json默认精度为秒
+	v := NewNullTime(time.Date(2022, 10, 24, 8, 30, 0, 0, time.UTC))
+	got, bs := jsonRoundTrip(t, v)
+	if !got.Valid || !time.Time(got.Time).Equal(time.Time(v.Time)) || bs != `"2022-10-24T08:30:00Z"` {
+		t.Fatalf("json round trip: %s, %+v", bs, got)
+	}
+
+	null, bs := jsonRoundTrip(t, NullTime{})
+	if null.Valid || bs != "null" {
+		t.Fatalf("json round trip null: %s, %+v", bs, null)
+	}
+}
+
+type testTypes struct {
+	Id        uint64                    `gorm:"column:id"`
+	Extra     JSONOf[map[string]string] `gorm:"column:extra"`
+	Amount    Decimal                   `gorm:"column:amount"`
+	Ids       IntArray                  `gorm:"column:ids"`
+	Tags      Set[string]               `gorm:"column:tags"`
+	Secret    EncryptedString           `gorm:"column:secret"`
+	Birthday  Date                      `gorm:"column:birthday"`
+	CheckedAt NullTime                  `gorm:"column:checked_at"`
+}
+
+func TestTypesDBRoundTrip(t *testing.T) {
+	setTestKeyProvider()
+	db := newTestDB(t, &testTypes{})
+
+	rows := []*testTypes{
+		{
+			Id:        1,
+			Extra:     NewJSONOf(map[string]string{"k": "v"}),
+			Amount:    MustDecimal("12.34"),
+			Ids:       IntArray{1, 2},
+			Tags:      NewSet("a", "b"),
+			Secret:    "secret",
+			Birthday:  NewDate(2000, 1, 2),
+			CheckedAt: NewNullTime(time.Date(2022, 10, 24, 8, 30, 0, 123456000, time.UTC)),
+		},
+		{Id: 2, Ids: IntArray{}, Tags: NewSet[string]()},
+	}
+	if err := db.Create(rows).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, row := range rows {
+		var got testTypes
+		if err := db.First(&got, row.Id).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got.Extra, row.Extra) || !got.Amount.Equals(row.Amount) || !reflect.DeepEqual(got.Ids, row.Ids) ||
+			!reflect.DeepEqual(got.Tags, row.Tags) || got.Secret != row.Secret || !got.Birthday.Time().Equal(row.Birthday.Time()) ||
+			got.CheckedAt.Valid != row.CheckedAt.Valid || !time.Time(got.CheckedAt.Time).Equal(time.Time(row.CheckedAt.Time)) {
+			t.Fatalf("got %+v, want %+v", got, row)
+		}
+	}
+}
+
+func TestEncryptedStringMask(t *testing.T) {
+	s := EncryptedString("p@ss")
+	account := struct{ Secret EncryptedString }{Secret: s}
+
+	entry, err := (&log.TextFormatter{DisableTimestamp: true}).Format(log.WithField("secret", s).WithField("ptr", &s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, out := range []string{
+		fmt.Sprint(s), fmt.Sprintf("%s %v %q %#v", s, s, s, s),
+		fmt.Sprintf("%v %+v %#v", account, account, account),
+		string(entry),
+	} {
+		if strings.Contains(out, "p@ss") || !strings.Contains(out, encryptedStringMask) {
+			t.Fatalf("plaintext leaked: %s", out)
+		}
+	}
+	if s.Plaintext() != "p@ss" || EncryptedString("").String() != "" {
+		t.Fatal("plaintext")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(2022, 10, 24, 8, 30, 0, 0, time.UTC)
+	cases := map[string]time.Time{
+		"2022-10-24T08:30:00Z":           want,
+		"2022-10-24T08:30:00.123456789Z": want.Add(123456789),
+		"2022-10-24T16:30:00+08:00":      want,
+		"2022-10-24T03:30:00.5-05:00":    want.Add(500 * time.Millisecond),
+		"2022-10-24 08:30:00":            want,
+		"2022-10-24 08:30:00.123456":     want.Add(123456 * time.Microsecond),
+		"2022-10-24 16:30:00 +0800 CST":  want,
+		"2022-10-24T08:30:00":            want,
+		"2022-10-24":                     want.Truncate(24 * time.Hour),
+		" 2022-10-24T08:30:00Z ":         want,
+		"":                               {},
+		"0000-00-00 00:00:00":            {},
+	}
+
+	for s, want := range cases {
+		got, err := ParseTime(s)
+		if err != nil || !time.Time(got).Equal(want) || time.Time(got).Location() != time.UTC {
+			t.Errorf("ParseTime(%q) = %v, %v, want %v", s, time.Time(got), err, want)
+		}
+	}
+
+	for _, s := range []string{"2022/10/24", "yesterday", "2022-13-01"} {
+		if _, err := ParseTime(s); err == nil {
+			t.Errorf("ParseTime(%q) no error", s)
+		}
+	}
+}
+
+func TestTimeScan(t *testing.T) {
+	want := time.Date(2022, 10, 24, 8, 30, 0, 0, time.UTC)
+	sources := []interface{}{
+		"2022-10-24 08:30:00",
+		[]byte("2022-10-24 08:30:00.000000"),
+		want.Unix(),
+		want.In(time.FixedZone("CST", 8*3600)),
+	}
+
+	for _, src := range sources {
+		var got Time
+		if err := got.Scan(src); err != nil || !time.Time(got).Equal(want) || time.Time(got).Location() != time.UTC {
+			t.Errorf("Scan(%v) = %v, %v", src, time.Time(got), err)
+		}
+	}
+
+	got := Time(want)
+	if err := got.Scan(nil); err != nil || !got.IsZero() {
+		t.Fatalf("Scan(nil) = %v, %v", time.Time(got), err)
+	}
+	if err := got.Scan(3.14); err == nil {
+		t.Fatal("Scan(float64) no error")
+	}
+	if err := got.Scan("invalid"); err == nil {
+		t.Fatal("Scan(invalid) no error")
+	}
+}
+
+func TestTimeUnmarshalJSON(t *testing.T) {
+	want := time.Date(2022, 10, 24, 8, 30, 0, 0, time.UTC)
+
+	var v struct {
+		At  Time  `json:"at"`
+		Ptr *Time `json:"ptr"`
+	}
+	if err := json.Unmarshal([]byte(`{"at":"2022-10-24T16:30:00.000+08:00","ptr":null}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if !time.Time(v.At).Equal(want) || v.Ptr != nil {
+		t.Fatalf("v = %v, %v", time.Time(v.At), v.Ptr)
+	}
+
+	for _, s := range []string{`null`, `""`} {
+		got := Time(want)
+		if err := json.Unmarshal([]byte(s), &got); err != nil || !time.Time(got).Equal(want) {
+			t.Fatalf("unmarshal %s = %v, %v", s, time.Time(got), err)
+		}
+	}
+
+	var got Time
+	for _, s := range []string{`123`, `"invalid"`} {
+		if err := json.Unmarshal([]byte(s), &got); err == nil {
+			t.Fatalf("unmarshal %s no error", s)
+		}
+	}
+}
+
+func TestTimePrecision(t *testing.T) {
+	defer SetTimePrecision(0)
+
+	v := Time(time.Date(2022, 10, 24, 16, 30, 0, 123456789, time.FixedZone("CST", 8*3600)))
+	cases := []struct {
+		precision int
+		want      string
+	}{
+		{0, "2022-10-24T08:30:00Z"},
+		{3, "2022-10-24T08:30:00.123Z"},
+		{6, "2022-10-24T08:30:00.123456Z"},
+		{12, "2022-10-24T08:30:00.123456789Z"},
+		{-1, "2022-10-24T08:30:00Z"},
+	}
+	for _, c := range cases {
+		SetTimePrecision(c.precision)
+		if got := v.String(); got != c.want {
+			t.Fatalf("precision %d: %s", c.precision, got)
+		}
+		if bs, _ := json.Marshal(v); string(bs) != `"`+c.want+`"` {
+			t.Fatalf("precision %d: %s", c.precision, bs)
+		}
+	}
+
+	// 数据库中保存到微秒，与输出精度无关
+	SetTimePrecision(3)
+	if dv, _ := v.Value(); dv != "2022-10-24 08:30:00.123456" {
+		t.Fatalf("value = %v", dv)
+	}
+}
+
+func TestTimePrecisionConcurrent(t *testing.T) {
+	defer SetTimePrecision(0)
+
+	v := Time(time.Now())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			SetTimePrecision(i % 10)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_, _ = v.MarshalJSON()
+	}
+	<-done
+}
@@ -0,0 +1,175 @@
+package idempotent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jiangfans/handy/monitor"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	消息至少投递一次，按消息id去重避免重复处理:
+	1. 处理前Acquire占用id，占用期为ProcessingTimeout；已处理过时跳过，
+	   正在被其他消费者处理时返回ErrProcessing，按消费失败处理，消息稍后重试，避免处理失败后消息丢失
+	2. 处理成功后Commit，记录保留TTL，TTL内重复投递的消息都会跳过
+	3. 处理失败后Release，消息重新投递时可以再处理
+	进程在处理中退出时，占用期过后消息可以被重新处理
+*/
+
+const (
+	DefaultTTL               = 7 * 24 * time.Hour
+	DefaultProcessingTimeout = 5 * time.Minute
+)
+
+var (
+	ErrMissingId  = errors.New("message id not found")
+	ErrProcessing = errors.New("message is being processed")
+)
+
+// AcquireResult Acquire的结果
+type AcquireResult int
+
+const (
+	Acquired   AcquireResult = iota // 占用成功，可以处理
+	Processing                      // 已被占用且未过期，还没有Commit
+	Committed                       // 已处理成功且未过期
+)
+
+type Store interface {
+	// Acquire 占用key，key不存在或已过期时占用ttl，否则返回key的状态
+	Acquire(ctx context.Context, key string, ttl time.Duration) (AcquireResult, error)
+	// Commit 处理成功，标记为已提交，key的过期时间改为ttl之后
+	Commit(ctx context.Context, key string, ttl time.Duration) error
+	// Release 处理失败，删除key
+	Release(ctx context.Context, key string) error
+}
+
+type Config struct {
+	Namespace         string        // key的前缀，一般为消费组名或队列名，同时作为监控的namespace标签
+	TTL               time.Duration // 处理成功后记录的保留时间，默认7天
+	ProcessingTimeout time.Duration // 处理中的占用时间，需大于消息的最长处理时间，默认5分钟
+}
+
+type Deduplicator struct {
+	store Store
+	cfg   Config
+}
+
+func NewDeduplicator(store Store, cfg *Config) (*Deduplicator, error) {
+	if store == nil {
+		return nil, errors.New("idempotent store can't be nil")
+	}
+
+	d := &Deduplicator{
+		store: store,
+	}
+	if cfg != nil {
+		d.cfg = *cfg
+	}
+
+	if d.cfg.TTL <= 0 {
+		d.cfg.TTL = DefaultTTL
+	}
+	if d.cfg.ProcessingTimeout <= 0 {
+		d.cfg.ProcessingTimeout = DefaultProcessingTimeout
+	}
+
+	return d, nil
+}
+
+// Do id没有处理过时执行f，已处理过的消息直接返回nil，正在处理中的消息返回ErrProcessing
+func (d *Deduplicator) Do(ctx context.Context, id string, f func() error) error {
+	if id == "" {
+		return ErrMissingId
+	}
+
+	key := id
+	if d.cfg.Namespace != "" {
+		key = d.cfg.Namespace + ":" + id
+	}
+
+	result, err := d.store.Acquire(ctx, key, d.cfg.ProcessingTimeout)
+	if err != nil {
+		monitor.ReportIdempotentTotal(d.cfg.Namespace, "error")
+		return fmt.Errorf("acquire idempotent key %s failed: %w", key, err)
+	}
+
+	switch result {
+	case Committed:
+		monitor.ReportIdempotentTotal(d.cfg.Namespace, "duplicate")
+		log.WithField("key", key).Info("duplicate message skipped")
+		return nil
+	case Processing:
+		// 处理中的消息可能失败，不能跳过
+		monitor.ReportIdempotentTotal(d.cfg.Namespace, "processing")
+		return fmt.Errorf("%w: %s", ErrProcessing, key)
+	}
+
+	if err = d.call(ctx, key, f); err != nil {
+		d.release(ctx, key)
+		monitor.ReportIdempotentTotal(d.cfg.Namespace, "failed")
+		return err
+	}
+
+	// 已处理成功，提交失败只会导致占用期过后可能重复处理
+	if err = d.store.Commit(ctx, key, d.cfg.TTL); err != nil {
+		log.WithField("key", key).WithError(err).Error("commit idempotent key failed")
+	}
+	monitor.ReportIdempotentTotal(d.cfg.Namespace, "processed")
+	return nil
+}
+
+// call f panic时也要释放key
+func (d *Deduplicator) call(ctx context.Context, key string, f func() error) error {
+	defer func() {
+		if re := recover(); re != nil {
+			d.release(ctx, key)
+			panic(re)
+		}
+	}()
+	return f()
+}
+
+func (d *Deduplicator) release(ctx context.Context, key string) {
+	if err := d.store.Release(ctx, key); err != nil {
+		log.WithField("key", key).WithError(err).Error("release idempotent key failed")
+	}
+}
+
+// JSONField 取json消息体中的字段作为消息id，嵌套字段用.分隔，如data.order_id
+func JSONField(body []byte, path string) (string, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+
+	for _, field := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("%w: %s", ErrMissingId, path)
+		}
+		if value, ok = object[field]; !ok {
+			return "", fmt.Errorf("%w: %s", ErrMissingId, path)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return "", fmt.Errorf("%w: %s", ErrMissingId, path)
+		}
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("%w: %s is not a string or number", ErrMissingId, path)
+	}
+}
@@ -0,0 +1,139 @@
+package idempotent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestDeduplicator(t *testing.T, store Store, cfg *Config) *Deduplicator {
+	t.Helper()
+
+	d, err := NewDeduplicator(store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDeduplicatorDuplicate(t *testing.T) {
+	store := NewMemoryStore()
+	d := newTestDeduplicator(t, store, &Config{Namespace: "orders"})
+	ctx := context.Background()
+
+	calls := 0
+	f := func() error {
+		calls++
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.Do(ctx, "m1", f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("calls = %d", calls)
+	}
+
+	// key带namespace前缀
+	assertAcquire(t, store, "orders:m1", time.Minute, Committed)
+
+	if err := d.Do(ctx, "", f); !errors.Is(err, ErrMissingId) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestDeduplicatorProcessing(t *testing.T) {
+	store := NewMemoryStore()
+	d := newTestDeduplicator(t, store, nil)
+	ctx := context.Background()
+
+	// 其他消费者正在处理，不能当作重复消息跳过
+	assertAcquire(t, store, "m1", time.Minute, Acquired)
+	err := d.Do(ctx, "m1", func() error {
+		t.Fatal("processing message handled")
+		return nil
+	})
+	if !errors.Is(err, ErrProcessing) {
+		t.Fatalf("err = %v", err)
+	}
+
+	// 处理失败释放后可以再处理
+	if err := store.Release(ctx, "m1"); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	if err := d.Do(ctx, "m1", func() error { calls++; return nil }); err != nil || calls != 1 {
+		t.Fatalf("calls = %d, err = %v", calls, err)
+	}
+}
+
+func TestDeduplicatorRelease(t *testing.T) {
+	d := newTestDeduplicator(t, NewMemoryStore(), nil)
+	ctx := context.Background()
+
+	consumeErr := errors.New("failed")
+	if err := d.Do(ctx, "m1", func() error { return consumeErr }); !errors.Is(err, consumeErr) {
+		t.Fatalf("err = %v", err)
+	}
+
+	func() {
+		defer func() {
+			if re := recover(); re != "boom" {
+				t.Fatalf("recover = %v", re)
+			}
+		}()
+		_ = d.Do(ctx, "m2", func() error { panic("boom") })
+	}()
+
+	// 失败和panic后都已释放，重新投递时再处理
+	for _, id := range []string{"m1", "m2"} {
+		calls := 0
+		if err := d.Do(ctx, id, func() error { calls++; return nil }); err != nil || calls != 1 {
+			t.Fatalf("%s: calls = %d, err = %v", id, calls, err)
+		}
+	}
+}
+
+func TestDeduplicatorTTL(t *testing.T) {
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "gorm": newTestGormStore(t)} {
+		d := newTestDeduplicator(t, store, &Config{TTL: 10 * time.Millisecond})
+		ctx := context.Background()
+
+		calls := 0
+		f := func() error {
+			calls++
+			return nil
+		}
+		if err := d.Do(ctx, "m1", f); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Do(ctx, "m1", f); err != nil || calls != 1 {
+			t.Fatalf("%s: calls = %d, err = %v", name, calls, err)
+		}
+
+		// 记录过期后重复投递的消息会再处理
+		time.Sleep(20 * time.Millisecond)
+		if err := d.Do(ctx, "m1", f); err != nil || calls != 2 {
+			t.Fatalf("%s: calls = %d, err = %v", name, calls, err)
+		}
+	}
+}
+
+func TestJSONField(t *testing.T) {
+	body := []byte(`{"id":"m1","data":{"order_id":12345678901234567890,"empty":""}}`)
+
+	cases := map[string]string{"id": "m1", "data.order_id": "12345678901234567890"}
+	for path, want := range cases {
+		if id, err := JSONField(body, path); err != nil || id != want {
+			t.Fatalf("%s: id = %s, err = %v", path, id, err)
+		}
+	}
+
+	for _, path := range []string{"missing", "data.empty", "id.order_id", "data"} {
+		if _, err := JSONField(body, path); !errors.Is(err, ErrMissingId) {
+			t.Fatalf("%s: err = %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package idempotent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+	用数据库表记录已处理的消息，多实例共享
+
+	CREATE TABLE `consumed_messages` (
+	  `key` varchar(255) NOT NULL,
+	  `expire_at` datetime(6) NOT NULL,
+	  `committed` tinyint(1) NOT NULL DEFAULT 0,
+	  `created_at` datetime(6) NOT NULL,
+	  PRIMARY KEY (`key`),
+	  KEY `idx_expire_at` (`expire_at`)
+	);
+
+	过期的记录不会自动删除，需定期调用Purge
+*/
+
+const DefaultGormStoreTable = "consumed_messages"
+
+type consumedMessage struct {
+	Key       string    `gorm:"column:key;primaryKey;size:255"`
+	ExpireAt  time.Time `gorm:"column:expire_at;index:idx_expire_at"`
+	Committed bool      `gorm:"column:committed;not null;default:false"`
+	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime:false"`
+}
+
+type GormStore struct {
+	db    *gorm.DB
+	table string
+}
+
+// NewGormStore table为空时使用consumed_messages
+func NewGormStore(db *gorm.DB, table string) (*GormStore, error) {
+	if db == nil {
+		return nil, errors.New("idempotent store db can't be nil")
+	}
+
+	if table == "" {
+		table = DefaultGormStoreTable
+	}
+	return &GormStore{
+		db:    db,
+		table: table,
+	}, nil
+}
+
+// AutoMigrate 建表，生产环境建议用上面的DDL
+func (s *GormStore) AutoMigrate() error {
+	return s.db.Table(s.table).AutoMigrate(&consumedMessage{})
+}
+
+func (s *GormStore) Acquire(ctx context.Context, key string, ttl time.Duration) (AcquireResult, error) {
+	now := time.Now().UTC()
+	result := s.db.WithContext(ctx).Table(s.table).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&consumedMessage{Key: key, ExpireAt: now.Add(ttl), CreatedAt: now})
+	if result.Error != nil {
+		return Processing, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return Acquired, nil
+	}
+
+	// 记录已存在，过期的可以重新占用
+	result = s.db.WithContext(ctx).Table(s.table).
+		Where(clause.Eq{Column: clause.Column{Name: "key"}, Value: key}).
+		Where("expire_at <= ?", now).
+		Updates(map[string]interface{}{"expire_at": now.Add(ttl), "committed": false, "created_at": now})
+	if result.Error != nil {
+		return Processing, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return Acquired, nil
+	}
+
+	var committed []bool
+	if err := s.db.WithContext(ctx).Table(s.table).
+		Where(clause.Eq{Column: clause.Column{Name: "key"}, Value: key}).
+		Pluck("committed", &committed).Error; err != nil {
+		return Processing, err
+	}
+	// 记录在两次查询之间被Release时也按处理中返回，稍后重试
+	if len(committed) > 0 && committed[0] {
+		return Committed, nil
+	}
+	return Processing, nil
+}
+
+func (s *GormStore) Commit(ctx context.Context, key string, ttl time.Duration) error {
+	return s.db.WithContext(ctx).Table(s.table).
+		Where(clause.Eq{Column: clause.Column{Name: "key"}, Value: key}).
+		Updates(map[string]interface{}{"expire_at": time.Now().UTC().Add(ttl), "committed": true}).Error
+}
+
+func (s *GormStore) Release(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).Table(s.table).
+		Where(clause.Eq{Column: clause.Column{Name: "key"}, Value: key}).
+		Delete(&consumedMessage{}).Error
+}
+
+// Purge 删除过期的记录，每次最多删除limit条，返回删除的条数
+func (s *GormStore) Purge(ctx context.Context, limit int) (int64, error) {
+	now := time.Now().UTC()
+
+	var keys []string
+	query := s.db.WithContext(ctx).Table(s.table).Where("expire_at <= ?", now)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Pluck("key", &keys).Error; err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	// 删除前再次确认已过期，期间可能被重新占用
+	result := s.db.WithContext(ctx).Table(s.table).
+		Where(clause.IN{Column: clause.Column{Name: "key"}, Values: toInterfaces(keys)}).
+		Where("expire_at <= ?", now).
+		Delete(&consumedMessage{})
+	return result.RowsAffected, result.Error
+}
+
+func toInterfaces(keys []string) []interface{} {
+	values := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, key)
+	}
+	return values
+}
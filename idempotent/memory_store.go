@@ -0,0 +1,75 @@
+package idempotent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const memoryStoreCleanInterval = time.Minute
+
+// MemoryStore 进程内的去重记录，只对单实例或同一分区的重复投递有效，重启后丢失
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	cleanedAt time.Time
+}
+
+type memoryEntry struct {
+	expireAt  time.Time
+	committed bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries:   map[string]memoryEntry{},
+		cleanedAt: time.Now(),
+	}
+}
+
+func (s *MemoryStore) Acquire(_ context.Context, key string, ttl time.Duration) (AcquireResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.clean(now)
+
+	if entry, ok := s.entries[key]; ok && entry.expireAt.After(now) {
+		if entry.committed {
+			return Committed, nil
+		}
+		return Processing, nil
+	}
+	s.entries[key] = memoryEntry{expireAt: now.Add(ttl)}
+	return Acquired, nil
+}
+
+func (s *MemoryStore) Commit(_ context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = memoryEntry{expireAt: time.Now().Add(ttl), committed: true}
+	return nil
+}
+
+func (s *MemoryStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// clean 定期删除过期的key
+func (s *MemoryStore) clean(now time.Time) {
+	if now.Sub(s.cleanedAt) < memoryStoreCleanInterval {
+		return
+	}
+
+	for key, entry := range s.entries {
+		if !entry.expireAt.After(now) {
+			delete(s.entries, key)
+		}
+	}
+	s.cleanedAt = now
+}
@@ -0,0 +1,103 @@
+package idempotent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestGormStore(t *testing.T) *GormStore {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 内存数据库每个连接独立，只用一个连接
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	store, err := NewGormStore(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func assertAcquire(t *testing.T, store Store, key string, ttl time.Duration, want AcquireResult) {
+	t.Helper()
+
+	result, err := store.Acquire(context.Background(), key, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != want {
+		t.Fatalf("acquire %s = %v, want %v", key, result, want)
+	}
+}
+
+// testStore Store实现的公共测试
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	// 处理中、已提交、释放
+	assertAcquire(t, store, "k1", time.Minute, Acquired)
+	assertAcquire(t, store, "k1", time.Minute, Processing)
+	if err := store.Commit(ctx, "k1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	assertAcquire(t, store, "k1", time.Minute, Committed)
+	if err := store.Release(ctx, "k1"); err != nil {
+		t.Fatal(err)
+	}
+	assertAcquire(t, store, "k1", time.Minute, Acquired)
+
+	// 占用期过后可以重新占用
+	assertAcquire(t, store, "k2", 10*time.Millisecond, Acquired)
+	time.Sleep(20 * time.Millisecond)
+	assertAcquire(t, store, "k2", time.Minute, Acquired)
+	assertAcquire(t, store, "k2", time.Minute, Processing)
+
+	// 提交记录过期后重新占用，状态为处理中
+	assertAcquire(t, store, "k3", time.Minute, Acquired)
+	if err := store.Commit(ctx, "k3", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	assertAcquire(t, store, "k3", time.Minute, Acquired)
+	assertAcquire(t, store, "k3", time.Minute, Processing)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestGormStore(t *testing.T) {
+	store := newTestGormStore(t)
+	testStore(t, store)
+
+	ctx := context.Background()
+	assertAcquire(t, store, "expired", time.Millisecond, Acquired)
+	time.Sleep(10 * time.Millisecond)
+
+	purged, err := store.Purge(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Fatalf("purged = %d", purged)
+	}
+	assertAcquire(t, store, "k1", time.Minute, Processing)
+}
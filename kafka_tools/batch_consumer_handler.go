@@ -0,0 +1,242 @@
+package kafka_tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/monitor"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	按分区批量消费，攒够BatchSize条或距第一条消息超过FlushInterval时调用一次BatchConsumeFunc
+	1. 返回nil时整批提交
+	2. 返回*BatchError时只有Failed中的消息失败，其余视为成功
+	3. 返回其他错误时整批失败
+	失败的消息按FailurePolicy转发到重试topic或DLQ后整批提交；没有配置或转发失败时只提交第一条失败消息之前的部分，停止消费该分区
+	重试topic中未到x-retry-not-before的消息不加入当前批次：先处理已攒的消息，等到时间后再开始新的一批
+*/
+
+const (
+	DefaultBatchSize          = 500
+	DefaultBatchFlushInterval = 200 * time.Millisecond
+)
+
+type BatchConsumeFunc func(msgs []*sarama.ConsumerMessage) error
+
+// BatchError 批量消费部分失败
+type BatchError struct {
+	Failed []*sarama.ConsumerMessage
+	Err    error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d msgs consume failed: %v", len(e.Failed), e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+type BatchConsumerHandler struct {
+	batchConsumeFunc BatchConsumeFunc
+	batchSize        int
+	flushInterval    time.Duration
+	processor        *messageProcessor
+}
+
+func NewBatchConsumerHandler(batchConsumeFunc BatchConsumeFunc, opts ...HandlerOption) *BatchConsumerHandler {
+	handlerOpts := newHandlerOpts(opts)
+
+	handler := &BatchConsumerHandler{
+		batchConsumeFunc: batchConsumeFunc,
+		batchSize:        handlerOpts.batchSize,
+		flushInterval:    handlerOpts.batchFlushInterval,
+		processor:        &messageProcessor{policy: handlerOpts.failurePolicy},
+	}
+
+	if handler.batchSize <= 0 {
+		handler.batchSize = DefaultBatchSize
+	}
+	if handler.flushInterval <= 0 {
+		handler.flushInterval = DefaultBatchFlushInterval
+	}
+	return handler
+}
+
+func (*BatchConsumerHandler) Setup(_ sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (*BatchConsumerHandler) Cleanup(_ sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (handler *BatchConsumerHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	batch := make([]*sarama.ConsumerMessage, 0, handler.batchSize)
+	timer := time.NewTimer(handler.flushInterval)
+	timer.Stop()
+	defer timer.Stop()
+
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		ok := handler.flush(sess, batch)
+		batch = make([]*sarama.ConsumerMessage, 0, handler.batchSize)
+		return ok
+	}
+
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				flush()
+				return nil
+			}
+
+			if notBeforeWait(msg) > 0 {
+				if !flush() {
+					return nil
+				}
+				if err := waitNotBefore(sess.Context(), msg); err != nil {
+					// session结束，未处理的消息重新消费
+					return nil
+				}
+			}
+
+			if len(batch) == 0 {
+				timer.Reset(handler.flushInterval)
+			}
+
+			batch = append(batch, msg)
+			if len(batch) >= handler.batchSize && !flush() {
+				return nil
+			}
+		case <-timer.C:
+			if !flush() {
+				return nil
+			}
+		case <-sess.Context().Done():
+			// 已拉取的消息处理完再退出
+			flush()
+			return nil
+		}
+	}
+}
+
+// flush 返回false时停止消费该分区
+func (handler *BatchConsumerHandler) flush(sess sarama.ConsumerGroupSession, batch []*sarama.ConsumerMessage) bool {
+	topic := batch[0].Topic
+	log.WithFields(log.Fields{
+		"topic":     topic,
+		"partition": batch[0].Partition,
+		"offset":    batch[0].Offset,
+		"count":     len(batch),
+	}).Debug("consume msg batch")
+
+	monitor.ReportKafkaInFlight(topic, len(batch))
+	err := handler.consume(sess.Context(), batch)
+	monitor.ReportKafkaInFlight(topic, -len(batch))
+	if err == nil {
+		sess.MarkMessage(batch[len(batch)-1], "")
+		return true
+	}
+
+	failed := batch
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		failed = batchErr.Failed
+	}
+
+	log.WithFields(log.Fields{
+		"topic":     topic,
+		"partition": batch[0].Partition,
+		"offset":    batch[0].Offset,
+		"count":     len(batch),
+		"failed":    len(failed),
+	}).WithError(err).Error("consume kafka msg batch error")
+
+	isFailed := make(map[int64]bool, len(failed))
+	for _, msg := range failed {
+		isFailed[msg.Offset] = true
+	}
+
+	for i, msg := range batch {
+		if !isFailed[msg.Offset] {
+			monitor.ReportKafkaConsumeTotal(topic, "success")
+			continue
+		}
+
+		monitor.ReportKafkaConsumeTotal(topic, "failed")
+		if handler.processor.policy == nil || handler.processor.fail(msg, err) != nil {
+			// 只提交失败消息之前的部分，失败的消息及之后的消息重新消费
+			if i > 0 {
+				sess.MarkMessage(batch[i-1], "")
+			}
+			return false
+		}
+	}
+
+	sess.MarkMessage(batch[len(batch)-1], "")
+	return true
+}
+
+// consume 配置了FailurePolicy时整批失败会原地重试，部分失败不重试
+func (handler *BatchConsumerHandler) consume(ctx context.Context, batch []*sarama.ConsumerMessage) error {
+	err := handler.consumeOnce(batch)
+	if err == nil || handler.processor.policy == nil {
+		return err
+	}
+
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return err
+	}
+
+	for attempt := 0; attempt < handler.processor.policy.MaxRetries; attempt++ {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(handler.processor.policy.backoff(attempt)):
+		}
+
+		if err = handler.consumeOnce(batch); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (handler *BatchConsumerHandler) consumeOnce(batch []*sarama.ConsumerMessage) (err error) {
+	defer func() {
+		if re := recover(); re != nil {
+			stack := string(debug.Stack())
+			log.WithField("stack", stack).Errorf("consume kafka msg batch paniced: %v", re)
+			err = &panicError{value: re, stack: stack}
+		}
+	}()
+
+	startAt := time.Now()
+	if err = handler.batchConsumeFunc(batch); err != nil {
+		return err
+	}
+
+	monitor.ReportKafkaConsumeTimeCost(startAt, batch[0].Topic)
+	for _, msg := range batch {
+		monitor.ReportKafkaConsumeLatency(msg.Timestamp, msg.Topic)
+		monitor.ReportKafkaConsumeTotal(msg.Topic, "success")
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package kafka_tools_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/kafka_tools"
+	"github.com/jiangfans/handy/kafka_tools/kafkatest"
+)
+
+// batchRecorder 记录每批消息的offset
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches [][]int64
+}
+
+func (r *batchRecorder) record(msgs []*sarama.ConsumerMessage) {
+	offsets := make([]int64, 0, len(msgs))
+	for _, msg := range msgs {
+		offsets = append(offsets, msg.Offset)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, offsets)
+}
+
+func (r *batchRecorder) sizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sizes := make([]int, 0, len(r.batches))
+	for _, batch := range r.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func drain(t *testing.T, cluster *kafkatest.Cluster, handler sarama.ConsumerGroupHandler) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cluster.Drain(ctx, "group", handler, "orders"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchFlushBySize(t *testing.T) {
+	cluster := kafkatest.NewCluster()
+	publishN(t, cluster, "orders", 6)
+
+	recorder := &batchRecorder{}
+	handler := kafka_tools.NewBatchConsumerHandler(func(msgs []*sarama.ConsumerMessage) error {
+		recorder.record(msgs)
+		return nil
+	}, kafka_tools.WithBatchSize(3), kafka_tools.WithBatchFlushInterval(time.Hour))
+	drain(t, cluster, handler)
+
+	if sizes := recorder.sizes(); len(sizes) != 2 || sizes[0] != 3 || sizes[1] != 3 {
+		t.Fatalf("batch sizes = %v", sizes)
+	}
+	if committed := cluster.CommittedOffset("group", "orders", 0); committed != 6 {
+		t.Fatalf("committed = %d", committed)
+	}
+}
+
+func TestBatchFlushByInterval(t *testing.T) {
+	cluster := kafkatest.NewCluster()
+	publishN(t, cluster, "orders", 2)
+
+	recorder := &batchRecorder{}
+	handler := kafka_tools.NewBatchConsumerHandler(func(msgs []*sarama.ConsumerMessage) error {
+		recorder.record(msgs)
+		return nil
+	}, kafka_tools.WithBatchSize(100), kafka_tools.WithBatchFlushInterval(20*time.Millisecond))
+	drain(t, cluster, handler)
+
+	if sizes := recorder.sizes(); len(sizes) != 1 || sizes[0] != 2 {
+		t.Fatalf("batch sizes = %v", sizes)
+	}
+	if committed := cluster.CommittedOffset("group", "orders", 0); committed != 2 {
+		t.Fatalf("committed = %d", committed)
+	}
+}
+
+func TestBatchPartialFailureToDLQ(t *testing.T) {
+	cluster := kafkatest.NewCluster()
+	publishN(t, cluster, "orders", 4)
+
+	handler := kafka_tools.NewBatchConsumerHandler(func(msgs []*sarama.ConsumerMessage) error {
+		return &kafka_tools.BatchError{Failed: []*sarama.ConsumerMessage{msgs[1]}, Err: errors.New("invalid order")}
+	}, kafka_tools.WithBatchSize(4), kafka_tools.WithFailurePolicy(&kafka_tools.FailurePolicy{
+		MaxRetries: 1,
+		DLQTopic:   "orders.dlq",
+		Producer:   cluster.SyncProducer(),
+	}))
+	drain(t, cluster, handler)
+
+	// 部分失败不原地重试，只有失败的消息转到DLQ，整批提交
+	dlq := cluster.Messages("orders.dlq")
+	if len(dlq) != 1 || string(dlq[0].Value) != "1" {
+		t.Fatalf("dlq = %v", dlq)
+	}
+	if committed := cluster.CommittedOffset("group", "orders", 0); committed != 4 {
+		t.Fatalf("committed = %d", committed)
+	}
+}
+
+func TestBatchPartialFailureOffset(t *testing.T) {
+	cluster := kafkatest.NewCluster()
+	publishN(t, cluster, "orders", 5)
+
+	recorder := &batchRecorder{}
+	handler := kafka_tools.NewBatchConsumerHandler(func(msgs []*sarama.ConsumerMessage) error {
+		recorder.record(msgs)
+		return &kafka_tools.BatchError{Failed: []*sarama.ConsumerMessage{msgs[2], msgs[4]}, Err: errors.New("invalid order")}
+	}, kafka_tools.WithBatchSize(5))
+	drain(t, cluster, handler)
+
+	// 没有FailurePolicy时只提交第一条失败消息之前的部分，停止消费该分区
+	if committed := cluster.CommittedOffset("group", "orders", 0); committed != 2 {
+		t.Fatalf("committed = %d", committed)
+	}
+	if sizes := recorder.sizes(); len(sizes) != 1 {
+		t.Fatalf("batch sizes = %v", sizes)
+	}
+}
+
+func TestBatchRetryNotBefore(t *testing.T) {
+	cluster := kafkatest.NewCluster()
+	publishN(t, cluster, "orders", 2)
+
+	notBefore := time.Now().Add(100 * time.Millisecond)
+	_, _, err := cluster.PublishMessage(&sarama.ProducerMessage{
+		Topic: "orders",
+		Value: sarama.StringEncoder("retry"),
+		Headers: []sarama.RecordHeader{{
+			Key:   []byte(kafka_tools.HeaderRetryNotBefore),
+			Value: []byte(strconv.FormatInt(notBefore.UnixMilli(), 10)),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var consumedAt []time.Time
+	recorder := &batchRecorder{}
+	handler := kafka_tools.NewBatchConsumerHandler(func(msgs []*sarama.ConsumerMessage) error {
+		recorder.record(msgs)
+		consumedAt = append(consumedAt, time.Now())
+		return nil
+	}, kafka_tools.WithBatchSize(100), kafka_tools.WithBatchFlushInterval(20*time.Millisecond))
+	drain(t, cluster, handler)
+
+	// 未到时间的消息单独成批，等到时间后才处理
+	if sizes := recorder.sizes(); len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 1 {
+		t.Fatalf("batch sizes = %v", sizes)
+	}
+	if consumedAt[0].After(notBefore) {
+		t.Fatal("ready msgs waited for retry msg")
+	}
+	if consumedAt[1].Before(notBefore.Truncate(time.Millisecond)) {
+		t.Fatal("retry msg consumed before not-before")
+	}
+	if committed := cluster.CommittedOffset("group", "orders", 0); committed != 3 {
+		t.Fatalf("committed = %d", committed)
+	}
+}
@@ -0,0 +1,198 @@
+package kafka_tools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+const (
+	SASLMechanismPlain       = "PLAIN"
+	SASLMechanismScramSHA256 = "SCRAM-SHA-256"
+	SASLMechanismScramSHA512 = "SCRAM-SHA-512"
+)
+
+const DefaultKafkaVersion = "1.1.0"
+
+type SASLConfig struct {
+	Mechanism string // PLAIN、SCRAM-SHA-256、SCRAM-SHA-512
+	User      string
+	Password  string
+}
+
+// TLSConfig 证书可以是文件路径或PEM内容，都为空时使用系统根证书
+type TLSConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	CA   []byte
+	Cert []byte
+	Key  []byte
+
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// ClientConfig consumer和producer共用的连接配置
+type ClientConfig struct {
+	Version  string // kafka版本，如2.8.0，默认1.1.0
+	ClientId string
+	SASL     *SASLConfig
+	TLS      *TLSConfig
+	Mutator  func(cfg *sarama.Config) // 其他配置直接修改sarama.Config，在校验前调用
+}
+
+// newSaramaConfig consumer和producer共用的基础配置
+func newSaramaConfig(cfg *ClientConfig) (*sarama.Config, error) {
+	saramaConfig := sarama.NewConfig()
+
+	version := DefaultKafkaVersion
+	if cfg.Version != "" {
+		version = cfg.Version
+	}
+	kafkaVersion, err := sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("kafka config invalid, version %s: %w", version, err)
+	}
+	saramaConfig.Version = kafkaVersion
+
+	if cfg.ClientId != "" {
+		saramaConfig.ClientID = cfg.ClientId
+	}
+
+	if cfg.SASL != nil {
+		if err := applySASL(saramaConfig, cfg.SASL); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.TLS != nil {
+		tlsConfig, err := cfg.TLS.build()
+		if err != nil {
+			return nil, err
+		}
+		saramaConfig.Net.TLS.Enable = true
+		saramaConfig.Net.TLS.Config = tlsConfig
+	}
+
+	return saramaConfig, nil
+}
+
+// validateSaramaConfig 调用Mutator后校验
+func validateSaramaConfig(saramaConfig *sarama.Config, cfg *ClientConfig) error {
+	if cfg.Mutator != nil {
+		cfg.Mutator(saramaConfig)
+	}
+
+	if err := saramaConfig.Validate(); err != nil {
+		return fmt.Errorf("kafka config invalid: %w", err)
+	}
+	return nil
+}
+
+func applySASL(saramaConfig *sarama.Config, cfg *SASLConfig) error {
+	if cfg.User == "" || cfg.Password == "" {
+		return errors.New("kafka config invalid, sasl user and password can't be empty")
+	}
+
+	saramaConfig.Net.SASL.Enable = true
+	saramaConfig.Net.SASL.Handshake = true
+	saramaConfig.Net.SASL.User = cfg.User
+	saramaConfig.Net.SASL.Password = cfg.Password
+
+	switch cfg.Mechanism {
+	case "", SASLMechanismPlain:
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case SASLMechanismScramSHA256:
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: scram.SHA256}
+		}
+	case SASLMechanismScramSHA512:
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: scram.SHA512}
+		}
+	default:
+		return fmt.Errorf("kafka config invalid, unsupported sasl mechanism %s", cfg.Mechanism)
+	}
+	return nil
+}
+
+func (cfg *TLSConfig) build() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	ca, err := pemOrFile(cfg.CA, cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("kafka config invalid, tls ca: %w", err)
+	}
+	if len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("kafka config invalid, tls ca has no valid certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	cert, err := pemOrFile(cfg.Cert, cfg.CertFile)
+	if err != nil {
+		return nil, fmt.Errorf("kafka config invalid, tls cert: %w", err)
+	}
+	key, err := pemOrFile(cfg.Key, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("kafka config invalid, tls key: %w", err)
+	}
+
+	if len(cert) > 0 || len(key) > 0 {
+		if len(cert) == 0 || len(key) == 0 {
+			return nil, errors.New("kafka config invalid, tls cert and key must be set together")
+		}
+
+		keyPair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("kafka config invalid, tls key pair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+
+	return tlsConfig, nil
+}
+
+func pemOrFile(content []byte, file string) ([]byte, error) {
+	if len(content) > 0 || file == "" {
+		return content, nil
+	}
+	return os.ReadFile(file)
+}
+
+type scramClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	conversation  *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
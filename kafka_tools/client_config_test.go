@@ -0,0 +1,172 @@
+package kafka_tools
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// newTestCert 生成自签名证书，返回PEM格式的证书和私钥
+func newTestCert(t *testing.T) (cert, key []byte) {
+	t.Helper()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return
+}
+
+func TestSASLMechanism(t *testing.T) {
+	cases := []struct {
+		mechanism string
+		want      sarama.SASLMechanism
+		scram     bool
+	}{
+		{mechanism: "", want: sarama.SASLTypePlaintext},
+		{mechanism: SASLMechanismPlain, want: sarama.SASLTypePlaintext},
+		{mechanism: SASLMechanismScramSHA256, want: sarama.SASLTypeSCRAMSHA256, scram: true},
+		{mechanism: SASLMechanismScramSHA512, want: sarama.SASLTypeSCRAMSHA512, scram: true},
+	}
+
+	for _, c := range cases {
+		saramaConfig, err := newSaramaConfig(&ClientConfig{SASL: &SASLConfig{Mechanism: c.mechanism, User: "u", Password: "p"}})
+		if err != nil {
+			t.Fatalf("%s: %v", c.mechanism, err)
+		}
+
+		sasl := saramaConfig.Net.SASL
+		if !sasl.Enable || sasl.Mechanism != c.want || sasl.User != "u" || sasl.Password != "p" {
+			t.Fatalf("%s: sasl = %+v", c.mechanism, sasl)
+		}
+		if (sasl.SCRAMClientGeneratorFunc != nil) != c.scram {
+			t.Fatalf("%s: scram client generator = %v", c.mechanism, sasl.SCRAMClientGeneratorFunc != nil)
+		}
+		if c.scram {
+			if err := sasl.SCRAMClientGeneratorFunc().Begin("u", "p", ""); err != nil {
+				t.Fatalf("%s: %v", c.mechanism, err)
+			}
+		}
+	}
+
+	if _, err := newSaramaConfig(&ClientConfig{SASL: &SASLConfig{Mechanism: "GSSAPI", User: "u", Password: "p"}}); err == nil {
+		t.Fatal("unsupported mechanism accepted")
+	}
+	if _, err := newSaramaConfig(&ClientConfig{SASL: &SASLConfig{User: "u"}}); err == nil {
+		t.Fatal("empty password accepted")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	cert, key := newTestCert(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]*TLSConfig{
+		"file":   {CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "kafka"},
+		"inline": {CA: cert, Cert: cert, Key: key, ServerName: "kafka"},
+	}
+	for name, tlsConfig := range cases {
+		saramaConfig, err := newSaramaConfig(&ClientConfig{TLS: tlsConfig})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		tls := saramaConfig.Net.TLS
+		if !tls.Enable || tls.Config.RootCAs == nil || len(tls.Config.Certificates) != 1 || tls.Config.ServerName != "kafka" {
+			t.Fatalf("%s: tls = %+v", name, tls.Config)
+		}
+	}
+
+	invalid := map[string]*TLSConfig{
+		"invalid ca":       {CA: []byte("not a pem")},
+		"invalid key":      {Cert: cert, Key: []byte("not a pem")},
+		"cert without key": {Cert: cert},
+		"missing file":     {CAFile: filepath.Join(dir, "missing.pem")},
+	}
+	for name, tlsConfig := range invalid {
+		if _, err := newSaramaConfig(&ClientConfig{TLS: tlsConfig}); err == nil {
+			t.Fatalf("%s accepted", name)
+		}
+	}
+}
+
+func TestConsumerSaramaConfigInvalid(t *testing.T) {
+	cases := map[string]*ConsumerConfig{
+		"rebalance strategy": {RebalanceStrategy: "unknown"},
+		"version":            {ClientConfig: ClientConfig{Version: "not a version"}},
+		"heartbeat":          {SessionTimeout: 3 * time.Second, HeartbeatInterval: 2 * time.Second},
+		"fetch":              {FetchDefault: 2048, FetchMax: 1024},
+	}
+	for name, cfg := range cases {
+		if _, err := newConsumerSaramaConfig(cfg); err == nil || !strings.Contains(err.Error(), "kafka config invalid") {
+			t.Fatalf("%s: err = %v", name, err)
+		}
+	}
+
+	saramaConfig, err := newConsumerSaramaConfig(&ConsumerConfig{RebalanceStrategy: RebalanceStrategySticky, ClientConfig: ClientConfig{Version: "2.8.0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saramaConfig.Consumer.Group.Rebalance.Strategy != sarama.BalanceStrategySticky || saramaConfig.Version != sarama.V2_8_0_0 {
+		t.Fatalf("strategy = %v, version = %v", saramaConfig.Consumer.Group.Rebalance.Strategy, saramaConfig.Version)
+	}
+}
+
+func TestMutatorBeforeValidate(t *testing.T) {
+	// Mutator的修改生效
+	saramaConfig, err := newConsumerSaramaConfig(&ConsumerConfig{ClientConfig: ClientConfig{
+		Mutator: func(cfg *sarama.Config) { cfg.ChannelBufferSize = 1024 },
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saramaConfig.ChannelBufferSize != 1024 {
+		t.Fatalf("channel buffer size = %d", saramaConfig.ChannelBufferSize)
+	}
+
+	// Mutator之后再校验，改成非法值时报错
+	_, err = newConsumerSaramaConfig(&ConsumerConfig{ClientConfig: ClientConfig{
+		Mutator: func(cfg *sarama.Config) { cfg.Consumer.Fetch.Min = 0 },
+	}})
+	if err == nil || !strings.Contains(err.Error(), "kafka config invalid") {
+		t.Fatalf("err = %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package kafka_tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/hamba/avro"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec 消息体的编解码
+type Codec interface {
+	Name() string
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufCodec v需实现proto.Message，TypedConsumeFunc的T为生成的结构体类型（非指针）
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (ProtobufCodec) Encode(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (ProtobufCodec) Decode(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not proto.Message", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// AvroCodec 使用本地schema编解码avro二进制，结构体字段用avro tag对应
+type AvroCodec struct {
+	schema avro.Schema
+}
+
+func NewAvroCodec(schema string) (*AvroCodec, error) {
+	s, err := avro.Parse(schema)
+	if err != nil {
+		return nil, fmt.Errorf("parse avro schema failed: %w", err)
+	}
+	return &AvroCodec{schema: s}, nil
+}
+
+func NewAvroCodecFromFile(file string) (*AvroCodec, error) {
+	schema, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewAvroCodec(string(schema))
+}
+
+func (c *AvroCodec) Name() string {
+	return "avro"
+}
+
+func (c *AvroCodec) Encode(v interface{}) ([]byte, error) {
+	return avro.Marshal(c.schema, v)
+}
+
+func (c *AvroCodec) Decode(data []byte, v interface{}) error {
+	return avro.Unmarshal(c.schema, data, v)
+}
@@ -0,0 +1,179 @@
+package kafka_tools
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	每个分区内并发消费
+	1. 按key哈希分到Concurrency个子队列，同一个key的消息在同一个子队列中顺序处理，没有key的消息按offset分配
+	2. 只提交到连续处理完成的最小offset，rebalance或重启后未提交的消息会重新消费，不会丢消息
+	3. 某条消息处理失败后停止拉取该分区，所有子队列（不只是失败key的队列）中缓冲的消息都不再处理，
+	   等处理中的消息结束后返回，失败的消息及之后未提交的消息会重新消费
+	4. session结束（rebalance、退出）后同样不再处理缓冲的消息，避免分区分配给其他消费者后重复处理
+*/
+
+const DefaultConcurrency = 10
+
+// 每个子队列的缓冲，避免某个key处理慢时阻塞拉取
+const subQueueSize = 16
+
+type ConcurrentConsumerHandler struct {
+	processor   *messageProcessor
+	concurrency int
+}
+
+func NewConcurrentConsumerHandler(consumeFunc ConsumeFunc, concurrency int, opts ...HandlerOption) *ConcurrentConsumerHandler {
+	return NewConcurrentContextConsumerHandler(consumeFunc.withContext(), concurrency, opts...)
+}
+
+func NewConcurrentContextConsumerHandler(consumeFunc ContextConsumeFunc, concurrency int, opts ...HandlerOption) *ConcurrentConsumerHandler {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	return &ConcurrentConsumerHandler{
+		processor:   newMessageProcessor(consumeFunc, opts),
+		concurrency: concurrency,
+	}
+}
+
+func (*ConcurrentConsumerHandler) Setup(_ sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (*ConcurrentConsumerHandler) Cleanup(_ sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (handler *ConcurrentConsumerHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	tracker := newOffsetTracker(sess, claim.Topic(), claim.Partition())
+	failed := make(chan struct{})
+	var failOnce sync.Once
+
+	var wg sync.WaitGroup
+	queues := make([]chan *sarama.ConsumerMessage, handler.concurrency)
+	for i := range queues {
+		queues[i] = make(chan *sarama.ConsumerMessage, subQueueSize)
+
+		wg.Add(1)
+		go func(queue chan *sarama.ConsumerMessage) {
+			defer wg.Done()
+			for msg := range queue {
+				select {
+				case <-failed:
+					// 已有消息失败，后面的消息都不再处理，同key的消息保证顺序
+					continue
+				case <-sess.Context().Done():
+					// 分区可能已分配给其他消费者
+					continue
+				default:
+				}
+
+				if err := handler.processor.process(sess.Context(), msg); err != nil {
+					failOnce.Do(func() { close(failed) })
+					continue
+				}
+				tracker.done(msg.Offset)
+			}
+		}(queues[i])
+	}
+
+	defer func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-sess.Context().Done():
+			return nil
+		case <-failed:
+			return nil
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+
+			log.WithFields(log.Fields{
+				"topic":     msg.Topic,
+				"partition": msg.Partition,
+				"offset":    msg.Offset,
+				"timestamp": msg.Timestamp.In(utils.CST).Format(time.RFC3339),
+			}).Debug("received msg")
+
+			tracker.add(msg.Offset)
+			queue := queues[handler.queueIndex(msg)]
+			select {
+			case queue <- msg:
+			case <-failed:
+				return nil
+			case <-sess.Context().Done():
+				return nil
+			}
+		}
+	}
+}
+
+func (handler *ConcurrentConsumerHandler) queueIndex(msg *sarama.ConsumerMessage) int {
+	if len(msg.Key) == 0 {
+		return int(msg.Offset % int64(handler.concurrency))
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write(msg.Key)
+	return int(h.Sum32() % uint32(handler.concurrency))
+}
+
+// offsetTracker 记录分区内处理中的offset，只提交连续完成的部分
+type offsetTracker struct {
+	sess      sarama.ConsumerGroupSession
+	topic     string
+	partition int32
+
+	mu        sync.Mutex
+	pending   []int64 // 按拉取顺序，offset递增
+	completed map[int64]bool
+}
+
+func newOffsetTracker(sess sarama.ConsumerGroupSession, topic string, partition int32) *offsetTracker {
+	return &offsetTracker{
+		sess:      sess,
+		topic:     topic,
+		partition: partition,
+		completed: make(map[int64]bool),
+	}
+}
+
+func (t *offsetTracker) add(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, offset)
+}
+
+func (t *offsetTracker) done(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.completed[offset] = true
+
+	var committed int64 = -1
+	for len(t.pending) > 0 && t.completed[t.pending[0]] {
+		committed = t.pending[0]
+		delete(t.completed, committed)
+		t.pending = t.pending[1:]
+	}
+
+	if committed >= 0 {
+		// 提交的是下一条要消费的offset
+		t.sess.MarkOffset(t.topic, t.partition, committed+1, "")
+	}
+}
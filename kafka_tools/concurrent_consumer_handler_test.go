@@ -0,0 +1,213 @@
+package kafka_tools_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/kafka_tools"
+	"github.com/jiangfans/handy/kafka_tools/kafkatest"
+)
+
+// publishN 向单分区topic发送n条消息，keys为空时不带key
+func publishN(t *testing.T, cluster *kafkatest.Cluster, topic string, n int, keys ...string) {
+	t.Helper()
+
+	cluster.CreateTopic(topic, 1)
+	for i := 0; i < n; i++ {
+		var key string
+		if len(keys) > 0 {
+			key = keys[i%len(keys)]
+		}
+		if _, _, err := cluster.Publish(topic, key, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// consumeInBackground 运行handler直到返回的cancel被调用，cancel等待Consume返回
+func consumeInBackground(t *testing.T, cluster *kafkatest.Cluster, handler sarama.ConsumerGroupHandler, topic string) (cancel func()) {
+	t.Helper()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	group := cluster.ConsumerGroup("group")
+	done := make(chan error, 1)
+	go func() {
+		done <- group.Consume(ctx, []string{topic}, handler)
+	}()
+
+	return func() {
+		cancelCtx()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("consume not return")
+		}
+	}
+}
+
+func TestConcurrentKeyOrder(t *testing.T) {
+	cluster := kafkatest.NewCluster()
+	keys := []string{"a", "b", "c", "d", "e"}
+	publishN(t, cluster, "orders", 100, keys...)
+
+	var mu sync.Mutex
+	consumed := map[string][]int64{}
+	handler := kafka_tools.NewConcurrentConsumerHandler(func(msg *sarama.ConsumerMessage) error {
+		// 不同key处理速度不同
+		time.Sleep(time.Duration(msg.Key[0]-'a') * 100 * time.Microsecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		consumed[string(msg.Key)] = append(consumed[string(msg.Key)], msg.Offset)
+		return nil
+	}, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cluster.Drain(ctx, "group", handler, "orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	if committed := cluster.CommittedOffset("group", "orders", 0); committed != 100 {
+		t.Fatalf("committed = %d", committed)
+	}
+	for key, offsets := range consumed {
+		if len(offsets) != 20 {
+			t.Fatalf("key %s consumed %d", key, len(offsets))
+		}
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] <= offsets[i-1] {
+				t.Fatalf("key %s out of order: %v", key, offsets)
+			}
+		}
+	}
+}
+
+func TestConcurrentContiguousOffset(t *testing.T) {
+	cluster := kafkatest.NewCluster()
+	// 没有key的消息按offset分到不同子队列
+	publishN(t, cluster, "orders", 3)
+
+	release := make(chan struct{})
+	later := make(chan int64, 2)
+	handler := kafka_tools.NewConcurrentConsumerHandler(func(msg *sarama.ConsumerMessage) error {
+		if msg.Offset == 0 {
+			<-release
+			return nil
+		}
+		later <- msg.Offset
+		return nil
+	}, 3)
+
+	stop := consumeInBackground(t, cluster, handler, "orders")
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-later:
+		case <-time.After(5 * time.Second):
+			t.Fatal("later offsets not consumed")
+		}
+	}
+	// offset 0未完成，1、2完成也不能提交
+	time.Sleep(10 * time.Millisecond)
+	if committed := cluster.CommittedOffset("group", "orders", 0); committed != -1 {
+		t.Fatalf("committed = %d before offset 0 done", committed)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cluster.WaitCaughtUp(ctx, "group", "orders"); err != nil {
+		t.Fatal(err)
+	}
+	if committed := cluster.CommittedOffset("group", "orders", 0); committed != 3 {
+		t.Fatalf("committed = %d", committed)
+	}
+}
+
+func TestConcurrentFailStop(t *testing.T) {
+	cluster := kafkatest.NewCluster()
+	publishN(t, cluster, "orders", 10, "a", "b")
+
+	var mu sync.Mutex
+	var consumed []int64
+	handler := kafka_tools.NewConcurrentConsumerHandler(func(msg *sarama.ConsumerMessage) error {
+		if msg.Offset == 3 {
+			return errors.New("failed")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		consumed = append(consumed, msg.Offset)
+		return nil
+	}, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// 失败后ConsumeClaim返回，session结束
+	if err := cluster.Drain(ctx, "group", handler, "orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 其他子队列缓冲的消息也可能被跳过，提交位置不会越过失败的消息
+	committed := cluster.CommittedOffset("group", "orders", 0)
+	if committed < 1 || committed > 3 {
+		t.Fatalf("committed = %d", committed)
+	}
+	for _, offset := range consumed {
+		// 同key（b）失败之后的消息不能处理
+		if offset > 3 && offset%2 == 1 {
+			t.Fatalf("consumed %d after failed offset: %v", offset, consumed)
+		}
+	}
+}
+
+func TestConcurrentStopOnSessionDone(t *testing.T) {
+	cluster := kafkatest.NewCluster()
+	publishN(t, cluster, "orders", 5, "a")
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var consumed []int64
+	handler := kafka_tools.NewConcurrentConsumerHandler(func(msg *sarama.ConsumerMessage) error {
+		if msg.Offset == 0 {
+			close(started)
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		consumed = append(consumed, msg.Offset)
+		return nil
+	}, 1)
+
+	stop := consumeInBackground(t, cluster, handler, "orders")
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not started")
+	}
+	// 等后面的消息进入子队列缓冲
+	time.Sleep(20 * time.Millisecond)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	stop()
+
+	if len(consumed) != 1 || consumed[0] != 0 {
+		t.Fatalf("consumed after session done: %v", consumed)
+	}
+	if committed := cluster.CommittedOffset("group", "orders", 0); committed != 1 {
+		t.Fatalf("committed = %d", committed)
+	}
+}
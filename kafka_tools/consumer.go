@@ -2,7 +2,10 @@ package kafka_tools
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
+
 	"github.com/Shopify/sarama"
 	log "github.com/sirupsen/logrus"
 )
@@ -14,16 +17,56 @@ const (
 
 type ConsumeFunc func(msg *sarama.ConsumerMessage) error
 
+// ContextConsumeFunc ctx为消费组session的ctx，rebalance或退出时结束
+type ContextConsumeFunc func(ctx context.Context, msg *sarama.ConsumerMessage) error
+
+func (f ConsumeFunc) withContext() ContextConsumeFunc {
+	return func(_ context.Context, msg *sarama.ConsumerMessage) error {
+		return f(msg)
+	}
+}
+
+const (
+	RebalanceStrategyRange      = "range"
+	RebalanceStrategyRoundRobin = "roundrobin"
+	RebalanceStrategySticky     = "sticky"
+)
+
 type ConsumerConfig struct {
-	Addrs         []string
-	ListenTopics  []string
-	GroupId       string
-	InitialOffset int64
-	Concurrency   int
+	ClientConfig
+
+	Addrs           []string
+	ListenTopics    []string
+	GroupId         string
+	InitialOffset   int64
+	Concurrency     int            // 并发消费时每个分区的并发数，默认10
+	FailurePolicy   *FailurePolicy // 消费失败的处理策略，为空时失败的消息会堵塞分区
+	ShutdownTimeout time.Duration  // ctx结束后等待处理中消息的时间，默认30s，超时后处理中的消息在后台继续运行
+
+	BatchSize          int           // 批量消费每批最大消息数，默认500
+	BatchFlushInterval time.Duration // 批量消费未攒满时最长等待时间，默认200ms
+
+	LagReportInterval time.Duration // 上报消费lag的间隔，默认30s，小于0时不上报
+
+	RebalanceStrategy string        // range、roundrobin、sticky，默认range
+	SessionTimeout    time.Duration // 默认10s
+	HeartbeatInterval time.Duration // 默认3s，需小于SessionTimeout的1/3
+	RebalanceTimeout  time.Duration // 默认60s
+	MaxProcessingTime time.Duration // 单条消息最长处理时间，默认100ms
+
+	// 拉取大小，单位字节，为0时使用sarama默认值
+	FetchMin     int32
+	FetchDefault int32
+	FetchMax     int32
 }
 
 type Consumer interface {
-	Run(ctx context.Context, f ConsumeFunc, concurrency bool)
+	// Run 阻塞直到ctx结束或出错，ctx结束后等待处理中的消息完成再返回
+	Run(ctx context.Context, f ConsumeFunc, concurrency bool) error
+	// RunContext 同Run，处理函数可以拿到session的ctx
+	RunContext(ctx context.Context, f ContextConsumeFunc, concurrency bool) error
+	// RunBatch 按分区批量消费
+	RunBatch(ctx context.Context, f BatchConsumeFunc) error
 }
 
 func NewConsumer(cfg *ConsumerConfig) (Consumer, error) {
@@ -31,14 +74,15 @@ func NewConsumer(cfg *ConsumerConfig) (Consumer, error) {
 		return nil, fmt.Errorf("kafka config invalid, GroupId:%s ListenTopics:%s Addrs:%v\n", cfg.GroupId, cfg.ListenTopics, cfg.Addrs)
 	}
 
-	saramaConfig := sarama.NewConfig()
-	saramaConfig.Consumer.Return.Errors = true
-	saramaConfig.Version = sarama.V1_1_0_0
+	if cfg.FailurePolicy != nil {
+		if err := cfg.FailurePolicy.validate(); err != nil {
+			return nil, err
+		}
+	}
 
-	if cfg.InitialOffset != 0 {
-		saramaConfig.Consumer.Offsets.Initial = cfg.InitialOffset
-	} else {
-		saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+	saramaConfig, err := newConsumerSaramaConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	client, err := sarama.NewClient(cfg.Addrs, saramaConfig)
@@ -50,11 +94,113 @@ func NewConsumer(cfg *ConsumerConfig) (Consumer, error) {
 	consumerGroup, err := sarama.NewConsumerGroupFromClient(cfg.GroupId, client)
 	if err != nil {
 		log.Error(err.Error())
+		_ = client.Close()
+		return nil, err
+	}
+
+	return newKafkaConsumer(cfg, consumerGroup, client), nil
+}
+
+// NewConsumerFromGroup 使用已创建的consumer group，如kafkatest中的内存实现，忽略Addrs和连接配置
+func NewConsumerFromGroup(consumerGroup sarama.ConsumerGroup, cfg *ConsumerConfig) (Consumer, error) {
+	if cfg == nil {
+		return nil, errors.New("kafka consumer config can't be nil")
+	}
+
+	if consumerGroup == nil || cfg.GroupId == "" || len(cfg.ListenTopics) < 1 {
+		return nil, fmt.Errorf("kafka config invalid, GroupId:%s ListenTopics:%s\n", cfg.GroupId, cfg.ListenTopics)
+	}
+
+	if cfg.FailurePolicy != nil {
+		if err := cfg.FailurePolicy.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return newKafkaConsumer(cfg, consumerGroup, nil), nil
+}
+
+func newKafkaConsumer(cfg *ConsumerConfig, consumerGroup sarama.ConsumerGroup, client sarama.Client) *kafkaConsumer {
+	consumer := &kafkaConsumer{
+		GroupId:            cfg.GroupId,
+		ListenTopics:       cfg.ListenTopics,
+		ConsumerGroup:      consumerGroup,
+		Concurrency:        cfg.Concurrency,
+		FailurePolicy:      cfg.FailurePolicy,
+		ShutdownTimeout:    cfg.ShutdownTimeout,
+		BatchSize:          cfg.BatchSize,
+		BatchFlushInterval: cfg.BatchFlushInterval,
+		LagReportInterval:  cfg.LagReportInterval,
+		client:             client,
+	}
+
+	if client != nil {
+		consumer.offsets = &clientOffsetSource{client: client}
+	} else if source, ok := consumerGroup.(OffsetSource); ok {
+		consumer.offsets = source
+	}
+	return consumer
+}
+
+func newConsumerSaramaConfig(cfg *ConsumerConfig) (*sarama.Config, error) {
+	saramaConfig, err := newSaramaConfig(&cfg.ClientConfig)
+	if err != nil {
 		return nil, err
 	}
 
-	return &kafkaConsumer{
-		ListenTopics:  cfg.ListenTopics,
-		ConsumerGroup: consumerGroup,
-	}, nil
+	saramaConfig.Consumer.Return.Errors = true
+
+	if cfg.InitialOffset != 0 {
+		saramaConfig.Consumer.Offsets.Initial = cfg.InitialOffset
+	} else {
+		saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+	}
+
+	switch cfg.RebalanceStrategy {
+	case "", RebalanceStrategyRange:
+		saramaConfig.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRange
+	case RebalanceStrategyRoundRobin:
+		saramaConfig.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRoundRobin
+	case RebalanceStrategySticky:
+		saramaConfig.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky
+	default:
+		return nil, fmt.Errorf("kafka config invalid, unsupported rebalance strategy %s", cfg.RebalanceStrategy)
+	}
+
+	if cfg.SessionTimeout > 0 {
+		saramaConfig.Consumer.Group.Session.Timeout = cfg.SessionTimeout
+	}
+	if cfg.HeartbeatInterval > 0 {
+		saramaConfig.Consumer.Group.Heartbeat.Interval = cfg.HeartbeatInterval
+	}
+	if saramaConfig.Consumer.Group.Heartbeat.Interval*3 > saramaConfig.Consumer.Group.Session.Timeout {
+		return nil, fmt.Errorf("kafka config invalid, heartbeat interval %s should be less than 1/3 of session timeout %s",
+			saramaConfig.Consumer.Group.Heartbeat.Interval, saramaConfig.Consumer.Group.Session.Timeout)
+	}
+
+	if cfg.RebalanceTimeout > 0 {
+		saramaConfig.Consumer.Group.Rebalance.Timeout = cfg.RebalanceTimeout
+	}
+	if cfg.MaxProcessingTime > 0 {
+		saramaConfig.Consumer.MaxProcessingTime = cfg.MaxProcessingTime
+	}
+
+	if cfg.FetchMin > 0 {
+		saramaConfig.Consumer.Fetch.Min = cfg.FetchMin
+	}
+	if cfg.FetchDefault > 0 {
+		saramaConfig.Consumer.Fetch.Default = cfg.FetchDefault
+	}
+	if cfg.FetchMax > 0 {
+		saramaConfig.Consumer.Fetch.Max = cfg.FetchMax
+	}
+	if saramaConfig.Consumer.Fetch.Max > 0 && saramaConfig.Consumer.Fetch.Default > saramaConfig.Consumer.Fetch.Max {
+		return nil, fmt.Errorf("kafka config invalid, fetch default %d greater than fetch max %d",
+			saramaConfig.Consumer.Fetch.Default, saramaConfig.Consumer.Fetch.Max)
+	}
+
+	if err := validateSaramaConfig(saramaConfig, &cfg.ClientConfig); err != nil {
+		return nil, err
+	}
+	return saramaConfig, nil
 }
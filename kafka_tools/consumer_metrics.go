@@ -0,0 +1,184 @@
+package kafka_tools
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/monitor"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	消费组监控，需monitor.Configure开启KafkaEnabled:
+	1. 每次rebalance后记录次数和分配到的分区数
+	2. 每隔LagReportInterval上报分配到的分区的lag，lag = 分区最新offset - 已提交offset，
+	   offset通过OffsetSource查询，NewConsumerFromGroup的consumer group实现了OffsetSource时也会上报
+	3. 处理中的消息数和从消息时间戳到处理完成的端到端延迟在处理消息时上报
+*/
+
+const DefaultLagReportInterval = 30 * time.Second
+
+// OffsetSource 查询分区最新offset和消费组已提交的offset
+type OffsetSource interface {
+	HighWaterMark(topic string, partition int32) (int64, error)
+	// CommittedOffsets 还没有提交过的分区不返回
+	CommittedOffsets(group string, partitions map[string][]int32) (map[string]map[int32]int64, error)
+}
+
+// clientOffsetSource 通过broker查询
+type clientOffsetSource struct {
+	client sarama.Client
+}
+
+func (s *clientOffsetSource) HighWaterMark(topic string, partition int32) (int64, error) {
+	return s.client.GetOffset(topic, partition, sarama.OffsetNewest)
+}
+
+func (s *clientOffsetSource) CommittedOffsets(group string, partitions map[string][]int32) (map[string]map[int32]int64, error) {
+	coordinator, err := s.client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &sarama.OffsetFetchRequest{Version: 1, ConsumerGroup: group}
+	for topic, ps := range partitions {
+		for _, partition := range ps {
+			request.AddPartition(topic, partition)
+		}
+	}
+
+	response, err := coordinator.FetchOffset(request)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]map[int32]int64, len(partitions))
+	for topic, ps := range partitions {
+		for _, partition := range ps {
+			block := response.GetBlock(topic, partition)
+			if block == nil || block.Err != sarama.ErrNoError || block.Offset < 0 {
+				// 还没有提交过offset
+				continue
+			}
+
+			if offsets[topic] == nil {
+				offsets[topic] = map[int32]int64{}
+			}
+			offsets[topic][partition] = block.Offset
+		}
+	}
+	return offsets, nil
+}
+
+// metricsHandler 记录rebalance和分区分配，供lagReporter使用
+type metricsHandler struct {
+	sarama.ConsumerGroupHandler
+	groupId string
+
+	mu       sync.Mutex
+	assigned map[string][]int32
+}
+
+func newMetricsHandler(handler sarama.ConsumerGroupHandler, groupId string) *metricsHandler {
+	return &metricsHandler{
+		ConsumerGroupHandler: handler,
+		groupId:              groupId,
+	}
+}
+
+func (handler *metricsHandler) Setup(sess sarama.ConsumerGroupSession) error {
+	claims := sess.Claims()
+
+	handler.mu.Lock()
+	handler.assigned = claims
+	handler.mu.Unlock()
+
+	monitor.ReportKafkaRebalance(handler.groupId)
+	for topic, partitions := range claims {
+		monitor.ReportKafkaAssignedPartitions(handler.groupId, topic, len(partitions))
+	}
+	log.WithField("group", handler.groupId).Infof("kafka partitions assigned: %v", claims)
+
+	return handler.ConsumerGroupHandler.Setup(sess)
+}
+
+func (handler *metricsHandler) Cleanup(sess sarama.ConsumerGroupSession) error {
+	err := handler.ConsumerGroupHandler.Cleanup(sess)
+
+	handler.mu.Lock()
+	assigned := handler.assigned
+	handler.assigned = nil
+	handler.mu.Unlock()
+
+	// 下次rebalance可能分配到其他分区，清掉旧分区的lag
+	for topic, partitions := range assigned {
+		monitor.ReportKafkaAssignedPartitions(handler.groupId, topic, 0)
+		for _, partition := range partitions {
+			monitor.RemoveKafkaLag(handler.groupId, topic, partition)
+		}
+	}
+	return err
+}
+
+func (handler *metricsHandler) assignment() map[string][]int32 {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	assigned := make(map[string][]int32, len(handler.assigned))
+	for topic, partitions := range handler.assigned {
+		assigned[topic] = append([]int32(nil), partitions...)
+	}
+	return assigned
+}
+
+// reportLag 定期上报lag直到ctx结束
+func (handler *metricsHandler) reportLag(ctx context.Context, source OffsetSource, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := handler.reportLagOnce(source); err != nil {
+				log.WithField("group", handler.groupId).WithError(err).Warn("report kafka consumer lag failed")
+			}
+		}
+	}
+}
+
+func (handler *metricsHandler) reportLagOnce(source OffsetSource) error {
+	assigned := handler.assignment()
+	if len(assigned) == 0 {
+		return nil
+	}
+
+	committed, err := source.CommittedOffsets(handler.groupId, assigned)
+	if err != nil {
+		return err
+	}
+
+	for topic, partitions := range assigned {
+		for _, partition := range partitions {
+			offset, ok := committed[topic][partition]
+			if !ok {
+				continue
+			}
+
+			highWaterMark, err := source.HighWaterMark(topic, partition)
+			if err != nil {
+				return err
+			}
+
+			lag := highWaterMark - offset
+			if lag < 0 {
+				lag = 0
+			}
+			monitor.ReportKafkaLag(handler.groupId, topic, partition, lag)
+		}
+	}
+	return nil
+}
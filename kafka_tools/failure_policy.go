@@ -0,0 +1,282 @@
+package kafka_tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/monitor"
+	"github.com/jiangfans/handy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	消费失败的处理策略，避免一条消息一直失败堵塞整个分区:
+	1. 先原地重试MaxRetries次，间隔从RetryBackoff开始指数增长
+	2. 仍失败时依次发送到RetryTopics，消息头带上重试次数和最早处理时间，消费重试topic时等到该时间再处理
+	   重试topic需要加到ListenTopics中，由同一个ConsumeFunc处理
+	3. 重试topic都失败后发送到DLQTopic，消息头带上错误和重试次数，panic时带上堆栈
+	4. 发送重试topic或DLQ失败时停止消费该分区，消息会重新消费
+
+	没有配置FailurePolicy时，失败的消息不提交，停止消费该分区
+*/
+
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderRetryAttempt      = "x-retry-attempt"
+	HeaderRetryNotBefore    = "x-retry-not-before" // unix毫秒
+	HeaderError             = "x-error"
+	HeaderErrorStack        = "x-error-stack" // 只有panic时有
+	HeaderFailedAt          = "x-failed-at"   // unix毫秒
+)
+
+const (
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultMaxRetryBackoff = 5 * time.Second
+)
+
+type RetryTopic struct {
+	Topic string
+	Delay time.Duration // 发送后至少经过Delay再处理
+}
+
+type FailurePolicy struct {
+	MaxRetries      int           // 原地重试次数
+	RetryBackoff    time.Duration // 原地重试第一次的间隔
+	MaxRetryBackoff time.Duration
+	RetryTopics     []RetryTopic
+	DLQTopic        string
+	Producer        sarama.SyncProducer // 发送重试topic和DLQ，配置了RetryTopics或DLQTopic时必填
+}
+
+func (p *FailurePolicy) validate() error {
+	if (len(p.RetryTopics) > 0 || p.DLQTopic != "") && p.Producer == nil {
+		return errors.New("kafka failure policy producer can't be nil")
+	}
+	return nil
+}
+
+func (p *FailurePolicy) backoff(attempt int) time.Duration {
+	base, max := p.RetryBackoff, p.MaxRetryBackoff
+	if base <= 0 {
+		base = DefaultRetryBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxRetryBackoff
+	}
+
+	backoff := base << uint(attempt)
+	if backoff <= 0 || backoff > max {
+		return max
+	}
+	return backoff
+}
+
+type panicError struct {
+	value interface{}
+	stack string
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("consume kafka msg paniced: %v", e.value)
+}
+
+// messageProcessor 处理单条消息，包括panic恢复、监控和失败策略
+type messageProcessor struct {
+	consumeFunc ContextConsumeFunc
+	policy      *FailurePolicy
+}
+
+// process 返回nil表示消息已处理完成（成功或已转到重试topic、DLQ），可以提交
+func (p *messageProcessor) process(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	if err := waitNotBefore(ctx, msg); err != nil {
+		return err
+	}
+
+	monitor.ReportKafkaInFlight(msg.Topic, 1)
+	defer monitor.ReportKafkaInFlight(msg.Topic, -1)
+
+	err := p.consume(ctx, msg)
+	if err == nil || p.policy == nil {
+		return err
+	}
+
+	for attempt := 0; attempt < p.policy.MaxRetries; attempt++ {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(p.policy.backoff(attempt)):
+		}
+
+		if err = p.consume(ctx, msg); err == nil {
+			return nil
+		}
+	}
+
+	return p.fail(msg, err)
+}
+
+func (p *messageProcessor) consume(ctx context.Context, msg *sarama.ConsumerMessage) (err error) {
+	logFields := msgLogFields(msg)
+
+	defer func() {
+		if re := recover(); re != nil {
+			stack := string(debug.Stack())
+			log.WithFields(logFields).WithField("stack", stack).Errorf("consume kafka msg paniced: %v", re)
+			err = &panicError{value: re, stack: stack}
+			monitor.ReportKafkaConsumeTotal(msg.Topic, "failed")
+			return
+		}
+
+		if err != nil {
+			log.WithFields(logFields).Errorf("consume kafka msg error: " + err.Error())
+			monitor.ReportKafkaConsumeTotal(msg.Topic, "failed")
+		}
+	}()
+
+	startAt := time.Now()
+	if err = p.consumeFunc(ctx, msg); err != nil {
+		return err
+	}
+
+	monitor.ReportKafkaConsumeTimeCost(startAt, msg.Topic)
+	monitor.ReportKafkaConsumeLatency(msg.Timestamp, msg.Topic)
+	monitor.ReportKafkaConsumeTotal(msg.Topic, "success")
+	return nil
+}
+
+func (p *messageProcessor) fail(msg *sarama.ConsumerMessage, consumeErr error) error {
+	attempt := retryAttempt(msg)
+
+	var (
+		topic   string
+		headers []sarama.RecordHeader
+		result  string
+	)
+
+	if attempt < len(p.policy.RetryTopics) {
+		retryTopic := p.policy.RetryTopics[attempt]
+		topic, result = retryTopic.Topic, "retry"
+		headers = []sarama.RecordHeader{
+			{Key: []byte(HeaderRetryNotBefore), Value: []byte(strconv.FormatInt(time.Now().Add(retryTopic.Delay).UnixMilli(), 10))},
+		}
+	} else if p.policy.DLQTopic != "" {
+		topic, result = p.policy.DLQTopic, "dead_letter"
+
+		headers = []sarama.RecordHeader{
+			{Key: []byte(HeaderError), Value: []byte(consumeErr.Error())},
+			{Key: []byte(HeaderFailedAt), Value: []byte(strconv.FormatInt(time.Now().UnixMilli(), 10))},
+		}
+
+		var pe *panicError
+		if errors.As(consumeErr, &pe) {
+			headers = append(headers, sarama.RecordHeader{Key: []byte(HeaderErrorStack), Value: []byte(pe.stack)})
+		}
+	} else {
+		return consumeErr
+	}
+
+	headers = append(headers, sarama.RecordHeader{Key: []byte(HeaderRetryAttempt), Value: []byte(strconv.Itoa(attempt + 1))})
+	headers = append(headers, originHeaders(msg)...)
+	for _, header := range msg.Headers {
+		if header != nil && !isFailureHeader(string(header.Key)) {
+			headers = append(headers, *header)
+		}
+	}
+
+	_, _, err := p.policy.Producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   topic,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	})
+	if err != nil {
+		log.WithFields(msgLogFields(msg)).WithError(err).Errorf("send kafka msg to %s failed", topic)
+		return err
+	}
+
+	monitor.ReportKafkaConsumeTotal(msg.Topic, result)
+	log.WithFields(msgLogFields(msg)).Warnf("kafka msg sent to %s, attempt %d", topic, attempt+1)
+	return nil
+}
+
+// originHeaders 原始消息的位置，重试topic中的消息沿用第一次的
+func originHeaders(msg *sarama.ConsumerMessage) []sarama.RecordHeader {
+	if headerValue(msg, HeaderOriginalTopic) != "" {
+		return []sarama.RecordHeader{
+			{Key: []byte(HeaderOriginalTopic), Value: []byte(headerValue(msg, HeaderOriginalTopic))},
+			{Key: []byte(HeaderOriginalPartition), Value: []byte(headerValue(msg, HeaderOriginalPartition))},
+			{Key: []byte(HeaderOriginalOffset), Value: []byte(headerValue(msg, HeaderOriginalOffset))},
+		}
+	}
+
+	return []sarama.RecordHeader{
+		{Key: []byte(HeaderOriginalTopic), Value: []byte(msg.Topic)},
+		{Key: []byte(HeaderOriginalPartition), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		{Key: []byte(HeaderOriginalOffset), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+	}
+}
+
+func isFailureHeader(key string) bool {
+	switch key {
+	case HeaderOriginalTopic, HeaderOriginalPartition, HeaderOriginalOffset, HeaderRetryAttempt,
+		HeaderRetryNotBefore, HeaderError, HeaderErrorStack, HeaderFailedAt:
+		return true
+	}
+	return false
+}
+
+func headerValue(msg *sarama.ConsumerMessage, key string) string {
+	for _, header := range msg.Headers {
+		if header != nil && string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func retryAttempt(msg *sarama.ConsumerMessage) int {
+	attempt, _ := strconv.Atoi(headerValue(msg, HeaderRetryAttempt))
+	return attempt
+}
+
+// waitNotBefore 重试topic中的消息等到指定时间再处理
+func waitNotBefore(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	wait := notBeforeWait(msg)
+	if wait <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// notBeforeWait 距离消息可以处理还需等待的时间，没有x-retry-not-before时为0
+func notBeforeWait(msg *sarama.ConsumerMessage) time.Duration {
+	notBefore, err := strconv.ParseInt(headerValue(msg, HeaderRetryNotBefore), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Until(time.UnixMilli(notBefore))
+}
+
+func msgLogFields(msg *sarama.ConsumerMessage) log.Fields {
+	return log.Fields{
+		"topic":     msg.Topic,
+		"partition": msg.Partition,
+		"offset":    msg.Offset,
+		"time":      msg.Timestamp.In(utils.CST).Format(time.RFC3339),
+		"key":       msg.Key,
+		"value":     string(msg.Value),
+	}
+}
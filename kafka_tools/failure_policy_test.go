@@ -0,0 +1,102 @@
+package kafka_tools
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func headerMap(msg *sarama.ProducerMessage) map[string]string {
+	headers := make(map[string]string, len(msg.Headers))
+	for _, header := range msg.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	return headers
+}
+
+func TestFailureDLQHeaders(t *testing.T) {
+	cases := []struct {
+		name      string
+		consume   ConsumeFunc
+		wantError string
+		wantStack bool
+	}{
+		{
+			name:      "error",
+			consume:   func(*sarama.ConsumerMessage) error { return errors.New("invalid payload") },
+			wantError: "invalid payload",
+		},
+		{
+			name:      "panic",
+			consume:   func(*sarama.ConsumerMessage) error { panic("nil pointer") },
+			wantError: "consume kafka msg paniced: nil pointer",
+			wantStack: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			producer := mocks.NewSyncProducer(t, nil)
+			defer func() { _ = producer.Close() }()
+
+			var sent *sarama.ProducerMessage
+			producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+				sent = msg
+				return nil
+			})
+
+			processor := &messageProcessor{
+				consumeFunc: c.consume.withContext(),
+				policy:      &FailurePolicy{DLQTopic: "dlq", Producer: producer},
+			}
+			msg := &sarama.ConsumerMessage{Topic: "topic", Partition: 1, Offset: 2, Value: []byte("v")}
+			if err := processor.process(context.Background(), msg); err != nil {
+				t.Fatal(err)
+			}
+
+			if sent == nil || sent.Topic != "dlq" {
+				t.Fatalf("sent = %+v", sent)
+			}
+			headers := headerMap(sent)
+			if headers[HeaderError] != c.wantError || headers[HeaderOriginalTopic] != "topic" || headers[HeaderRetryAttempt] != "1" {
+				t.Fatalf("headers = %v", headers)
+			}
+
+			stack, ok := headers[HeaderErrorStack]
+			if ok != c.wantStack || (c.wantStack && !strings.Contains(stack, "goroutine")) {
+				t.Fatalf("stack = %q", stack)
+			}
+		})
+	}
+}
+
+func TestFailureRetryInPlace(t *testing.T) {
+	attempts := 0
+	processor := &messageProcessor{
+		consumeFunc: ConsumeFunc(func(*sarama.ConsumerMessage) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("temporary")
+			}
+			return nil
+		}).withContext(),
+		policy: &FailurePolicy{MaxRetries: 2, RetryBackoff: 1},
+	}
+
+	if err := processor.process(context.Background(), &sarama.ConsumerMessage{Topic: "topic"}); err != nil || attempts != 3 {
+		t.Fatalf("attempts = %d, err = %v", attempts, err)
+	}
+}
+
+func TestFailureWithoutPolicy(t *testing.T) {
+	consumeErr := errors.New("failed")
+	processor := &messageProcessor{consumeFunc: ConsumeFunc(func(*sarama.ConsumerMessage) error { return consumeErr }).withContext()}
+
+	if err := processor.process(context.Background(), &sarama.ConsumerMessage{Topic: "topic"}); !errors.Is(err, consumeErr) {
+		t.Fatalf("err = %v", err)
+	}
+}
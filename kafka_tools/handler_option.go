@@ -0,0 +1,67 @@
+package kafka_tools
+
+import "time"
+
+type HandlerOpts struct {
+	failurePolicy      *FailurePolicy
+	batchSize          int
+	batchFlushInterval time.Duration
+}
+
+type (
+	funcHandlerOption struct {
+		f func(opts *HandlerOpts)
+	}
+
+	HandlerOption interface {
+		apply(opts *HandlerOpts)
+	}
+)
+
+func (fdo *funcHandlerOption) apply(do *HandlerOpts) {
+	fdo.f(do)
+}
+
+func newHandlerOption(f func(opts *HandlerOpts)) *funcHandlerOption {
+	return &funcHandlerOption{
+		f: f,
+	}
+}
+
+// WithFailurePolicy 消费失败时原地重试、转发到重试topic和DLQ
+func WithFailurePolicy(policy *FailurePolicy) HandlerOption {
+	return newHandlerOption(func(opts *HandlerOpts) {
+		opts.failurePolicy = policy
+	})
+}
+
+// WithBatchSize 批量消费每批最大消息数
+func WithBatchSize(size int) HandlerOption {
+	return newHandlerOption(func(opts *HandlerOpts) {
+		opts.batchSize = size
+	})
+}
+
+// WithBatchFlushInterval 批量消费未攒满时最长等待时间
+func WithBatchFlushInterval(interval time.Duration) HandlerOption {
+	return newHandlerOption(func(opts *HandlerOpts) {
+		opts.batchFlushInterval = interval
+	})
+}
+
+func newHandlerOpts(opts []HandlerOption) *HandlerOpts {
+	handlerOpts := &HandlerOpts{}
+	for _, opt := range opts {
+		opt.apply(handlerOpts)
+	}
+	return handlerOpts
+}
+
+func newMessageProcessor(consumeFunc ContextConsumeFunc, opts []HandlerOption) *messageProcessor {
+	handlerOpts := newHandlerOpts(opts)
+
+	return &messageProcessor{
+		consumeFunc: consumeFunc,
+		policy:      handlerOpts.failurePolicy,
+	}
+}
@@ -0,0 +1,53 @@
+package kafka_tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/idempotent"
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageIdFunc 取消息id用于去重
+type MessageIdFunc func(msg *sarama.ConsumerMessage) (string, error)
+
+// IdFromHeader 消息头中的id，如x-event-id
+func IdFromHeader(key string) MessageIdFunc {
+	return func(msg *sarama.ConsumerMessage) (string, error) {
+		if id := headerValue(msg, key); id != "" {
+			return id, nil
+		}
+		return "", fmt.Errorf("%w: header %s", idempotent.ErrMissingId, key)
+	}
+}
+
+// IdFromJSONField json消息体中的字段，嵌套字段用.分隔
+func IdFromJSONField(path string) MessageIdFunc {
+	return func(msg *sarama.ConsumerMessage) (string, error) {
+		return idempotent.JSONField(msg.Value, path)
+	}
+}
+
+// IdFromPosition 原始消息的topic、分区和offset，重试topic中的消息沿用原始位置
+// 只能去重同一条消息的重复消费，不能去重重复发送
+func IdFromPosition(msg *sarama.ConsumerMessage) (string, error) {
+	headers := originHeaders(msg)
+	return fmt.Sprintf("%s-%s-%s", headers[0].Value, headers[1].Value, headers[2].Value), nil
+}
+
+// Idempotent 按消息id去重，已处理的消息直接跳过，取不到id或其他消费者正在处理时按消费失败处理
+// 返回的函数用于Consumer.RunContext，session结束时去重记录的读写也会取消
+func Idempotent(d *idempotent.Deduplicator, idFunc MessageIdFunc, f ConsumeFunc) ContextConsumeFunc {
+	return func(ctx context.Context, msg *sarama.ConsumerMessage) error {
+		id, err := idFunc(msg)
+		if err != nil {
+			log.WithFields(msgLogFields(msg)).WithError(err).Error("get kafka msg id failed")
+			return err
+		}
+
+		return d.Do(ctx, id, func() error {
+			return f(msg)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package kafka_tools
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/idempotent"
+)
+
+type ctxKey struct{}
+
+// ctxStore 记录Acquire收到的ctx
+type ctxStore struct {
+	*idempotent.MemoryStore
+	ctx context.Context
+}
+
+func (s *ctxStore) Acquire(ctx context.Context, key string, ttl time.Duration) (idempotent.AcquireResult, error) {
+	s.ctx = ctx
+	return s.MemoryStore.Acquire(ctx, key, ttl)
+}
+
+func TestIdempotent(t *testing.T) {
+	store := &ctxStore{MemoryStore: idempotent.NewMemoryStore()}
+	d, err := idempotent.NewDeduplicator(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	f := Idempotent(d, IdFromHeader(HeaderEventId), func(msg *sarama.ConsumerMessage) error {
+		calls++
+		if string(msg.Value) == "panic" {
+			panic("boom")
+		}
+		return nil
+	})
+	processor := newMessageProcessor(f, nil)
+	ctx := context.WithValue(context.Background(), ctxKey{}, "session")
+
+	msg := &sarama.ConsumerMessage{Topic: "orders", Headers: []*sarama.RecordHeader{header(HeaderEventId, "e1")}}
+	for i := 0; i < 2; i++ {
+		if err := processor.process(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("calls = %d", calls)
+	}
+	// 使用session的ctx
+	if store.ctx == nil || store.ctx.Value(ctxKey{}) != "session" {
+		t.Fatal("session ctx not passed to store")
+	}
+
+	// 其他消费者正在处理时按消费失败处理
+	if _, err := store.MemoryStore.Acquire(ctx, "e2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	processing := &sarama.ConsumerMessage{Topic: "orders", Headers: []*sarama.RecordHeader{header(HeaderEventId, "e2")}}
+	if err := processor.process(ctx, processing); !errors.Is(err, idempotent.ErrProcessing) {
+		t.Fatalf("err = %v", err)
+	}
+
+	// panic后释放，重新投递时再处理
+	panicked := &sarama.ConsumerMessage{Topic: "orders", Value: []byte("panic"), Headers: []*sarama.RecordHeader{header(HeaderEventId, "e3")}}
+	for i := 0; i < 2; i++ {
+		var panicErr *panicError
+		if err := processor.process(ctx, panicked); !errors.As(err, &panicErr) {
+			t.Fatalf("err = %v", err)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("calls = %d", calls)
+	}
+
+	if err := processor.process(ctx, &sarama.ConsumerMessage{Topic: "orders"}); !errors.Is(err, idempotent.ErrMissingId) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestIdFromPosition(t *testing.T) {
+	msg := &sarama.ConsumerMessage{Topic: "orders", Partition: 1, Offset: 2}
+	if id, err := IdFromPosition(msg); err != nil || id != "orders-1-2" {
+		t.Fatalf("id = %s, err = %v", id, err)
+	}
+
+	// 重试topic中的消息沿用原始位置
+	retried := &sarama.ConsumerMessage{Topic: "orders.retry", Partition: 0, Offset: 9, Headers: []*sarama.RecordHeader{
+		header(HeaderOriginalTopic, "orders"), header(HeaderOriginalPartition, "1"), header(HeaderOriginalOffset, "2"),
+	}}
+	if id, err := IdFromPosition(retried); err != nil || id != "orders-1-2" {
+		t.Fatalf("id = %s, err = %v", id, err)
+	}
+}
@@ -2,53 +2,144 @@ package kafka_tools
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/Shopify/sarama"
 	log "github.com/sirupsen/logrus"
 )
 
+/*
+	ctx结束后优雅退出:
+	1. 停止拉取消息，等待处理中的消息结束，已处理的消息提交offset
+	2. 超过ShutdownTimeout仍未结束时不再等待，返回ErrShutdownTimeout，未提交的消息下次重新消费；
+	   Consume协程和处理中的消息不会被中断，关闭consumer group后仍在后台运行直到处理函数返回，
+	   调用方应在Run返回后尽快退出进程，不要在同一进程内重新Run
+	3. 关闭consumer group，正常退出时Run返回nil
+*/
+
+const DefaultShutdownTimeout = 30 * time.Second
+
+var ErrShutdownTimeout = errors.New("wait in-flight messages timeout")
+
 type kafkaConsumer struct {
-	ListenTopics  []string
-	ConsumerGroup sarama.ConsumerGroup
+	GroupId         string
+	ListenTopics    []string
+	ConsumerGroup   sarama.ConsumerGroup
+	Concurrency     int
+	FailurePolicy   *FailurePolicy
+	ShutdownTimeout time.Duration
+
+	BatchSize          int
+	BatchFlushInterval time.Duration
+
+	LagReportInterval time.Duration
+
+	client  sarama.Client // NewConsumerGroupFromClient创建的consumer group关闭时不会关闭client
+	offsets OffsetSource  // 为空时不上报lag
+}
+
+func (consumer *kafkaConsumer) Run(ctx context.Context, f ConsumeFunc, concurrency bool) error {
+	return consumer.RunContext(ctx, f.withContext(), concurrency)
+}
+
+func (consumer *kafkaConsumer) RunContext(ctx context.Context, f ContextConsumeFunc, concurrency bool) error {
+	var handler sarama.ConsumerGroupHandler
+
+	if !concurrency {
+		handler = NewOneByOneContextConsumerHandler(f, consumer.handlerOptions()...)
+	} else {
+		handler = NewConcurrentContextConsumerHandler(f, consumer.Concurrency, consumer.handlerOptions()...)
+	}
+
+	return consumer.run(ctx, handler)
+}
+
+func (consumer *kafkaConsumer) RunBatch(ctx context.Context, f BatchConsumeFunc) error {
+	opts := append(consumer.handlerOptions(), WithBatchSize(consumer.BatchSize), WithBatchFlushInterval(consumer.BatchFlushInterval))
+	return consumer.run(ctx, NewBatchConsumerHandler(f, opts...))
+}
+
+func (consumer *kafkaConsumer) handlerOptions() []HandlerOption {
+	var opts []HandlerOption
+	if consumer.FailurePolicy != nil {
+		opts = append(opts, WithFailurePolicy(consumer.FailurePolicy))
+	}
+	return opts
 }
 
-func (consumer *kafkaConsumer) Run(ctx context.Context, f ConsumeFunc, concurrency bool) {
+func (consumer *kafkaConsumer) run(ctx context.Context, handler sarama.ConsumerGroupHandler) (err error) {
 	log.Infof("😂😂😂start receive msg ...")
 
-	var programQuitNormal bool
-	defer func() {
-		if e := recover(); e != nil {
-			if programQuitNormal {
-				log.Info("😊program quit normal")
-			} else {
-				log.Errorf("😭program quit with panic: %v", e)
-			}
+	go func() {
+		for err := range consumer.ConsumerGroup.Errors() {
+			log.WithError(err).Error("kafka consumer group error")
 		}
-
-		_ = consumer.ConsumerGroup.Close()
 	}()
 
+	metrics := newMetricsHandler(handler, consumer.GroupId)
+	if consumer.offsets != nil && consumer.LagReportInterval >= 0 {
+		interval := consumer.LagReportInterval
+		if interval == 0 {
+			interval = DefaultLagReportInterval
+		}
+		go metrics.reportLag(ctx, consumer.offsets, interval)
+	}
+
+	done := make(chan error, 1)
 	go func() {
+		done <- consumer.consume(ctx, metrics)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		log.Info("ctx done, wait in-flight messages ...")
+
+		shutdownTimeout := consumer.ShutdownTimeout
+		if shutdownTimeout <= 0 {
+			shutdownTimeout = DefaultShutdownTimeout
+		}
+
 		select {
-		case <-ctx.Done():
-			programQuitNormal = true
-			panic("👋ctx done, program quit")
+		case err = <-done:
+		case <-time.After(shutdownTimeout):
+			err = ErrShutdownTimeout
+			go func() {
+				<-done
+				log.Warn("kafka in-flight messages finished after shutdown timeout")
+			}()
 		}
-	}()
+	}
 
-	var handler sarama.ConsumerGroupHandler
+	if closeErr := consumer.ConsumerGroup.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if consumer.client != nil {
+		if closeErr := consumer.client.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
 
-	if !concurrency {
-		handler = NewOneByOneConsumerHandler(f)
-	} else {
-		// todo 实现并发处理消息
-		panic("🈚️concurrency consume not implement!")
+	if err != nil {
+		return fmt.Errorf("kafka consumer quit: %w", err)
 	}
 
+	log.Info("😊program quit normal")
+	return nil
+}
+
+// consume rebalance后Consume会返回，需要循环调用直到ctx结束
+func (consumer *kafkaConsumer) consume(ctx context.Context, handler sarama.ConsumerGroupHandler) error {
 	for {
 		err := consumer.ConsumerGroup.Consume(ctx, consumer.ListenTopics, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+
 		if err != nil {
-			log.Error("😭program quit with error: ", err.Error())
-			return
+			return err
 		}
 	}
 }
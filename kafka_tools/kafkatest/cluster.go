@@ -0,0 +1,323 @@
+package kafkatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/kafka_tools"
+)
+
+/*
+	内存中的kafka，用于测试不需要真实broker:
+	1. Publish或SyncProducer/AsyncProducer/Producer发送的消息按key哈希写入分区，没有创建过的topic自动创建为1个分区
+	2. ConsumerGroup实现sarama.ConsumerGroup，可直接运行OneByOneConsumerHandler等handler，或通过Consumer运行kafka_tools.Consumer
+	3. MarkOffset直接视为已提交，没有提交过offset的分区从最早的消息开始消费
+	4. Messages、CommittedOffset用于断言消费结果和FailurePolicy转发到重试topic、DLQ的消息
+	5. EnableMetrics配置monitor后，Metrics用于断言消费、发送的监控
+*/
+
+type Cluster struct {
+	mu            sync.Mutex
+	topics        map[string][][]*sarama.ConsumerMessage
+	offsets       map[string]map[string]map[int32]int64 // group -> topic -> partition -> 下一条要消费的offset
+	produceErrors map[string]error
+	updated       chan struct{} // 有新消息或offset变化时关闭并替换
+}
+
+func NewCluster() *Cluster {
+	return &Cluster{
+		topics:        map[string][][]*sarama.ConsumerMessage{},
+		offsets:       map[string]map[string]map[int32]int64{},
+		produceErrors: map[string]error{},
+		updated:       make(chan struct{}),
+	}
+}
+
+// CreateTopic 创建有多个分区的topic，已存在时不变
+func (c *Cluster) CreateTopic(topic string, partitions int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.topics[topic]; !ok {
+		c.topics[topic] = make([][]*sarama.ConsumerMessage, partitions)
+	}
+}
+
+// SetProduceError 发送到topic时返回err，err为nil时恢复
+func (c *Cluster) SetProduceError(topic string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		delete(c.produceErrors, topic)
+		return
+	}
+	c.produceErrors[topic] = err
+}
+
+func (c *Cluster) Publish(topic, key string, value []byte) (partition int32, offset int64, err error) {
+	msg := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(value)}
+	if key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	return c.PublishMessage(msg)
+}
+
+func (c *Cluster) PublishMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error) {
+	key, err := encode(msg.Key)
+	if err != nil {
+		return 0, 0, err
+	}
+	value, err := encode(msg.Value)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.produceErrors[msg.Topic]; err != nil {
+		return 0, 0, err
+	}
+
+	partitions := c.topicLocked(msg.Topic)
+	partition, err = sarama.NewHashPartitioner(msg.Topic).Partition(msg, int32(len(partitions)))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	timestamp := msg.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	headers := make([]*sarama.RecordHeader, 0, len(msg.Headers))
+	for i := range msg.Headers {
+		header := msg.Headers[i]
+		headers = append(headers, &header)
+	}
+
+	offset = int64(len(partitions[partition]))
+	partitions[partition] = append(partitions[partition], &sarama.ConsumerMessage{
+		Topic:     msg.Topic,
+		Partition: partition,
+		Offset:    offset,
+		Key:       key,
+		Value:     value,
+		Headers:   headers,
+		Timestamp: timestamp,
+	})
+
+	msg.Partition, msg.Offset = partition, offset
+	c.notifyLocked()
+	return partition, offset, nil
+}
+
+// Messages topic中的所有消息，按分区和offset排序
+func (c *Cluster) Messages(topic string) []*sarama.ConsumerMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var msgs []*sarama.ConsumerMessage
+	for _, partition := range c.topics[topic] {
+		msgs = append(msgs, partition...)
+	}
+	return msgs
+}
+
+// HighWaterMark 分区下一条消息的offset
+func (c *Cluster) HighWaterMark(topic string, partition int32) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	partitions := c.topics[topic]
+	if int(partition) >= len(partitions) {
+		return 0
+	}
+	return int64(len(partitions[partition]))
+}
+
+// CommittedOffset 消费组在分区上已提交的offset，即下一条要消费的消息，没有提交过时返回-1
+func (c *Cluster) CommittedOffset(group, topic string, partition int32) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if offset, ok := c.offsets[group][topic][partition]; ok {
+		return offset
+	}
+	return -1
+}
+
+// WaitCaughtUp 等待消费组提交完topics中的所有消息
+func (c *Cluster) WaitCaughtUp(ctx context.Context, group string, topics ...string) error {
+	for {
+		caughtUp, updated := c.caughtUp(group, topics)
+		if caughtUp {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait group %s caught up: %w", group, ctx.Err())
+		case <-updated:
+		}
+	}
+}
+
+func (c *Cluster) caughtUp(group string, topics []string) (bool, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, topic := range topics {
+		for partition, msgs := range c.topics[topic] {
+			if len(msgs) > 0 && c.offsets[group][topic][int32(partition)] < int64(len(msgs)) {
+				return false, c.updated
+			}
+		}
+	}
+	return true, c.updated
+}
+
+// SyncProducer 写入cluster的sarama.SyncProducer，可用于FailurePolicy.Producer
+func (c *Cluster) SyncProducer() sarama.SyncProducer {
+	return &syncProducer{cluster: c}
+}
+
+// AsyncProducer 写入cluster的sarama.AsyncProducer，成功和失败都会返回
+func (c *Cluster) AsyncProducer() sarama.AsyncProducer {
+	return newAsyncProducer(c)
+}
+
+// Producer 写入cluster的kafka_tools.Producer，cfg只用到回调，可以为nil
+func (c *Cluster) Producer(cfg *kafka_tools.ProducerConfig) kafka_tools.Producer {
+	return kafka_tools.NewProducerFromSarama(c.SyncProducer(), c.AsyncProducer(), cfg)
+}
+
+// ConsumerGroup groupId的内存consumer group
+func (c *Cluster) ConsumerGroup(groupId string) *ConsumerGroup {
+	return newConsumerGroup(c, groupId)
+}
+
+// Consumer 使用内存consumer group的kafka_tools.Consumer，cfg中的连接配置不生效，lag按内存中的offset上报
+func (c *Cluster) Consumer(cfg *kafka_tools.ConsumerConfig) (kafka_tools.Consumer, error) {
+	if cfg == nil {
+		return nil, errors.New("kafka consumer config can't be nil")
+	}
+	return kafka_tools.NewConsumerFromGroup(c.ConsumerGroup(cfg.GroupId), cfg)
+}
+
+// Drain 用handler消费topics中的消息，全部提交或有分区停止消费后返回
+func (c *Cluster) Drain(ctx context.Context, group string, handler sarama.ConsumerGroupHandler, topics ...string) error {
+	consumerGroup := c.ConsumerGroup(group)
+	defer consumerGroup.Close()
+
+	drainCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- consumerGroup.Consume(drainCtx, topics, handler)
+	}()
+
+	caughtUp := make(chan error, 1)
+	go func() {
+		caughtUp <- c.WaitCaughtUp(drainCtx, group, topics...)
+	}()
+
+	select {
+	case err := <-done:
+		// 有分区的ConsumeClaim返回，session结束
+		return err
+	case err := <-caughtUp:
+		cancel()
+		if consumeErr := <-done; consumeErr != nil {
+			return consumeErr
+		}
+		return err
+	}
+}
+
+func (c *Cluster) topicLocked(topic string) [][]*sarama.ConsumerMessage {
+	partitions, ok := c.topics[topic]
+	if !ok {
+		partitions = make([][]*sarama.ConsumerMessage, 1)
+		c.topics[topic] = partitions
+	}
+	return partitions
+}
+
+// claims topics的所有分区
+func (c *Cluster) claims(topics []string) map[string][]int32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	claims := make(map[string][]int32, len(topics))
+	for _, topic := range topics {
+		partitions := c.topicLocked(topic)
+		for partition := range partitions {
+			claims[topic] = append(claims[topic], int32(partition))
+		}
+	}
+	return claims
+}
+
+// fetch 从offset开始的消息，以及下次有更新时关闭的channel
+func (c *Cluster) fetch(topic string, partition int32, offset int64) ([]*sarama.ConsumerMessage, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msgs := c.topics[topic][partition]
+	if offset >= int64(len(msgs)) {
+		return nil, c.updated
+	}
+	return msgs[offset:], c.updated
+}
+
+func (c *Cluster) commit(group, topic string, partition int32, offset int64, force bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.offsets[group] == nil {
+		c.offsets[group] = map[string]map[int32]int64{}
+	}
+	if c.offsets[group][topic] == nil {
+		c.offsets[group][topic] = map[int32]int64{}
+	}
+
+	if current, ok := c.offsets[group][topic][partition]; ok && !force && offset <= current {
+		return
+	}
+	c.offsets[group][topic][partition] = offset
+	c.notifyLocked()
+}
+
+func (c *Cluster) committed(group, topic string, partition int32) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offset, ok := c.offsets[group][topic][partition]
+	return offset, ok
+}
+
+func (c *Cluster) notifyLocked() {
+	close(c.updated)
+	c.updated = make(chan struct{})
+}
+
+func (c *Cluster) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.notifyLocked()
+}
+
+func encode(encoder sarama.Encoder) ([]byte, error) {
+	if encoder == nil {
+		return nil, nil
+	}
+	return encoder.Encode()
+}
@@ -0,0 +1,86 @@
+package kafkatest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/kafka_tools"
+)
+
+func TestOneByOneConsumerHandler(t *testing.T) {
+	metrics, err := EnableMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := NewCluster()
+	cluster.CreateTopic("orders", 2)
+	for _, value := range []string{"a", "bad", "b", "c"} {
+		if _, _, err := cluster.Publish("orders", value, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	successBefore := metrics.ConsumeTotal(t, "orders", "success")
+	deadLetterBefore := metrics.ConsumeTotal(t, "orders", "dead_letter")
+
+	var consumed []string
+	handler := kafka_tools.NewOneByOneConsumerHandler(func(msg *sarama.ConsumerMessage) error {
+		if string(msg.Value) == "bad" {
+			return errors.New("invalid order")
+		}
+		consumed = append(consumed, string(msg.Value))
+		return nil
+	}, kafka_tools.WithFailurePolicy(&kafka_tools.FailurePolicy{
+		MaxRetries:   1,
+		RetryBackoff: time.Millisecond,
+		DLQTopic:     "orders.dlq",
+		Producer:     cluster.SyncProducer(),
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cluster.Drain(ctx, "group", handler, "orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(consumed) != 3 {
+		t.Fatalf("consumed = %v", consumed)
+	}
+	for partition := int32(0); partition < 2; partition++ {
+		if committed, hwm := cluster.CommittedOffset("group", "orders", partition), cluster.HighWaterMark("orders", partition); committed != hwm {
+			t.Fatalf("partition %d committed = %d, high water mark = %d", partition, committed, hwm)
+		}
+	}
+
+	dlq := cluster.Messages("orders.dlq")
+	if len(dlq) != 1 || string(dlq[0].Value) != "bad" {
+		t.Fatalf("dlq = %v", dlq)
+	}
+	headers := map[string]string{}
+	for _, header := range dlq[0].Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	if headers[kafka_tools.HeaderError] != "invalid order" || headers[kafka_tools.HeaderOriginalTopic] != "orders" {
+		t.Fatalf("headers = %v", headers)
+	}
+
+	if got := metrics.ConsumeTotal(t, "orders", "success") - successBefore; got != 3 {
+		t.Fatalf("success = %v", got)
+	}
+	if got := metrics.ConsumeTotal(t, "orders", "dead_letter") - deadLetterBefore; got != 1 {
+		t.Fatalf("dead_letter = %v", got)
+	}
+	if got := metrics.InFlight(t, "orders"); got != 0 {
+		t.Fatalf("in flight = %v", got)
+	}
+}
+
+func TestConsumerNilConfig(t *testing.T) {
+	if _, err := NewCluster().Consumer(nil); err == nil {
+		t.Fatal("nil config")
+	}
+}
@@ -0,0 +1,290 @@
+package kafkatest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// ConsumerGroup 内存中的sarama.ConsumerGroup，一个成员分配到所有分区
+// 与sarama一致，任一分区的ConsumeClaim返回后session结束，Consume返回
+type ConsumerGroup struct {
+	cluster *Cluster
+	groupId string
+
+	mu         sync.Mutex
+	generation int32
+	paused     map[string]map[int32]bool
+	closed     chan struct{}
+	closeOnce  sync.Once
+	errors     chan error
+}
+
+func newConsumerGroup(cluster *Cluster, groupId string) *ConsumerGroup {
+	return &ConsumerGroup{
+		cluster: cluster,
+		groupId: groupId,
+		paused:  map[string]map[int32]bool{},
+		closed:  make(chan struct{}),
+		errors:  make(chan error),
+	}
+}
+
+func (g *ConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	select {
+	case <-g.closed:
+		return sarama.ErrClosedConsumerGroup
+	default:
+	}
+
+	g.mu.Lock()
+	g.generation++
+	generation := g.generation
+	g.mu.Unlock()
+
+	sessCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-g.closed:
+			cancel()
+		case <-sessCtx.Done():
+		}
+	}()
+
+	sess := &session{
+		ctx:        sessCtx,
+		group:      g,
+		claims:     g.cluster.claims(topics),
+		generation: generation,
+	}
+
+	if err := handler.Setup(sess); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for topic, partitions := range sess.claims {
+		for _, partition := range partitions {
+			claim := g.newClaim(topic, partition)
+
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				claim.feed(sessCtx)
+			}()
+			go func() {
+				defer wg.Done()
+				// 第一个分区退出后结束session
+				defer cancel()
+				_ = handler.ConsumeClaim(sess, claim)
+			}()
+		}
+	}
+	wg.Wait()
+
+	return handler.Cleanup(sess)
+}
+
+// HighWaterMark 实现kafka_tools.OffsetSource，用于上报lag
+func (g *ConsumerGroup) HighWaterMark(topic string, partition int32) (int64, error) {
+	return g.cluster.HighWaterMark(topic, partition), nil
+}
+
+// CommittedOffsets 实现kafka_tools.OffsetSource
+func (g *ConsumerGroup) CommittedOffsets(group string, partitions map[string][]int32) (map[string]map[int32]int64, error) {
+	offsets := make(map[string]map[int32]int64, len(partitions))
+	for topic, ps := range partitions {
+		for _, partition := range ps {
+			if offset, ok := g.cluster.committed(group, topic, partition); ok {
+				if offsets[topic] == nil {
+					offsets[topic] = map[int32]int64{}
+				}
+				offsets[topic][partition] = offset
+			}
+		}
+	}
+	return offsets, nil
+}
+
+func (g *ConsumerGroup) Errors() <-chan error {
+	return g.errors
+}
+
+func (g *ConsumerGroup) Close() error {
+	g.closeOnce.Do(func() {
+		close(g.closed)
+		close(g.errors)
+	})
+	return nil
+}
+
+func (g *ConsumerGroup) Pause(partitions map[string][]int32) {
+	g.setPaused(partitions, true)
+}
+
+func (g *ConsumerGroup) Resume(partitions map[string][]int32) {
+	g.setPaused(partitions, false)
+}
+
+func (g *ConsumerGroup) PauseAll() {
+	g.setPaused(g.cluster.claims(g.topics()), true)
+}
+
+func (g *ConsumerGroup) ResumeAll() {
+	g.mu.Lock()
+	g.paused = map[string]map[int32]bool{}
+	g.mu.Unlock()
+
+	g.cluster.notify()
+}
+
+func (g *ConsumerGroup) setPaused(partitions map[string][]int32, paused bool) {
+	g.mu.Lock()
+	for topic, ps := range partitions {
+		if g.paused[topic] == nil {
+			g.paused[topic] = map[int32]bool{}
+		}
+		for _, partition := range ps {
+			g.paused[topic][partition] = paused
+		}
+	}
+	g.mu.Unlock()
+
+	g.cluster.notify()
+}
+
+func (g *ConsumerGroup) isPaused(topic string, partition int32) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.paused[topic][partition]
+}
+
+func (g *ConsumerGroup) topics() []string {
+	g.cluster.mu.Lock()
+	defer g.cluster.mu.Unlock()
+
+	topics := make([]string, 0, len(g.cluster.topics))
+	for topic := range g.cluster.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (g *ConsumerGroup) newClaim(topic string, partition int32) *claim {
+	offset, ok := g.cluster.committed(g.groupId, topic, partition)
+	if !ok {
+		offset = sarama.OffsetOldest
+	}
+
+	return &claim{
+		group:         g,
+		topic:         topic,
+		partition:     partition,
+		initialOffset: offset,
+		messages:      make(chan *sarama.ConsumerMessage),
+	}
+}
+
+type session struct {
+	ctx        context.Context
+	group      *ConsumerGroup
+	claims     map[string][]int32
+	generation int32
+}
+
+func (s *session) Claims() map[string][]int32 {
+	return s.claims
+}
+
+func (s *session) MemberID() string {
+	return "kafkatest-" + s.group.groupId
+}
+
+func (s *session) GenerationID() int32 {
+	return s.generation
+}
+
+func (s *session) MarkOffset(topic string, partition int32, offset int64, _ string) {
+	s.group.cluster.commit(s.group.groupId, topic, partition, offset, false)
+}
+
+func (s *session) Commit() {}
+
+func (s *session) ResetOffset(topic string, partition int32, offset int64, _ string) {
+	s.group.cluster.commit(s.group.groupId, topic, partition, offset, true)
+}
+
+func (s *session) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *session) Context() context.Context {
+	return s.ctx
+}
+
+type claim struct {
+	group         *ConsumerGroup
+	topic         string
+	partition     int32
+	initialOffset int64
+	messages      chan *sarama.ConsumerMessage
+}
+
+func (c *claim) Topic() string {
+	return c.topic
+}
+
+func (c *claim) Partition() int32 {
+	return c.partition
+}
+
+func (c *claim) InitialOffset() int64 {
+	return c.initialOffset
+}
+
+func (c *claim) HighWaterMarkOffset() int64 {
+	return c.group.cluster.HighWaterMark(c.topic, c.partition)
+}
+
+func (c *claim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+// feed 把分区的消息依次发给ConsumeClaim，session结束后关闭Messages
+func (c *claim) feed(ctx context.Context) {
+	defer close(c.messages)
+
+	offset := c.initialOffset
+	if offset < 0 {
+		offset = 0
+	}
+
+	for {
+		msgs, updated := c.group.cluster.fetch(c.topic, c.partition, offset)
+		if c.group.isPaused(c.topic, c.partition) {
+			msgs = nil
+		}
+
+		for _, msg := range msgs {
+			select {
+			case c.messages <- msg:
+				offset++
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if len(msgs) > 0 {
+			continue
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package kafkatest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/kafka_tools"
+)
+
+// runUntilHandled 第一条消息开始处理后结束ctx，返回Run的结果
+func runUntilHandled(t *testing.T, consumer kafka_tools.Consumer, f kafka_tools.ConsumeFunc) error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handling := make(chan struct{}, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- consumer.Run(ctx, func(msg *sarama.ConsumerMessage) error {
+			select {
+			case handling <- struct{}{}:
+			default:
+			}
+			return f(msg)
+		}, false)
+	}()
+
+	select {
+	case <-handling:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not consumed")
+	}
+	cancel()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("run not return")
+		return nil
+	}
+}
+
+func TestConsumerShutdown(t *testing.T) {
+	cluster := NewCluster()
+	cluster.CreateTopic("orders", 1)
+	if _, _, err := cluster.Publish("orders", "k", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := cluster.Consumer(&kafka_tools.ConsumerConfig{
+		GroupId:           "group",
+		ListenTopics:      []string{"orders"},
+		ShutdownTimeout:   5 * time.Second,
+		LagReportInterval: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ctx结束后等待处理中的消息完成并提交
+	err = runUntilHandled(t, consumer, func(msg *sarama.ConsumerMessage) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed := cluster.CommittedOffset("group", "orders", 0); committed != 1 {
+		t.Fatalf("committed = %d", committed)
+	}
+}
+
+func TestConsumerShutdownTimeout(t *testing.T) {
+	cluster := NewCluster()
+	cluster.CreateTopic("orders", 1)
+	if _, _, err := cluster.Publish("orders", "k", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := cluster.Consumer(&kafka_tools.ConsumerConfig{
+		GroupId:           "group",
+		ListenTopics:      []string{"orders"},
+		ShutdownTimeout:   50 * time.Millisecond,
+		LagReportInterval: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	startAt := time.Now()
+	err = runUntilHandled(t, consumer, func(msg *sarama.ConsumerMessage) error {
+		defer close(finished)
+		<-release
+		return nil
+	})
+	if !errors.Is(err, kafka_tools.ErrShutdownTimeout) {
+		t.Fatalf("err = %v", err)
+	}
+	if cost := time.Since(startAt); cost > time.Second {
+		t.Fatalf("run returned after %v", cost)
+	}
+
+	// 超时后处理中的消息在后台继续运行，不会被中断
+	close(release)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight message not finished")
+	}
+}
@@ -0,0 +1,116 @@
+package kafkatest
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jiangfans/handy/monitor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsNamespace EnableMetrics配置monitor使用的namespace
+const MetricsNamespace = "kafkatest"
+
+var (
+	metricsOnce sync.Once
+	metrics     *Metrics
+	metricsErr  error
+)
+
+// Metrics 从prometheus默认registry读取kafka_tools上报的监控
+// 指标在进程内累计，多个测试共用，断言时应比较前后的差值
+type Metrics struct {
+	gatherer prometheus.Gatherer
+}
+
+// EnableMetrics 以MetricsNamespace开启kafka监控，进程内只配置一次，测试中不要再调用monitor.Configure
+func EnableMetrics() (*Metrics, error) {
+	metricsOnce.Do(func() {
+		if monitor.KafkaProm != nil {
+			metricsErr = errors.New("kafka monitor already configured")
+			return
+		}
+
+		if metricsErr = monitor.Configure(&monitor.Config{Namespace: MetricsNamespace, KafkaEnabled: true}); metricsErr == nil {
+			metrics = &Metrics{gatherer: prometheus.DefaultGatherer}
+		}
+	})
+	return metrics, metricsErr
+}
+
+// ConsumeTotal 消费结果计数，result为success、failed、retry、dead_letter等
+func (m *Metrics) ConsumeTotal(t testing.TB, topic, result string) float64 {
+	t.Helper()
+	return m.Value(t, "built_in_kafka_consume_total", map[string]string{"topic": topic, "result": result})
+}
+
+// ProduceTotal 发送结果计数，result为success、failed
+func (m *Metrics) ProduceTotal(t testing.TB, topic, result string) float64 {
+	t.Helper()
+	return m.Value(t, "built_in_kafka_produce_total", map[string]string{"topic": topic, "result": result})
+}
+
+// InFlight 处理中的消息数
+func (m *Metrics) InFlight(t testing.TB, topic string) float64 {
+	t.Helper()
+	return m.Value(t, "built_in_kafka_in_flight", map[string]string{"topic": topic})
+}
+
+// Lag 消费组在分区上的lag，分区被回收后没有数据，为0
+func (m *Metrics) Lag(t testing.TB, group, topic string, partition int32) float64 {
+	t.Helper()
+	return m.Value(t, "built_in_kafka_consumer_lag", map[string]string{"group": group, "topic": topic, "partition": strconv.Itoa(int(partition))})
+}
+
+// RebalanceTotal 消费组rebalance次数
+func (m *Metrics) RebalanceTotal(t testing.TB, group string) float64 {
+	t.Helper()
+	return m.Value(t, "built_in_kafka_rebalance_total", map[string]string{"group": group})
+}
+
+// AssignedPartitions 消费组在topic上分配到的分区数
+func (m *Metrics) AssignedPartitions(t testing.TB, group, topic string) float64 {
+	t.Helper()
+	return m.Value(t, "built_in_kafka_assigned_partitions", map[string]string{"group": group, "topic": topic})
+}
+
+// Value 指标name（不含namespace）中标签匹配labels的序列之和，histogram取样本数，没有数据时为0
+func (m *Metrics) Value(t testing.TB, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := m.gatherer.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics: %v", err)
+	}
+
+	var value float64
+	for _, family := range families {
+		if family.GetName() != MetricsNamespace+"_"+name {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if v, ok := labels[label.GetName()]; ok && v == label.GetValue() {
+					matched++
+				}
+			}
+			if matched != len(labels) {
+				continue
+			}
+
+			switch {
+			case metric.GetCounter() != nil:
+				value += metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				value += metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				value += float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return value
+}
@@ -0,0 +1,116 @@
+package kafkatest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/kafka_tools"
+)
+
+func TestConsumerLagMetrics(t *testing.T) {
+	metrics, err := EnableMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const produced, consumed = 5, 3
+	cluster := NewCluster()
+	cluster.CreateTopic("lag", 1)
+	for i := 0; i < produced; i++ {
+		if _, _, err := cluster.Publish("lag", "", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	consumer, err := cluster.Consumer(&kafka_tools.ConsumerConfig{
+		GroupId:           "lag-group",
+		ListenTopics:      []string{"lag"},
+		LagReportInterval: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		// 只消费前consumed条，之后的消息等到session结束
+		done <- consumer.RunContext(ctx, func(ctx context.Context, msg *sarama.ConsumerMessage) error {
+			if msg.Offset < consumed {
+				return nil
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		}, false)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.Lag(t, "lag-group", "lag", 0) != produced-consumed {
+		if time.Now().After(deadline) {
+			t.Fatalf("lag = %v", metrics.Lag(t, "lag-group", "lag", 0))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if committed := cluster.CommittedOffset("lag-group", "lag", 0); committed != consumed {
+		t.Fatalf("committed = %d", committed)
+	}
+	// 分区回收后删除lag
+	if lag := metrics.Lag(t, "lag-group", "lag", 0); lag != 0 {
+		t.Fatalf("lag after cleanup = %v", lag)
+	}
+}
+
+func TestConsumerRebalanceMetrics(t *testing.T) {
+	metrics, err := EnableMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := NewCluster()
+	cluster.CreateTopic("rebalance", 2)
+
+	before := metrics.RebalanceTotal(t, "rebalance-group")
+	for i := 0; i < 2; i++ {
+		if _, _, err := cluster.Publish("rebalance", "", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Run返回时关闭consumer group，每次重新创建，相当于成员重新加入，Setup时记录rebalance和分配到的分区
+		consumer, err := cluster.Consumer(&kafka_tools.ConsumerConfig{
+			GroupId:           "rebalance-group",
+			ListenTopics:      []string{"rebalance"},
+			LagReportInterval: -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var assigned float64
+		err = runUntilHandled(t, consumer, func(msg *sarama.ConsumerMessage) error {
+			assigned = metrics.AssignedPartitions(t, "rebalance-group", "rebalance")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assigned != 2 {
+			t.Fatalf("assigned partitions = %v", assigned)
+		}
+		// Cleanup后清零
+		if got := metrics.AssignedPartitions(t, "rebalance-group", "rebalance"); got != 0 {
+			t.Fatalf("assigned partitions after cleanup = %v", got)
+		}
+	}
+
+	if got := metrics.RebalanceTotal(t, "rebalance-group") - before; got != 2 {
+		t.Fatalf("rebalance = %v", got)
+	}
+}
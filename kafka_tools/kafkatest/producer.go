@@ -0,0 +1,125 @@
+package kafkatest
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// syncProducer 不支持事务
+type syncProducer struct {
+	cluster *Cluster
+}
+
+func (p *syncProducer) SendMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error) {
+	return p.cluster.PublishMessage(msg)
+}
+
+func (p *syncProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	var errs sarama.ProducerErrors
+	for _, msg := range msgs {
+		if _, _, err := p.cluster.PublishMessage(msg); err != nil {
+			errs = append(errs, &sarama.ProducerError{Msg: msg, Err: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *syncProducer) Close() error {
+	return nil
+}
+
+func (p *syncProducer) TxnStatus() sarama.ProducerTxnStatusFlag {
+	return sarama.ProducerTxnFlagReady
+}
+
+func (p *syncProducer) IsTransactional() bool {
+	return false
+}
+
+func (p *syncProducer) BeginTxn() error {
+	return sarama.ErrNonTransactedProducer
+}
+
+func (p *syncProducer) CommitTxn() error {
+	return sarama.ErrNonTransactedProducer
+}
+
+func (p *syncProducer) AbortTxn() error {
+	return sarama.ErrNonTransactedProducer
+}
+
+func (p *syncProducer) AddOffsetsToTxn(_ map[string][]*sarama.PartitionOffsetMetadata, _ string) error {
+	return sarama.ErrNonTransactedProducer
+}
+
+func (p *syncProducer) AddMessageToTxn(_ *sarama.ConsumerMessage, _ string, _ *string) error {
+	return sarama.ErrNonTransactedProducer
+}
+
+// asyncProducer 不支持事务，Successes和Errors都需要读取
+type asyncProducer struct {
+	syncProducer
+
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newAsyncProducer(cluster *Cluster) *asyncProducer {
+	p := &asyncProducer{
+		syncProducer: syncProducer{cluster: cluster},
+		input:        make(chan *sarama.ProducerMessage),
+		successes:    make(chan *sarama.ProducerMessage),
+		errors:       make(chan *sarama.ProducerError),
+		done:         make(chan struct{}),
+	}
+
+	go p.run()
+	return p
+}
+
+func (p *asyncProducer) run() {
+	defer close(p.done)
+	defer close(p.errors)
+	defer close(p.successes)
+
+	for msg := range p.input {
+		if _, _, err := p.cluster.PublishMessage(msg); err != nil {
+			p.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+			continue
+		}
+		p.successes <- msg
+	}
+}
+
+func (p *asyncProducer) AsyncClose() {
+	p.closeOnce.Do(func() {
+		close(p.input)
+	})
+}
+
+// Close 需要有人读取Successes和Errors，否则会一直阻塞
+func (p *asyncProducer) Close() error {
+	p.AsyncClose()
+	<-p.done
+	return nil
+}
+
+func (p *asyncProducer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+func (p *asyncProducer) Successes() <-chan *sarama.ProducerMessage {
+	return p.successes
+}
+
+func (p *asyncProducer) Errors() <-chan *sarama.ProducerError {
+	return p.errors
+}
@@ -0,0 +1,318 @@
+package kafka_tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/monitor"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	producer, err := kafka_tools.NewProducer(&kafka_tools.ProducerConfig{Addrs: addrs, Idempotent: true})
+	defer producer.Close()
+
+	1. Send同步发送，返回写入的分区和offset
+	2. SendAsync异步发送，结果通过OnSuccess/OnError回调，Close时等待发送中的消息结束；
+	   ctx结束或producer已关闭时直接返回错误，不回调，broker不可用导致写入阻塞时Close会让其返回ErrProducerClosed
+	3. 相同key的消息发送到同一分区
+	4. Idempotent开启幂等发送，acks=all，broker重试时不会重复写入
+*/
+
+const DefaultProducerMaxRetries = 3
+
+var ErrProducerClosed = errors.New("kafka producer closed")
+
+type ProducerConfig struct {
+	ClientConfig
+
+	Addrs        []string
+	Idempotent   bool
+	RequiredAcks sarama.RequiredAcks // 默认WaitForLocal，Idempotent时固定为WaitForAll
+	MaxRetries   int
+
+	// 批量发送，满足任一条件即发送一批，都为0时立即发送
+	FlushMessages  int
+	FlushBytes     int
+	FlushFrequency time.Duration // linger
+	Compression    sarama.CompressionCodec
+
+	OnSuccess func(msg *Message)            // 异步发送成功回调
+	OnError   func(msg *Message, err error) // 异步发送失败回调，为空时打印日志
+}
+
+type Message struct {
+	Topic   string
+	Key     string // 相同key发送到同一分区
+	Value   []byte
+	Headers map[string]string
+}
+
+type Producer interface {
+	Send(ctx context.Context, msg *Message) (partition int32, offset int64, err error)
+	SendAsync(ctx context.Context, msg *Message) error
+	SendBytes(ctx context.Context, topic, key string, value []byte) error
+	SendJSON(ctx context.Context, topic, key string, v interface{}) error
+	SendJSONAsync(ctx context.Context, topic, key string, v interface{}) error
+	Close() error
+}
+
+type kafkaProducer struct {
+	client        sarama.Client
+	syncProducer  sarama.SyncProducer
+	asyncProducer sarama.AsyncProducer
+	cfg           ProducerConfig
+
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	mu        sync.RWMutex // 发送时持有读锁，保证Close后不再写入已关闭的producer
+	closed    bool
+	closing   chan struct{} // Close时关闭，让阻塞在写入的SendAsync返回并释放读锁
+}
+
+// 异步发送时通过Metadata带上原始消息和发送时间
+type produceMetadata struct {
+	msg     *Message
+	startAt time.Time
+}
+
+func NewProducer(cfg *ProducerConfig) (Producer, error) {
+	if cfg == nil || len(cfg.Addrs) < 1 {
+		return nil, fmt.Errorf("kafka producer config invalid")
+	}
+
+	saramaConfig, err := newSaramaConfig(&cfg.ClientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	saramaConfig.Producer.Return.Successes = true
+	saramaConfig.Producer.Return.Errors = true
+	saramaConfig.Producer.Partitioner = sarama.NewHashPartitioner
+	saramaConfig.Producer.Flush.Messages = cfg.FlushMessages
+	saramaConfig.Producer.Flush.Bytes = cfg.FlushBytes
+	saramaConfig.Producer.Flush.Frequency = cfg.FlushFrequency
+	saramaConfig.Producer.Compression = cfg.Compression
+
+	saramaConfig.Producer.Retry.Max = DefaultProducerMaxRetries
+	if cfg.MaxRetries > 0 {
+		saramaConfig.Producer.Retry.Max = cfg.MaxRetries
+	}
+
+	if cfg.RequiredAcks != 0 {
+		saramaConfig.Producer.RequiredAcks = cfg.RequiredAcks
+	}
+
+	if cfg.Idempotent {
+		saramaConfig.Producer.Idempotent = true
+		saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
+		saramaConfig.Net.MaxOpenRequests = 1
+	}
+
+	if err := validateSaramaConfig(saramaConfig, &cfg.ClientConfig); err != nil {
+		return nil, err
+	}
+
+	client, err := sarama.NewClient(cfg.Addrs, saramaConfig)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	syncProducer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	asyncProducer, err := sarama.NewAsyncProducerFromClient(client)
+	if err != nil {
+		_ = syncProducer.Close()
+		_ = client.Close()
+		return nil, err
+	}
+
+	producer := newKafkaProducer(syncProducer, asyncProducer, cfg)
+	producer.client = client
+	return producer, nil
+}
+
+// NewProducerFromSarama 使用已创建的sarama producer，如kafkatest中的内存实现，cfg只用到回调
+func NewProducerFromSarama(syncProducer sarama.SyncProducer, asyncProducer sarama.AsyncProducer, cfg *ProducerConfig) Producer {
+	if cfg == nil {
+		cfg = &ProducerConfig{}
+	}
+	return newKafkaProducer(syncProducer, asyncProducer, cfg)
+}
+
+func newKafkaProducer(syncProducer sarama.SyncProducer, asyncProducer sarama.AsyncProducer, cfg *ProducerConfig) *kafkaProducer {
+	producer := &kafkaProducer{
+		syncProducer:  syncProducer,
+		asyncProducer: asyncProducer,
+		cfg:           *cfg,
+		closing:       make(chan struct{}),
+	}
+
+	producer.wg.Add(2)
+	go producer.handleSuccesses()
+	go producer.handleErrors()
+
+	return producer
+}
+
+func (p *kafkaProducer) Send(ctx context.Context, msg *Message) (partition int32, offset int64, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return 0, 0, ErrProducerClosed
+	}
+
+	startAt := time.Now()
+	partition, offset, err = p.syncProducer.SendMessage(toProducerMessage(msg))
+	if err != nil {
+		monitor.ReportKafkaProduceTotal(msg.Topic, "failed")
+		log.WithError(err).Errorf("send kafka msg to %s failed", msg.Topic)
+		return
+	}
+
+	monitor.ReportKafkaProduceTimeCost(startAt, msg.Topic)
+	monitor.ReportKafkaProduceTotal(msg.Topic, "success")
+	return
+}
+
+func (p *kafkaProducer) SendAsync(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrProducerClosed
+	}
+
+	producerMsg := toProducerMessage(msg)
+	producerMsg.Metadata = &produceMetadata{msg: msg, startAt: time.Now()}
+
+	select {
+	case p.asyncProducer.Input() <- producerMsg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.closing:
+		return ErrProducerClosed
+	}
+}
+
+func (p *kafkaProducer) SendBytes(ctx context.Context, topic, key string, value []byte) error {
+	_, _, err := p.Send(ctx, &Message{Topic: topic, Key: key, Value: value})
+	return err
+}
+
+func (p *kafkaProducer) SendJSON(ctx context.Context, topic, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.SendBytes(ctx, topic, key, value)
+}
+
+// SendJSONAsync 返回序列化和SendAsync的错误，发送结果通过回调
+func (p *kafkaProducer) SendJSONAsync(ctx context.Context, topic, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return p.SendAsync(ctx, &Message{Topic: topic, Key: key, Value: value})
+}
+
+// Close 等待异步发送中的消息结束后关闭
+func (p *kafkaProducer) Close() (err error) {
+	p.closeOnce.Do(func() {
+		// 等待正在写入的Send、SendAsync结束，阻塞的SendAsync通过closing返回
+		close(p.closing)
+		p.mu.Lock()
+		p.closed = true
+		p.mu.Unlock()
+
+		p.asyncProducer.AsyncClose()
+		p.wg.Wait()
+
+		if e := p.syncProducer.Close(); e != nil {
+			err = e
+		}
+		if p.client != nil {
+			if e := p.client.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return
+}
+
+func (p *kafkaProducer) handleSuccesses() {
+	defer p.wg.Done()
+
+	for producerMsg := range p.asyncProducer.Successes() {
+		monitor.ReportKafkaProduceTotal(producerMsg.Topic, "success")
+
+		metadata, ok := producerMsg.Metadata.(*produceMetadata)
+		if !ok {
+			continue
+		}
+		monitor.ReportKafkaProduceTimeCost(metadata.startAt, producerMsg.Topic)
+
+		if p.cfg.OnSuccess != nil {
+			p.cfg.OnSuccess(metadata.msg)
+		}
+	}
+}
+
+func (p *kafkaProducer) handleErrors() {
+	defer p.wg.Done()
+
+	for producerErr := range p.asyncProducer.Errors() {
+		monitor.ReportKafkaProduceTotal(producerErr.Msg.Topic, "failed")
+
+		metadata, ok := producerErr.Msg.Metadata.(*produceMetadata)
+		if !ok {
+			log.WithError(producerErr.Err).Errorf("send kafka msg to %s failed", producerErr.Msg.Topic)
+			continue
+		}
+		p.onError(metadata.msg, producerErr.Err)
+	}
+}
+
+func (p *kafkaProducer) onError(msg *Message, err error) {
+	if p.cfg.OnError != nil {
+		p.cfg.OnError(msg, err)
+		return
+	}
+	log.WithError(err).Errorf("send kafka msg to %s failed", msg.Topic)
+}
+
+func toProducerMessage(msg *Message) *sarama.ProducerMessage {
+	producerMsg := &sarama.ProducerMessage{
+		Topic: msg.Topic,
+		Value: sarama.ByteEncoder(msg.Value),
+	}
+
+	if msg.Key != "" {
+		producerMsg.Key = sarama.StringEncoder(msg.Key)
+	}
+
+	for key, value := range msg.Headers {
+		producerMsg.Headers = append(producerMsg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+	return producerMsg
+}
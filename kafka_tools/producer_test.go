@@ -0,0 +1,158 @@
+package kafka_tools
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func newMockProducer(t *testing.T, cfg *ProducerConfig) (Producer, *mocks.SyncProducer, *mocks.AsyncProducer) {
+	t.Helper()
+
+	saramaConfig := mocks.NewTestConfig()
+	saramaConfig.Producer.Return.Successes = true
+	syncProducer := mocks.NewSyncProducer(t, saramaConfig)
+	asyncProducer := mocks.NewAsyncProducer(t, saramaConfig)
+	return NewProducerFromSarama(syncProducer, asyncProducer, cfg), syncProducer, asyncProducer
+}
+
+func TestProducerSendAsync(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		succeeded []string
+		failed    []string
+	)
+	producer, _, asyncProducer := newMockProducer(t, &ProducerConfig{
+		OnSuccess: func(msg *Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			succeeded = append(succeeded, string(msg.Value))
+		},
+		OnError: func(msg *Message, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			failed = append(failed, string(msg.Value))
+		},
+	})
+
+	asyncProducer.ExpectInputAndSucceed()
+	asyncProducer.ExpectInputAndFail(errors.New("broker down"))
+	asyncProducer.ExpectInputAndSucceed()
+
+	ctx := context.Background()
+	if err := producer.SendAsync(ctx, &Message{Topic: "topic", Key: "k", Value: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.SendAsync(ctx, &Message{Topic: "topic", Value: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	// 不是通过SendAsync发送的消息没有metadata，不能panic
+	asyncProducer.Input() <- &sarama.ProducerMessage{Topic: "topic", Value: sarama.StringEncoder("c")}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := producer.SendAsync(canceled, &Message{Topic: "topic"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v", err)
+	}
+
+	if err := producer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(succeeded) != 1 || succeeded[0] != "a" || len(failed) != 1 || failed[0] != "b" {
+		t.Fatalf("succeeded = %v, failed = %v", succeeded, failed)
+	}
+
+	if err := producer.SendAsync(ctx, &Message{Topic: "topic"}); !errors.Is(err, ErrProducerClosed) {
+		t.Fatalf("err = %v", err)
+	}
+	if err := producer.SendJSONAsync(ctx, "topic", "", map[string]int{"a": 1}); !errors.Is(err, ErrProducerClosed) {
+		t.Fatalf("err = %v", err)
+	}
+	if err := producer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProducerSend(t *testing.T) {
+	producer, syncProducer, _ := newMockProducer(t, nil)
+
+	syncProducer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		if msg.Topic != "topic" || len(msg.Headers) != 1 || string(msg.Headers[0].Key) != "h" {
+			return errors.New("unexpected message")
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	if _, _, err := producer.Send(ctx, &Message{Topic: "topic", Key: "k", Headers: map[string]string{"h": "v"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := producer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := producer.Send(ctx, &Message{Topic: "topic"}); !errors.Is(err, ErrProducerClosed) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+// blockedAsyncProducer 模拟broker不可用，写入Input一直阻塞
+type blockedAsyncProducer struct {
+	sarama.AsyncProducer
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func newBlockedAsyncProducer() *blockedAsyncProducer {
+	return &blockedAsyncProducer{
+		input:     make(chan *sarama.ProducerMessage, 1),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+	}
+}
+
+func (p *blockedAsyncProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *blockedAsyncProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+func (p *blockedAsyncProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+func (p *blockedAsyncProducer) AsyncClose()                               { close(p.successes); close(p.errors) }
+
+func TestProducerCloseWithBlockedSendAsync(t *testing.T) {
+	saramaConfig := mocks.NewTestConfig()
+	syncProducer := mocks.NewSyncProducer(t, saramaConfig)
+	producer := NewProducerFromSarama(syncProducer, newBlockedAsyncProducer(), nil)
+
+	ctx := context.Background()
+	// 填满input
+	if err := producer.SendAsync(ctx, &Message{Topic: "topic"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- producer.SendAsync(ctx, &Message{Topic: "topic"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- producer.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked by SendAsync")
+	}
+	if err := <-sent; !errors.Is(err, ErrProducerClosed) {
+		t.Fatalf("err = %v", err)
+	}
+}
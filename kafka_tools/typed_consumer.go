@@ -0,0 +1,301 @@
+package kafka_tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jiangfans/handy/monitor"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	按类型解码消息:
+	1. EnvelopeExtractor从消息中取出事件id、类型、版本和消息体，默认整个消息体就是数据
+	2. Codec把消息体解码成T，T或*T实现了Validator时解码后校验
+	3. 解码或校验失败时交给DecodeErrorHandler，默认打印日志后跳过，不会堵塞分区
+	   返回错误时按消费失败处理，配置了FailurePolicy时会转发到重试topic或DLQ
+	Router按事件类型把消息分发给不同的TypedConsumeFunc，Handle、HandleUnknown需在ConsumeFunc之前调用
+*/
+
+const (
+	HeaderEventId      = "x-event-id"
+	HeaderEventType    = "x-event-type"
+	HeaderEventVersion = "x-event-version"
+)
+
+var ErrUnknownEventType = errors.New("unknown event type")
+
+// Envelope 事件的元信息，Data为待解码的消息体
+type Envelope struct {
+	Id      string
+	Type    string
+	Version int
+	Data    []byte
+}
+
+type EnvelopeExtractor func(msg *sarama.ConsumerMessage) (*Envelope, error)
+
+// RawEnvelope 整个消息体就是数据，没有元信息
+func RawEnvelope(msg *sarama.ConsumerMessage) (*Envelope, error) {
+	return &Envelope{Data: msg.Value}, nil
+}
+
+// HeaderEnvelope 元信息在消息头x-event-id、x-event-type、x-event-version中
+func HeaderEnvelope(msg *sarama.ConsumerMessage) (*Envelope, error) {
+	envelope := &Envelope{
+		Id:   headerValue(msg, HeaderEventId),
+		Type: headerValue(msg, HeaderEventType),
+		Data: msg.Value,
+	}
+
+	if version := headerValue(msg, HeaderEventVersion); version != "" {
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event version %s", version)
+		}
+		envelope.Version = v
+	}
+	return envelope, nil
+}
+
+// JSONEnvelope 消息体为{"id":"","type":"","version":1,"data":{}}，data配合JSONCodec使用
+func JSONEnvelope(msg *sarama.ConsumerMessage) (*Envelope, error) {
+	var body struct {
+		Id      string          `json:"id"`
+		Type    string          `json:"type"`
+		Version int             `json:"version"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(msg.Value, &body); err != nil {
+		return nil, fmt.Errorf("invalid json envelope: %w", err)
+	}
+
+	return &Envelope{
+		Id:      body.Id,
+		Type:    body.Type,
+		Version: body.Version,
+		Data:    body.Data,
+	}, nil
+}
+
+// Validator 解码后的数据实现Validate时会被调用
+type Validator interface {
+	Validate() error
+}
+
+// DecodeError 解码或校验失败
+type DecodeError struct {
+	Envelope *Envelope // 取元信息失败时为空
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode kafka msg failed: %v", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeErrorHandler 返回nil时跳过该消息，返回错误时按消费失败处理
+type DecodeErrorHandler func(msg *sarama.ConsumerMessage, err *DecodeError) error
+
+// SkipDecodeError 打印日志后跳过
+func SkipDecodeError(msg *sarama.ConsumerMessage, err *DecodeError) error {
+	log.WithFields(msgLogFields(msg)).WithError(err).Error("kafka msg skipped")
+	return nil
+}
+
+// SendDecodeErrorTo 把原始消息和错误信息发送到topic，发送失败时按消费失败处理
+func SendDecodeErrorTo(producer Producer, topic string) DecodeErrorHandler {
+	return func(msg *sarama.ConsumerMessage, decodeErr *DecodeError) error {
+		headers := make(map[string]string, len(msg.Headers)+5)
+		for _, header := range msg.Headers {
+			if header != nil && !isFailureHeader(string(header.Key)) {
+				headers[string(header.Key)] = string(header.Value)
+			}
+		}
+		for _, header := range originHeaders(msg) {
+			headers[string(header.Key)] = string(header.Value)
+		}
+		headers[HeaderError] = decodeErr.Error()
+		headers[HeaderFailedAt] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+		_, _, err := producer.Send(context.Background(), &Message{
+			Topic:   topic,
+			Key:     string(msg.Key),
+			Value:   msg.Value,
+			Headers: headers,
+		})
+		if err != nil {
+			log.WithFields(msgLogFields(msg)).WithError(err).Errorf("send kafka msg to %s failed", topic)
+			return err
+		}
+
+		log.WithFields(msgLogFields(msg)).WithError(decodeErr).Warnf("kafka msg sent to %s", topic)
+		return nil
+	}
+}
+
+type TypedMessage[T any] struct {
+	Raw      *sarama.ConsumerMessage
+	Envelope *Envelope
+	Data     T
+}
+
+type TypedConsumeFunc[T any] func(msg *TypedMessage[T]) error
+
+type TypedOpts struct {
+	envelope    EnvelopeExtractor
+	decodeError DecodeErrorHandler
+}
+
+type (
+	funcTypedOption struct {
+		f func(opts *TypedOpts)
+	}
+
+	TypedOption interface {
+		apply(opts *TypedOpts)
+	}
+)
+
+func (fdo *funcTypedOption) apply(do *TypedOpts) {
+	fdo.f(do)
+}
+
+func newTypedOption(f func(opts *TypedOpts)) *funcTypedOption {
+	return &funcTypedOption{
+		f: f,
+	}
+}
+
+// WithEnvelope 取元信息的方式，默认RawEnvelope
+func WithEnvelope(extractor EnvelopeExtractor) TypedOption {
+	return newTypedOption(func(opts *TypedOpts) {
+		opts.envelope = extractor
+	})
+}
+
+// WithDecodeErrorHandler 解码失败的处理，默认SkipDecodeError
+func WithDecodeErrorHandler(handler DecodeErrorHandler) TypedOption {
+	return newTypedOption(func(opts *TypedOpts) {
+		opts.decodeError = handler
+	})
+}
+
+func newTypedOpts(opts []TypedOption) *TypedOpts {
+	typedOpts := &TypedOpts{
+		envelope:    RawEnvelope,
+		decodeError: SkipDecodeError,
+	}
+	for _, opt := range opts {
+		opt.apply(typedOpts)
+	}
+	return typedOpts
+}
+
+// Typed 把TypedConsumeFunc转换成ConsumeFunc，可直接用于Consumer.Run
+func Typed[T any](codec Codec, f TypedConsumeFunc[T], opts ...TypedOption) ConsumeFunc {
+	typedOpts := newTypedOpts(opts)
+	handle := typedHandler(codec, f)
+
+	return func(msg *sarama.ConsumerMessage) error {
+		envelope, err := typedOpts.envelope(msg)
+		if err != nil {
+			return typedOpts.onDecodeError(msg, &DecodeError{Err: err})
+		}
+		return handle(msg, envelope, typedOpts)
+	}
+}
+
+func (opts *TypedOpts) onDecodeError(msg *sarama.ConsumerMessage, err *DecodeError) error {
+	monitor.ReportKafkaConsumeTotal(msg.Topic, "decode_failed")
+	return opts.decodeError(msg, err)
+}
+
+type envelopeHandler func(msg *sarama.ConsumerMessage, envelope *Envelope, opts *TypedOpts) error
+
+func typedHandler[T any](codec Codec, f TypedConsumeFunc[T]) envelopeHandler {
+	return func(msg *sarama.ConsumerMessage, envelope *Envelope, opts *TypedOpts) error {
+		typedMsg := &TypedMessage[T]{Raw: msg, Envelope: envelope}
+		if err := decode(codec, envelope.Data, &typedMsg.Data); err != nil {
+			return opts.onDecodeError(msg, &DecodeError{Envelope: envelope, Err: err})
+		}
+		return f(typedMsg)
+	}
+}
+
+func decode[T any](codec Codec, data []byte, v *T) error {
+	if err := codec.Decode(data, v); err != nil {
+		return fmt.Errorf("%s decode: %w", codec.Name(), err)
+	}
+
+	var validator Validator
+	if vv, ok := interface{}(v).(Validator); ok {
+		validator = vv
+	} else if vv, ok := interface{}(*v).(Validator); ok {
+		validator = vv
+	}
+	if validator != nil {
+		if err := validator.Validate(); err != nil {
+			return fmt.Errorf("validate: %w", err)
+		}
+	}
+	return nil
+}
+
+// Router 按Envelope.Type分发消息，没有对应handler的消息按解码失败处理
+type Router struct {
+	opts     *TypedOpts
+	handlers map[string]envelopeHandler
+	unknown  ConsumeFunc
+}
+
+// NewRouter 默认使用HeaderEnvelope
+func NewRouter(opts ...TypedOption) *Router {
+	return &Router{
+		opts:     newTypedOpts(append([]TypedOption{WithEnvelope(HeaderEnvelope)}, opts...)),
+		handlers: map[string]envelopeHandler{},
+	}
+}
+
+// Handle 注册事件类型的handler，go不支持泛型方法所以是函数；不能和ConsumeFunc返回的函数并发调用
+func Handle[T any](r *Router, eventType string, codec Codec, f TypedConsumeFunc[T]) {
+	r.handlers[eventType] = typedHandler(codec, f)
+}
+
+// HandleUnknown 没有对应handler的消息交给f处理，而不是按解码失败处理
+func (r *Router) HandleUnknown(f ConsumeFunc) {
+	r.unknown = f
+}
+
+// ConsumeFunc 使用调用时已注册的handler，之后再注册的不生效
+func (r *Router) ConsumeFunc() ConsumeFunc {
+	handlers := make(map[string]envelopeHandler, len(r.handlers))
+	for eventType, handle := range r.handlers {
+		handlers[eventType] = handle
+	}
+	unknown := r.unknown
+
+	return func(msg *sarama.ConsumerMessage) error {
+		envelope, err := r.opts.envelope(msg)
+		if err != nil {
+			return r.opts.onDecodeError(msg, &DecodeError{Err: err})
+		}
+
+		handle, ok := handlers[envelope.Type]
+		if !ok {
+			if unknown != nil {
+				return unknown(msg)
+			}
+			return r.opts.onDecodeError(msg, &DecodeError{Envelope: envelope, Err: fmt.Errorf("%w %q", ErrUnknownEventType, envelope.Type)})
+		}
+		return handle(msg, envelope, r.opts)
+	}
+}
@@ -0,0 +1,323 @@
+package kafka_tools
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testOrder struct {
+	Id     string `json:"id" avro:"id"`
+	Amount int    `json:"amount" avro:"amount"`
+}
+
+// testValueOrder 值接收者实现Validator
+type testValueOrder testOrder
+
+func (o testValueOrder) Validate() error {
+	if o.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	return nil
+}
+
+// testPtrOrder 指针接收者实现Validator
+type testPtrOrder testOrder
+
+func (o *testPtrOrder) Validate() error {
+	if o.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	return nil
+}
+
+func header(key, value string) *sarama.RecordHeader {
+	return &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+}
+
+// recordDecodeError 记录解码失败，返回nil跳过
+func recordDecodeError(errs *[]*DecodeError) TypedOption {
+	return WithDecodeErrorHandler(func(msg *sarama.ConsumerMessage, err *DecodeError) error {
+		*errs = append(*errs, err)
+		return nil
+	})
+}
+
+func TestTypedEnvelope(t *testing.T) {
+	cases := []struct {
+		name      string
+		extractor EnvelopeExtractor
+		msg       *sarama.ConsumerMessage
+		want      Envelope
+	}{
+		{
+			name:      "raw",
+			extractor: RawEnvelope,
+			msg:       &sarama.ConsumerMessage{Value: []byte(`{"id":"o1","amount":1}`)},
+		},
+		{
+			name:      "header",
+			extractor: HeaderEnvelope,
+			msg: &sarama.ConsumerMessage{
+				Value:   []byte(`{"id":"o1","amount":1}`),
+				Headers: []*sarama.RecordHeader{header(HeaderEventId, "e1"), header(HeaderEventType, "order.created"), header(HeaderEventVersion, "2")},
+			},
+			want: Envelope{Id: "e1", Type: "order.created", Version: 2},
+		},
+		{
+			name:      "json",
+			extractor: JSONEnvelope,
+			msg:       &sarama.ConsumerMessage{Value: []byte(`{"id":"e1","type":"order.created","version":2,"data":{"id":"o1","amount":1}}`)},
+			want:      Envelope{Id: "e1", Type: "order.created", Version: 2},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got *TypedMessage[testOrder]
+			f := Typed(JSONCodec{}, func(msg *TypedMessage[testOrder]) error {
+				got = msg
+				return nil
+			}, WithEnvelope(c.extractor))
+
+			if err := f(c.msg); err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || got.Raw != c.msg || got.Data != (testOrder{Id: "o1", Amount: 1}) {
+				t.Fatalf("got = %+v", got)
+			}
+			if envelope := got.Envelope; envelope.Id != c.want.Id || envelope.Type != c.want.Type || envelope.Version != c.want.Version {
+				t.Fatalf("envelope = %+v", envelope)
+			}
+		})
+	}
+
+	invalid := map[string]struct {
+		extractor EnvelopeExtractor
+		msg       *sarama.ConsumerMessage
+	}{
+		"header version": {HeaderEnvelope, &sarama.ConsumerMessage{Headers: []*sarama.RecordHeader{header(HeaderEventVersion, "v2")}}},
+		"json":           {JSONEnvelope, &sarama.ConsumerMessage{Value: []byte("not json")}},
+	}
+	for name, c := range invalid {
+		var decodeErrs []*DecodeError
+		f := Typed(JSONCodec{}, func(msg *TypedMessage[testOrder]) error {
+			t.Fatalf("%s: consumed invalid envelope", name)
+			return nil
+		}, WithEnvelope(c.extractor), recordDecodeError(&decodeErrs))
+
+		if err := f(c.msg); err != nil || len(decodeErrs) != 1 || decodeErrs[0].Envelope != nil {
+			t.Fatalf("%s: err = %v, decode errors = %v", name, err, decodeErrs)
+		}
+	}
+}
+
+func TestTypedValidator(t *testing.T) {
+	valid := &sarama.ConsumerMessage{Value: []byte(`{"id":"o1","amount":1}`)}
+	invalid := &sarama.ConsumerMessage{Value: []byte(`{"id":"o1","amount":0}`)}
+
+	t.Run("value receiver", func(t *testing.T) {
+		var consumed int
+		var decodeErrs []*DecodeError
+		f := Typed(JSONCodec{}, func(msg *TypedMessage[testValueOrder]) error {
+			consumed++
+			return nil
+		}, recordDecodeError(&decodeErrs))
+
+		if err := f(valid); err != nil {
+			t.Fatal(err)
+		}
+		if err := f(invalid); err != nil {
+			t.Fatal(err)
+		}
+		if consumed != 1 || len(decodeErrs) != 1 || decodeErrs[0].Envelope == nil {
+			t.Fatalf("consumed = %d, decode errors = %v", consumed, decodeErrs)
+		}
+	})
+
+	t.Run("pointer receiver", func(t *testing.T) {
+		var consumed int
+		var decodeErrs []*DecodeError
+		f := Typed(JSONCodec{}, func(msg *TypedMessage[testPtrOrder]) error {
+			consumed++
+			return nil
+		}, recordDecodeError(&decodeErrs))
+
+		if err := f(valid); err != nil {
+			t.Fatal(err)
+		}
+		if err := f(invalid); err != nil {
+			t.Fatal(err)
+		}
+		if consumed != 1 || len(decodeErrs) != 1 {
+			t.Fatalf("consumed = %d, decode errors = %v", consumed, decodeErrs)
+		}
+	})
+
+	t.Run("pointer type", func(t *testing.T) {
+		var consumed int
+		var decodeErrs []*DecodeError
+		f := Typed(JSONCodec{}, func(msg *TypedMessage[*testPtrOrder]) error {
+			consumed++
+			return nil
+		}, recordDecodeError(&decodeErrs))
+
+		if err := f(valid); err != nil {
+			t.Fatal(err)
+		}
+		if err := f(invalid); err != nil {
+			t.Fatal(err)
+		}
+		if consumed != 1 || len(decodeErrs) != 1 {
+			t.Fatalf("consumed = %d, decode errors = %v", consumed, decodeErrs)
+		}
+	})
+}
+
+func TestDecodeErrorHandler(t *testing.T) {
+	msg := &sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 1,
+		Offset:    2,
+		Key:       []byte("k"),
+		Value:     []byte("not json"),
+		Headers:   []*sarama.RecordHeader{header("trace-id", "t1"), header(HeaderError, "old error")},
+	}
+	consume := func(msg *TypedMessage[testOrder]) error {
+		t.Fatal("consumed invalid msg")
+		return nil
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		if err := Typed(JSONCodec{}, consume)(msg); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("send", func(t *testing.T) {
+		producer, syncProducer, _ := newMockProducer(t, nil)
+		defer func() { _ = producer.Close() }()
+
+		var sent *sarama.ProducerMessage
+		syncProducer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			sent = msg
+			return nil
+		})
+
+		f := Typed(JSONCodec{}, consume, WithDecodeErrorHandler(SendDecodeErrorTo(producer, "orders.invalid")))
+		if err := f(msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if sent == nil || sent.Topic != "orders.invalid" {
+			t.Fatalf("sent = %+v", sent)
+		}
+		headers := headerMap(sent)
+		if headers["trace-id"] != "t1" || headers[HeaderOriginalTopic] != "orders" || headers[HeaderOriginalOffset] != "2" || headers[HeaderFailedAt] == "" {
+			t.Fatalf("headers = %v", headers)
+		}
+		if headers[HeaderError] == "old error" || headers[HeaderError] == "" {
+			t.Fatalf("error header = %q", headers[HeaderError])
+		}
+	})
+
+	t.Run("send failed", func(t *testing.T) {
+		producer, syncProducer, _ := newMockProducer(t, nil)
+		defer func() { _ = producer.Close() }()
+
+		sendErr := errors.New("broker down")
+		syncProducer.ExpectSendMessageAndFail(sendErr)
+
+		// 发送失败时按消费失败处理
+		f := Typed(JSONCodec{}, consume, WithDecodeErrorHandler(SendDecodeErrorTo(producer, "orders.invalid")))
+		if err := f(msg); !errors.Is(err, sendErr) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+}
+
+func TestRouter(t *testing.T) {
+	created := &sarama.ConsumerMessage{
+		Value:   []byte(`{"id":"o1","amount":1}`),
+		Headers: []*sarama.RecordHeader{header(HeaderEventType, "order.created")},
+	}
+	unknown := &sarama.ConsumerMessage{
+		Value:   []byte(`{}`),
+		Headers: []*sarama.RecordHeader{header(HeaderEventType, "order.deleted")},
+	}
+
+	var decodeErrs []*DecodeError
+	var consumed []string
+	router := NewRouter(recordDecodeError(&decodeErrs))
+	Handle(router, "order.created", JSONCodec{}, func(msg *TypedMessage[testOrder]) error {
+		consumed = append(consumed, msg.Data.Id)
+		return nil
+	})
+
+	f := router.ConsumeFunc()
+	if err := f(created); err != nil {
+		t.Fatal(err)
+	}
+	if len(consumed) != 1 || consumed[0] != "o1" {
+		t.Fatalf("consumed = %v", consumed)
+	}
+
+	// 没有HandleUnknown时按解码失败处理
+	if err := f(unknown); err != nil {
+		t.Fatal(err)
+	}
+	if len(decodeErrs) != 1 || !errors.Is(decodeErrs[0], ErrUnknownEventType) || decodeErrs[0].Envelope.Type != "order.deleted" {
+		t.Fatalf("decode errors = %v", decodeErrs)
+	}
+
+	// ConsumeFunc之后注册的不生效
+	var unknownConsumed int
+	router.HandleUnknown(func(msg *sarama.ConsumerMessage) error {
+		unknownConsumed++
+		return nil
+	})
+	if err := f(unknown); err != nil || unknownConsumed != 0 || len(decodeErrs) != 2 {
+		t.Fatalf("err = %v, unknown consumed = %d, decode errors = %d", err, unknownConsumed, len(decodeErrs))
+	}
+
+	if err := router.ConsumeFunc()(unknown); err != nil || unknownConsumed != 1 || len(decodeErrs) != 2 {
+		t.Fatalf("err = %v, unknown consumed = %d, decode errors = %d", err, unknownConsumed, len(decodeErrs))
+	}
+}
+
+func TestCodec(t *testing.T) {
+	avroCodec, err := NewAvroCodec(`{"type":"record","name":"order","fields":[{"name":"id","type":"string"},{"name":"amount","type":"int"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, avroCodec} {
+		data, err := codec.Encode(testOrder{Id: "o1", Amount: 1})
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+
+		var order testOrder
+		if err := codec.Decode(data, &order); err != nil || order != (testOrder{Id: "o1", Amount: 1}) {
+			t.Fatalf("%s: order = %+v, err = %v", codec.Name(), order, err)
+		}
+	}
+
+	data, err := ProtobufCodec{}.Encode(wrapperspb.String("o1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value wrapperspb.StringValue
+	if err := (ProtobufCodec{}).Decode(data, &value); err != nil || value.GetValue() != "o1" {
+		t.Fatalf("value = %v, err = %v", value.GetValue(), err)
+	}
+	if _, err := (ProtobufCodec{}).Encode(testOrder{}); err == nil {
+		t.Fatal("encode non proto message")
+	}
+
+	if _, err := NewAvroCodec("not a schema"); err == nil {
+		t.Fatal("invalid avro schema accepted")
+	}
+}
@@ -0,0 +1,14 @@
+package middlewares
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jiangfans/handy/gorm_tools"
+)
+
+// ReadYourWrites 同一请求写入后的读走主库，配合gorm_tools.ResolverPlugin使用
+func ReadYourWrites() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(gorm_tools.WithReadYourWrites(c.Request.Context()))
+		c.Next()
+	}
+}
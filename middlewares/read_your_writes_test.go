@@ -0,0 +1,94 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/jiangfans/handy/gorm_tools"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type testRecord struct {
+	Id   uint64 `gorm:"column:id"`
+	Name string `gorm:"column:name"`
+}
+
+func openRecordDB(t *testing.T, name string) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), name+".db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	if err := db.AutoMigrate(&testRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&testRecord{Id: 1, Name: name}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestReadYourWrites(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db := openRecordDB(t, "primary")
+	replicaDB, err := openRecordDB(t, "replica").DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &gorm_tools.ResolverPlugin{
+		Replicas:             []gorm_tools.Replica{{Name: "replica", DB: replicaDB}},
+		ReadYourWritesWindow: time.Hour,
+		HealthCheckInterval:  time.Hour,
+	}
+	if err := db.Use(plugin); err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close()
+
+	router := gin.New()
+	router.Use(ReadYourWrites())
+	router.POST("/records", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		var before, after testRecord
+		if err := db.WithContext(ctx).First(&before, 1).Error; err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := db.WithContext(ctx).Create(&testRecord{Id: 2, Name: "new"}).Error; err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := db.WithContext(ctx).First(&after, 1).Error; err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.String(http.StatusOK, before.Name+","+after.Name)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/records", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "replica,primary" {
+		t.Fatalf("code = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	// 新请求写入前读从库
+	var record testRecord
+	if err := db.WithContext(gorm_tools.WithReadYourWrites(context.Background())).First(&record, 1).Error; err != nil || record.Name != "replica" {
+		t.Fatalf("record = %+v, err = %v", record, err)
+	}
+}
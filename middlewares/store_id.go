@@ -0,0 +1,33 @@
+package middlewares
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jiangfans/handy/gorm_tools"
+	"github.com/jiangfans/handy/utils"
+)
+
+// StoreId 将请求头store-id写入request context和gin.Context，配合gorm_tools.TenantScopePlugin使用
+// db.WithContext(c)和db.WithContext(c.Request.Context())都能取到店铺id
+func StoreId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value := c.GetHeader(utils.HeaderStoreId)
+		if value == "" {
+			c.Next()
+			return
+		}
+
+		storeId, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid store-id header"})
+			return
+		}
+
+		c.Request = c.Request.WithContext(gorm_tools.WithStoreId(c.Request.Context(), storeId))
+		// gin 1.8默认不会从gin.Context回退到Request.Context()查找非字符串key
+		c.Set(gorm_tools.StoreIdContextKey, storeId)
+		c.Next()
+	}
+}
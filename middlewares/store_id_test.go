@@ -0,0 +1,111 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/jiangfans/handy/gorm_tools"
+	"github.com/jiangfans/handy/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type testProduct struct {
+	Id      uint64 `gorm:"column:id"`
+	StoreId uint64 `gorm:"column:store_id"`
+	Name    string `gorm:"column:name"`
+}
+
+func newTenantTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	if err := db.AutoMigrate(&testProduct{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(&gorm_tools.TenantScopePlugin{}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.WithContext(gorm_tools.WithoutTenantScope(context.Background())).
+		Create([]*testProduct{{Id: 1, StoreId: 1, Name: "a"}, {Id: 2, StoreId: 2, Name: "b"}}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestStoreId(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTenantTestDB(t)
+
+	contexts := map[string]func(c *gin.Context) context.Context{
+		"gin context":     func(c *gin.Context) context.Context { return c },
+		"request context": func(c *gin.Context) context.Context { return c.Request.Context() },
+	}
+	for name, ctxOf := range contexts {
+		t.Run(name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(StoreId())
+			router.GET("/products", func(c *gin.Context) {
+				var products []*testProduct
+				if err := db.WithContext(ctxOf(c)).Find(&products).Error; err != nil {
+					c.String(http.StatusInternalServerError, err.Error())
+					return
+				}
+				c.JSON(http.StatusOK, products)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/products", nil)
+			req.Header.Set(utils.HeaderStoreId, "2")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK || w.Body.String() != `[{"Id":2,"StoreId":2,"Name":"b"}]` {
+				t.Fatalf("code = %d, body = %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestStoreIdInvalid(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(StoreId())
+	router.GET("/", func(c *gin.Context) {
+		if _, ok := gorm_tools.StoreIdFromContext(c); ok {
+			t.Error("store id without header")
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(utils.HeaderStoreId, "abc")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("code = %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d", w.Code)
+	}
+}
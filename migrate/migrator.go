@@ -0,0 +1,398 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jiangfans/handy/gorm_tools"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+/*
+	版本化迁移:
+	migrations, _ := migrate.LoadFS(migrationFS, "migrations")
+	migrator, _ := migrate.NewMigrator(db, migrations, nil)
+	err := migrator.Up(ctx)
+
+	1. 已执行的版本和checksum记录在schema_migrations表，已执行的sql迁移被修改时报ErrChecksumMismatch，
+	   数据库中有代码里不存在的已执行版本时报ErrUnknownMigration，回滚到旧版本代码时可设置IgnoreUnknown
+	2. 执行前获取advisory lock（mysql GET_LOCK，postgres pg_advisory_lock），多个实例同时启动时只有一个执行迁移，其他等待
+	   解锁不随ctx取消，解锁失败时关闭连接，避免带着锁的连接回到连接池
+	3. 每个迁移在单独的事务中执行，mysql的DDL会隐式提交，DDL迁移尽量一个文件一条语句
+	4. DryRun只打印将要执行的sql，不执行也不加锁
+*/
+
+const (
+	DefaultTable       = "schema_migrations"
+	DefaultLockName    = "handy_schema_migrations"
+	DefaultLockTimeout = 5 * time.Minute
+
+	lockRetryInterval = time.Second
+	unlockTimeout     = 10 * time.Second
+)
+
+var (
+	ErrChecksumMismatch = errors.New("applied migration has been modified")
+	ErrNoDownMigration  = errors.New("migration has no down")
+	ErrUnknownMigration = errors.New("applied migration not found")
+	ErrLockTimeout      = errors.New("acquire migration lock timeout")
+)
+
+type Config struct {
+	Table       string        // 默认schema_migrations
+	LockName    string        // advisory lock名称
+	LockTimeout time.Duration // 等待其他实例迁移完成的时间
+	DryRun      bool
+	Output      io.Writer // DryRun的输出，默认os.Stdout
+
+	IgnoreUnknown bool // 有未知的已执行版本时只打印警告
+}
+
+type appliedMigration struct {
+	Version   int64  `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"size:255;not null"`
+	Checksum  string `gorm:"size:64;not null"`
+	AppliedAt gorm_tools.Time
+}
+
+type Status struct {
+	Version          int64
+	Name             string
+	Applied          bool
+	AppliedAt        *gorm_tools.Time
+	ChecksumMismatch bool
+}
+
+type Migrator struct {
+	db         *gorm.DB
+	migrations []*Migration
+	cfg        Config
+}
+
+func NewMigrator(db *gorm.DB, migrations []*Migration, cfg *Config) (*Migrator, error) {
+	if db == nil {
+		return nil, errors.New("migrator db can't be nil")
+	}
+
+	sorted := make([]*Migration, len(migrations))
+	copy(sorted, migrations)
+	sortMigrations(sorted)
+
+	for i, m := range sorted {
+		if m.Up == nil && m.UpSQL == "" {
+			return nil, fmt.Errorf("migration %s missing up", m)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+	}
+
+	migrator := &Migrator{
+		db:         db,
+		migrations: sorted,
+	}
+	if cfg != nil {
+		migrator.cfg = *cfg
+	}
+
+	if migrator.cfg.Table == "" {
+		migrator.cfg.Table = DefaultTable
+	}
+	if migrator.cfg.LockName == "" {
+		migrator.cfg.LockName = DefaultLockName
+	}
+	if migrator.cfg.LockTimeout <= 0 {
+		migrator.cfg.LockTimeout = DefaultLockTimeout
+	}
+	if migrator.cfg.Output == nil {
+		migrator.cfg.Output = os.Stdout
+	}
+
+	return migrator, nil
+}
+
+// Up 执行所有未执行的迁移
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.run(ctx, func(conn *gorm.DB, applied map[int64]*appliedMigration) error {
+		if err := m.verify(applied); err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			if err := m.apply(ctx, conn, migration, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down 按版本倒序回滚最近执行的steps个迁移
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.run(ctx, func(conn *gorm.DB, applied map[int64]*appliedMigration) error {
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			if !migration.hasDown() {
+				return fmt.Errorf("%w: %s", ErrNoDownMigration, migration)
+			}
+
+			if err := m.apply(ctx, conn, migration, false); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// Status 所有迁移的执行状态
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.loadApplied(m.db.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := Status{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = &record.AppliedAt
+			status.ChecksumMismatch = checksumMismatch(migration, record)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (m *Migrator) run(ctx context.Context, f func(conn *gorm.DB, applied map[int64]*appliedMigration) error) error {
+	db := m.db.WithContext(ctx)
+	if m.cfg.DryRun {
+		applied, err := m.loadApplied(db)
+		if err != nil {
+			return err
+		}
+		return f(db, applied)
+	}
+
+	// advisory lock属于连接，加锁、迁移、解锁需在同一个连接上
+	return db.Connection(func(conn *gorm.DB) error {
+		unlock, err := m.lock(ctx, conn)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if err := conn.Table(m.cfg.Table).AutoMigrate(&appliedMigration{}); err != nil {
+			return err
+		}
+
+		applied, err := m.loadApplied(conn)
+		if err != nil {
+			return err
+		}
+		return f(conn, applied)
+	})
+}
+
+func (m *Migrator) loadApplied(db *gorm.DB) (map[int64]*appliedMigration, error) {
+	applied := make(map[int64]*appliedMigration)
+	if !db.Migrator().HasTable(m.cfg.Table) {
+		return applied, nil
+	}
+
+	var records []*appliedMigration
+	if err := db.Table(m.cfg.Table).Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+func (m *Migrator) verify(applied map[int64]*appliedMigration) error {
+	known := make(map[int64]bool, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+		if record, ok := applied[migration.Version]; ok && checksumMismatch(migration, record) {
+			return fmt.Errorf("%w: %s", ErrChecksumMismatch, migration)
+		}
+	}
+
+	for _, record := range sortedApplied(applied) {
+		if known[record.Version] {
+			continue
+		}
+
+		if !m.cfg.IgnoreUnknown {
+			return fmt.Errorf("%w: %d_%s", ErrUnknownMigration, record.Version, record.Name)
+		}
+		log.Warnf("applied migration %d_%s not found in migrations", record.Version, record.Name)
+	}
+	return nil
+}
+
+func sortedApplied(applied map[int64]*appliedMigration) []*appliedMigration {
+	records := make([]*appliedMigration, 0, len(applied))
+	for _, record := range applied {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Version < records[j].Version
+	})
+	return records
+}
+
+func checksumMismatch(migration *Migration, record *appliedMigration) bool {
+	return record.Checksum != "" && migration.Checksum() != "" && record.Checksum != migration.Checksum()
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *gorm.DB, migration *Migration, up bool) error {
+	direction, sql, fn := "up", migration.UpSQL, migration.Up
+	if !up {
+		direction, sql, fn = "down", migration.DownSQL, migration.Down
+	}
+
+	if m.cfg.DryRun {
+		return m.print(migration, direction, sql, fn)
+	}
+
+	startAt := time.Now()
+	err := gorm_tools.WithTx(ctx, conn, func(ctx context.Context, tx *gorm.DB) error {
+		if fn != nil {
+			if err := fn(ctx, tx); err != nil {
+				return err
+			}
+		} else {
+			for _, statement := range splitStatements(sql) {
+				if err := tx.Exec(statement).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		if !up {
+			return tx.Table(m.cfg.Table).Where("version = ?", migration.Version).Delete(&appliedMigration{}).Error
+		}
+		return tx.Table(m.cfg.Table).Create(&appliedMigration{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			Checksum:  migration.Checksum(),
+			AppliedAt: gorm_tools.Time(time.Now().UTC()),
+		}).Error
+	}, gorm_tools.TxMaxRetries(0))
+	if err != nil {
+		return fmt.Errorf("migration %s %s failed: %w", migration, direction, err)
+	}
+
+	log.Infof("migration %s %s done, cost %dms", migration, direction, time.Since(startAt).Milliseconds())
+	return nil
+}
+
+func (m *Migrator) print(migration *Migration, direction, sql string, fn MigrateFunc) error {
+	if _, err := fmt.Fprintf(m.cfg.Output, "-- %s %s\n", migration, direction); err != nil {
+		return err
+	}
+
+	if fn != nil {
+		_, err := fmt.Fprintln(m.cfg.Output, "-- go migration")
+		return err
+	}
+
+	for _, statement := range splitStatements(sql) {
+		if _, err := fmt.Fprintln(m.cfg.Output, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) lock(ctx context.Context, conn *gorm.DB) (unlock func(), err error) {
+	switch conn.Dialector.Name() {
+	case "mysql":
+		var result *int
+		timeout := int(m.cfg.LockTimeout.Seconds())
+		if err := conn.Raw("SELECT GET_LOCK(?, ?)", m.cfg.LockName, timeout).Scan(&result).Error; err != nil {
+			return nil, err
+		}
+		if result == nil || *result != 1 {
+			return nil, ErrLockTimeout
+		}
+
+		return func() {
+			releaseLock(conn, "SELECT RELEASE_LOCK(?)", m.cfg.LockName)
+		}, nil
+	case "postgres":
+		key := lockKey(m.cfg.LockName)
+		deadline := time.Now().Add(m.cfg.LockTimeout)
+		for {
+			var locked bool
+			if err := conn.Raw("SELECT pg_try_advisory_lock(?)", key).Scan(&locked).Error; err != nil {
+				return nil, err
+			}
+			if locked {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				return nil, ErrLockTimeout
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(lockRetryInterval):
+			}
+		}
+
+		return func() {
+			releaseLock(conn, "SELECT pg_advisory_unlock(?)", key)
+		}, nil
+	default:
+		// sqlite等单机数据库不需要加锁
+		return func() {}, nil
+	}
+}
+
+// releaseLock 使用新的ctx，调用方ctx已取消时也能解锁；失败时关闭连接，数据库会随连接释放锁
+func releaseLock(conn *gorm.DB, query string, values ...interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+
+	err := conn.WithContext(ctx).Exec(query, values...).Error
+	if err == nil {
+		return
+	}
+	log.WithError(err).Error("release migration lock failed, close the connection")
+
+	if sqlConn, ok := conn.Statement.ConnPool.(*sql.Conn); ok {
+		// Raw返回driver.ErrBadConn时连接被关闭，不会回到连接池
+		_ = sqlConn.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+	}
+}
+
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
@@ -0,0 +1,292 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 内存数据库每个连接独立，只用一个连接
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	return db
+}
+
+var testFS = fstest.MapFS{
+	"migrations/1_create_users.up.sql": {Data: []byte(`
+-- 用户
+CREATE TABLE users (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+CREATE INDEX idx_users_name ON users (name);
+`)},
+	"migrations/1_create_users.down.sql":  {Data: []byte("DROP TABLE users;")},
+	"migrations/2_create_orders.up.sql":   {Data: []byte("CREATE TABLE orders (id INTEGER PRIMARY KEY, user_id INTEGER);")},
+	"migrations/2_create_orders.down.sql": {Data: []byte("DROP TABLE orders;")},
+	"migrations/README.md":                {Data: []byte("ignored")},
+}
+
+func loadTestMigrations(t *testing.T) []*Migration {
+	t.Helper()
+
+	migrations, err := LoadFS(testFS, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// go迁移，没有down
+	return append(migrations, &Migration{
+		Version: 3,
+		Name:    "seed_users",
+		Up: func(ctx context.Context, tx *gorm.DB) error {
+			return tx.Exec("INSERT INTO users (id, name) VALUES (1, 'admin')").Error
+		},
+	})
+}
+
+func newTestMigrator(t *testing.T, db *gorm.DB, migrations []*Migration, cfg *Config) *Migrator {
+	t.Helper()
+
+	migrator, err := NewMigrator(db, migrations, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrator
+}
+
+func appliedVersions(t *testing.T, migrator *Migrator) []int64 {
+	t.Helper()
+
+	statuses, err := migrator.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var versions []int64
+	for _, status := range statuses {
+		if status.Applied {
+			versions = append(versions, status.Version)
+		}
+	}
+	return versions
+}
+
+func TestLoadFS(t *testing.T) {
+	migrations := loadTestMigrations(t)
+	if len(migrations) != 3 || migrations[0].Name != "create_users" || migrations[1].Version != 2 {
+		t.Fatalf("migrations = %v", migrations)
+	}
+	if migrations[0].Checksum() == "" || migrations[2].Checksum() != "" {
+		t.Fatal("checksum")
+	}
+
+	_, err := LoadFS(fstest.MapFS{"m/1_a.down.sql": {Data: []byte("SELECT 1;")}}, "m")
+	if err == nil {
+		t.Fatal("missing up sql")
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements := splitStatements(string(testFS["migrations/1_create_users.up.sql"].Data) + "SELECT 1")
+	if len(statements) != 3 || !strings.HasPrefix(statements[0], "CREATE TABLE users") ||
+		statements[1] != "CREATE INDEX idx_users_name ON users (name);" || statements[2] != "SELECT 1" {
+		t.Fatalf("statements = %q", statements)
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	db := newTestDB(t)
+	migrator := newTestMigrator(t, db, loadTestMigrations(t), nil)
+	ctx := context.Background()
+
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if versions := appliedVersions(t, migrator); !reflect.DeepEqual(versions, []int64{1, 2, 3}) {
+		t.Fatalf("applied = %v", versions)
+	}
+
+	var count int64
+	if err := db.Table("users").Count(&count).Error; err != nil || count != 1 {
+		t.Fatalf("users = %d, %v", count, err)
+	}
+
+	// 重复执行不会重新迁移
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Table("users").Count(&count).Error; err != nil || count != 1 {
+		t.Fatalf("users = %d, %v", count, err)
+	}
+
+	// 版本3没有down
+	if err := migrator.Down(ctx, 1); !errors.Is(err, ErrNoDownMigration) {
+		t.Fatalf("err = %v", err)
+	}
+
+	migrator = newTestMigrator(t, db, loadTestMigrations(t)[:2], &Config{IgnoreUnknown: true})
+	if err := migrator.Down(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if db.Migrator().HasTable("orders") || !db.Migrator().HasTable("users") {
+		t.Fatal("down orders")
+	}
+	if err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Migrator().HasTable("orders") {
+		t.Fatal("up orders again")
+	}
+}
+
+func TestFailedMigrationRollback(t *testing.T) {
+	db := newTestDB(t)
+	migrations := []*Migration{
+		{Version: 1, Name: "ok", UpSQL: "CREATE TABLE a (id INTEGER);"},
+		{Version: 2, Name: "bad", UpSQL: "CREATE TABLE b (id INTEGER);\nINSERT INTO missing VALUES (1);"},
+	}
+	migrator := newTestMigrator(t, db, migrations, nil)
+
+	if err := migrator.Up(context.Background()); err == nil || !strings.Contains(err.Error(), "2_bad") {
+		t.Fatalf("err = %v", err)
+	}
+	if versions := appliedVersions(t, migrator); !reflect.DeepEqual(versions, []int64{1}) {
+		t.Fatalf("applied = %v", versions)
+	}
+	if db.Migrator().HasTable("b") {
+		t.Fatal("failed migration not rolled back")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	db := newTestDB(t)
+	output := &bytes.Buffer{}
+	migrator := newTestMigrator(t, db, loadTestMigrations(t), &Config{DryRun: true, Output: output})
+
+	if err := migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	out := output.String()
+	for _, want := range []string{"-- 1_create_users up", "CREATE INDEX idx_users_name ON users (name);", "-- 2_create_orders up", "-- 3_seed_users up\n-- go migration"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output missing %q:\n%s", want, out)
+		}
+	}
+	if db.Migrator().HasTable("users") || db.Migrator().HasTable(DefaultTable) {
+		t.Fatal("dry run executed")
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := newTestMigrator(t, db, loadTestMigrations(t), nil).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations := loadTestMigrations(t)
+	migrations[1].UpSQL = "CREATE TABLE orders (id INTEGER PRIMARY KEY, user_id INTEGER, amount INTEGER);"
+	migrator := newTestMigrator(t, db, migrations, nil)
+
+	if err := migrator.Up(ctx); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("err = %v", err)
+	}
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[0].ChecksumMismatch || !statuses[1].ChecksumMismatch || statuses[2].ChecksumMismatch {
+		t.Fatalf("statuses = %+v", statuses)
+	}
+}
+
+func TestUnknownMigration(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if err := newTestMigrator(t, db, loadTestMigrations(t), nil).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 回滚到没有版本3的旧代码
+	old := loadTestMigrations(t)[:2]
+	if err := newTestMigrator(t, db, old, nil).Up(ctx); !errors.Is(err, ErrUnknownMigration) {
+		t.Fatalf("err = %v", err)
+	}
+	if err := newTestMigrator(t, db, old, &Config{IgnoreUnknown: true}).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatusWithoutTable(t *testing.T) {
+	migrator := newTestMigrator(t, newTestDB(t), loadTestMigrations(t), nil)
+
+	statuses, err := migrator.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 3 || statuses[0].Applied {
+		t.Fatalf("statuses = %+v", statuses)
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "unlock.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sqlDB.Close() }()
+
+	// 调用方ctx已取消时仍能解锁，连接回到连接池
+	ctx, cancel := context.WithCancel(context.Background())
+	err = db.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		cancel()
+		releaseLock(conn, "SELECT ?", 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := sqlDB.Stats(); stats.OpenConnections != 1 || stats.Idle != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	// 解锁失败时关闭连接
+	err = db.Connection(func(conn *gorm.DB) error {
+		releaseLock(conn, "SELECT RELEASE_LOCK(?)", DefaultLockName)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := sqlDB.Stats(); stats.OpenConnections != 0 || stats.Idle != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
@@ -1,6 +1,7 @@
 package monitor
 
 import (
+	"database/sql"
 	"errors"
 	"strconv"
 	"time"
@@ -9,12 +10,17 @@ import (
 	"gitlab.shoplazza.site/xiabing/goat.git/prom"
 )
 
-var KafkaProm, RequestProm, RequestErrorProm *prom.PromVec
+var KafkaProm, KafkaProduceProm, KafkaLatencyProm, KafkaRebalanceProm, RequestProm, RequestErrorProm, OutboxProm, DBRouteProm, DBQueryProm, DBQueryErrorProm, IdempotentProm *prom.PromVec
+
+var KafkaLagGauge, KafkaAssignedPartitionsGauge, KafkaInFlightGauge, OutboxPendingGauge, OutboxLagGauge, DBReplicaUpGauge, DBPoolGauge *prometheus.GaugeVec
 
 type Config struct {
 	Namespace      string
 	KafkaEnabled   bool
 	RequestEnabled bool
+	OutboxEnabled  bool
+	DBEnabled      bool
+	DedupEnabled   bool
 }
 
 func Configure(cfg *Config) error {
@@ -30,6 +36,32 @@ func Configure(cfg *Config) error {
 		KafkaProm = prom.NewPromVec(cfg.Namespace).
 			Counter(kafkaConsumeTotal, "Kafka consume total", []string{"topic", "result"}).
 			Histogram(kafkaConsumeTimeCost, "Kafka consume time cost", []string{"topic"}, prometheus.ExponentialBuckets(0.02, 2, 11))
+
+		KafkaProduceProm = prom.NewPromVec(cfg.Namespace).
+			Counter(kafkaProduceTotal, "Kafka produce total", []string{"topic", "result"}).
+			Histogram(kafkaProduceTimeCost, "Kafka produce time cost", []string{"topic"}, prometheus.ExponentialBuckets(0.002, 2, 12))
+
+		KafkaLatencyProm = prom.NewPromVec(cfg.Namespace).
+			Histogram(kafkaConsumeLatency, "Kafka end-to-end latency from msg timestamp to consumed", []string{"topic"}, prometheus.ExponentialBuckets(0.01, 2, 16))
+
+		KafkaRebalanceProm = prom.NewPromVec(cfg.Namespace).
+			Counter(kafkaRebalanceTotal, "Kafka consumer group rebalance total", []string{"group"})
+
+		var err error
+		KafkaLagGauge, err = registerGaugeVec(cfg.Namespace, kafkaConsumerLag, "Kafka consumer group lag", []string{"group", "topic", "partition"})
+		if err != nil {
+			return err
+		}
+
+		KafkaAssignedPartitionsGauge, err = registerGaugeVec(cfg.Namespace, kafkaAssignedPartitions, "Kafka assigned partitions", []string{"group", "topic"})
+		if err != nil {
+			return err
+		}
+
+		KafkaInFlightGauge, err = registerGaugeVec(cfg.Namespace, kafkaInFlight, "Kafka in-flight messages", []string{"topic"})
+		if err != nil {
+			return err
+		}
 	}
 
 	if cfg.RequestEnabled {
@@ -41,9 +73,73 @@ func Configure(cfg *Config) error {
 			Counter(requestErrorTotal, "Request error total", []string{"url", "method"})
 	}
 
+	if cfg.OutboxEnabled {
+		OutboxProm = prom.NewPromVec(cfg.Namespace).
+			Counter(outboxPublishTotal, "Outbox publish total", []string{"topic", "result"}).
+			Histogram(outboxPublishTimeCost, "Outbox publish time cost", []string{"topic"}, prometheus.ExponentialBuckets(0.02, 2, 11))
+
+		var err error
+		OutboxPendingGauge, err = registerGaugeVec(cfg.Namespace, outboxPending, "Outbox pending events", []string{"table"})
+		if err != nil {
+			return err
+		}
+
+		OutboxLagGauge, err = registerGaugeVec(cfg.Namespace, outboxLagSeconds, "Outbox oldest pending event age in seconds", []string{"table"})
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.DBEnabled {
+		DBRouteProm = prom.NewPromVec(cfg.Namespace).
+			Counter(dbRouteTotal, "DB query route total", []string{"target", "reason"})
+
+		DBQueryProm = prom.NewPromVec(cfg.Namespace).
+			Counter(dbQueryTotal, "DB query total", []string{"table", "operation"}).
+			Histogram(dbQueryTimeCost, "DB query time cost", []string{"table", "operation"}, prometheus.ExponentialBuckets(0.001, 2, 14))
+
+		DBQueryErrorProm = prom.NewPromVec(cfg.Namespace).
+			Counter(dbQueryErrorTotal, "DB query error total", []string{"table", "operation", "error_type"})
+
+		var err error
+		DBReplicaUpGauge, err = registerGaugeVec(cfg.Namespace, dbReplicaUp, "DB replica healthy", []string{"replica"})
+		if err != nil {
+			return err
+		}
+
+		DBPoolGauge, err = registerGaugeVec(cfg.Namespace, dbPoolStats, "DB connection pool stats", []string{"db", "stat"})
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.DedupEnabled {
+		IdempotentProm = prom.NewPromVec(cfg.Namespace).
+			Counter(idempotentTotal, "Idempotent consume total", []string{"namespace", "result"})
+	}
+
 	return nil
 }
 
+func registerGaugeVec(namespace, name, help string, labels []string) (*prometheus.GaugeVec, error) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, labels)
+
+	if err := prometheus.Register(gauge); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			if existing, ok := are.ExistingCollector.(*prometheus.GaugeVec); ok {
+				return existing, nil
+			}
+		}
+		return nil, err
+	}
+
+	return gauge, nil
+}
+
 func ReportKafkaConsumeTotal(topic, result string) {
 	if KafkaProm != nil {
 		KafkaProm.Inc(topic, result)
@@ -56,6 +152,55 @@ func ReportKafkaConsumeTimeCost(startTime time.Time, topic string) {
 	}
 }
 
+func ReportKafkaProduceTotal(topic, result string) {
+	if KafkaProduceProm != nil {
+		KafkaProduceProm.Inc(topic, result)
+	}
+}
+
+func ReportKafkaProduceTimeCost(startTime time.Time, topic string) {
+	if KafkaProduceProm != nil {
+		KafkaProduceProm.HandleTime(startTime, topic)
+	}
+}
+
+func ReportKafkaConsumeLatency(timestamp time.Time, topic string) {
+	if KafkaLatencyProm != nil && !timestamp.IsZero() {
+		KafkaLatencyProm.HandleTime(timestamp, topic)
+	}
+}
+
+func ReportKafkaRebalance(group string) {
+	if KafkaRebalanceProm != nil {
+		KafkaRebalanceProm.Inc(group)
+	}
+}
+
+func ReportKafkaLag(group, topic string, partition int32, lag int64) {
+	if KafkaLagGauge != nil {
+		KafkaLagGauge.WithLabelValues(group, topic, strconv.Itoa(int(partition))).Set(float64(lag))
+	}
+}
+
+// RemoveKafkaLag 分区被分配给其他消费者后删除
+func RemoveKafkaLag(group, topic string, partition int32) {
+	if KafkaLagGauge != nil {
+		KafkaLagGauge.DeleteLabelValues(group, topic, strconv.Itoa(int(partition)))
+	}
+}
+
+func ReportKafkaAssignedPartitions(group, topic string, count int) {
+	if KafkaAssignedPartitionsGauge != nil {
+		KafkaAssignedPartitionsGauge.WithLabelValues(group, topic).Set(float64(count))
+	}
+}
+
+func ReportKafkaInFlight(topic string, delta int) {
+	if KafkaInFlightGauge != nil {
+		KafkaInFlightGauge.WithLabelValues(topic).Add(float64(delta))
+	}
+}
+
 func ReportRequestTotal(reqUrl, method string, statusCode int) {
 	if RequestProm != nil {
 		RequestProm.Inc(reqUrl, method, strconv.Itoa(statusCode))
@@ -73,3 +218,79 @@ func ReportRequestTimeCost(startTime time.Time, reqUrl, method string) {
 		RequestProm.HandleTime(startTime, reqUrl, method)
 	}
 }
+
+func ReportOutboxPublishTotal(topic, result string) {
+	if OutboxProm != nil {
+		OutboxProm.Inc(topic, result)
+	}
+}
+
+func ReportOutboxPublishTimeCost(startTime time.Time, topic string) {
+	if OutboxProm != nil {
+		OutboxProm.HandleTime(startTime, topic)
+	}
+}
+
+func ReportOutboxPending(table string, pending int64, lag time.Duration) {
+	if OutboxPendingGauge != nil {
+		OutboxPendingGauge.WithLabelValues(table).Set(float64(pending))
+	}
+
+	if OutboxLagGauge != nil {
+		OutboxLagGauge.WithLabelValues(table).Set(lag.Seconds())
+	}
+}
+
+func ReportDBRouteTotal(target, reason string) {
+	if DBRouteProm != nil {
+		DBRouteProm.Inc(target, reason)
+	}
+}
+
+func ReportDBReplicaUp(replica string, up bool) {
+	if DBReplicaUpGauge != nil {
+		var value float64
+		if up {
+			value = 1
+		}
+		DBReplicaUpGauge.WithLabelValues(replica).Set(value)
+	}
+}
+
+func ReportDBQueryTotal(table, operation string) {
+	if DBQueryProm != nil {
+		DBQueryProm.Inc(table, operation)
+	}
+}
+
+func ReportDBQueryTimeCost(startTime time.Time, table, operation string) {
+	if DBQueryProm != nil {
+		DBQueryProm.HandleTime(startTime, table, operation)
+	}
+}
+
+func ReportDBQueryErrorTotal(table, operation, errorType string) {
+	if DBQueryErrorProm != nil {
+		DBQueryErrorProm.Inc(table, operation, errorType)
+	}
+}
+
+func ReportDBPoolStats(db string, stats sql.DBStats) {
+	if DBPoolGauge != nil {
+		DBPoolGauge.WithLabelValues(db, "max_open").Set(float64(stats.MaxOpenConnections))
+		DBPoolGauge.WithLabelValues(db, "open").Set(float64(stats.OpenConnections))
+		DBPoolGauge.WithLabelValues(db, "in_use").Set(float64(stats.InUse))
+		DBPoolGauge.WithLabelValues(db, "idle").Set(float64(stats.Idle))
+		DBPoolGauge.WithLabelValues(db, "wait_count").Set(float64(stats.WaitCount))
+		DBPoolGauge.WithLabelValues(db, "wait_seconds").Set(stats.WaitDuration.Seconds())
+		DBPoolGauge.WithLabelValues(db, "max_idle_closed").Set(float64(stats.MaxIdleClosed))
+		DBPoolGauge.WithLabelValues(db, "max_idle_time_closed").Set(float64(stats.MaxIdleTimeClosed))
+		DBPoolGauge.WithLabelValues(db, "max_lifetime_closed").Set(float64(stats.MaxLifetimeClosed))
+	}
+}
+
+func ReportIdempotentTotal(namespace, result string) {
+	if IdempotentProm != nil {
+		IdempotentProm.Inc(namespace, result)
+	}
+}
@@ -3,8 +3,30 @@ package monitor
 const (
 	kafkaConsumeTotal    = "built_in_kafka_consume_total"
 	kafkaConsumeTimeCost = "built_in_kafka_consume_time_cost"
+	kafkaProduceTotal    = "built_in_kafka_produce_total"
+	kafkaProduceTimeCost = "built_in_kafka_produce_time_cost"
+
+	kafkaConsumeLatency     = "built_in_kafka_consume_latency"
+	kafkaRebalanceTotal     = "built_in_kafka_rebalance_total"
+	kafkaConsumerLag        = "built_in_kafka_consumer_lag"
+	kafkaAssignedPartitions = "built_in_kafka_assigned_partitions"
+	kafkaInFlight           = "built_in_kafka_in_flight"
 
 	requestTotal      = "built_in_request_total"
 	requestTimeCost   = "built_in_request_time_cost"
 	requestErrorTotal = "built_in_request_error_total"
+
+	outboxPublishTotal    = "built_in_outbox_publish_total"
+	outboxPublishTimeCost = "built_in_outbox_publish_time_cost"
+	outboxPending         = "built_in_outbox_pending"
+	outboxLagSeconds      = "built_in_outbox_lag_seconds"
+
+	dbRouteTotal      = "built_in_db_route_total"
+	dbReplicaUp       = "built_in_db_replica_up"
+	dbQueryTotal      = "built_in_db_query_total"
+	dbQueryTimeCost   = "built_in_db_query_time_cost"
+	dbQueryErrorTotal = "built_in_db_query_error_total"
+	dbPoolStats       = "built_in_db_pool_stats"
+
+	idempotentTotal = "built_in_idempotent_total"
 )
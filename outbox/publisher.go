@@ -0,0 +1,103 @@
+package outbox
+
+import (
+	"context"
+
+	"github.com/Shopify/sarama"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/jiangfans/handy/gorm_tools"
+	"github.com/jiangfans/handy/sqs_tools"
+)
+
+type Publisher interface {
+	Publish(ctx context.Context, event *gorm_tools.OutboxEvent) error
+}
+
+type PublisherFunc func(ctx context.Context, event *gorm_tools.OutboxEvent) error
+
+func (f PublisherFunc) Publish(ctx context.Context, event *gorm_tools.OutboxEvent) error {
+	return f(ctx, event)
+}
+
+// KafkaPublisher 发送到event.Topic，event.Key作为消息key
+type KafkaPublisher struct {
+	producer sarama.SyncProducer
+}
+
+func NewKafkaPublisher(producer sarama.SyncProducer) *KafkaPublisher {
+	return &KafkaPublisher{
+		producer: producer,
+	}
+}
+
+// Publish sarama.SyncProducer不支持取消，ctx结束时不再等待发送结果，消息可能已经发送成功
+func (p *KafkaPublisher) Publish(ctx context.Context, event *gorm_tools.OutboxEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	headers, err := event.HeaderMap()
+	if err != nil {
+		return err
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: event.Topic,
+		Value: sarama.ByteEncoder(event.Payload),
+	}
+	if event.Key != "" {
+		msg.Key = sarama.StringEncoder(event.Key)
+	}
+	for key, value := range headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := p.producer.SendMessage(msg)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SqsPublisher event.Topic为队列url，headers作为MessageAttributes
+type SqsPublisher struct {
+	client sqs_tools.Client
+}
+
+func NewSqsPublisher(client sqs_tools.Client) *SqsPublisher {
+	return &SqsPublisher{
+		client: client,
+	}
+}
+
+func (p *SqsPublisher) Publish(ctx context.Context, event *gorm_tools.OutboxEvent) error {
+	headers, err := event.HeaderMap()
+	if err != nil {
+		return err
+	}
+
+	input := &sqs.SendMessageInput{
+		MessageBody: aws.String(string(event.Payload)),
+		QueueUrl:    aws.String(event.Topic),
+	}
+	if len(headers) != 0 {
+		input.MessageAttributes = make(map[string]types.MessageAttributeValue, len(headers))
+		for key, value := range headers {
+			input.MessageAttributes[key] = types.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(value),
+			}
+		}
+	}
+
+	return p.client.SendMsg(ctx, input)
+}
@@ -0,0 +1,280 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jiangfans/handy/gorm_tools"
+	"github.com/jiangfans/handy/monitor"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+/*
+	投递gorm_tools.AddOutboxEvent写入的事件
+	1. 每次在短事务中用 FOR UPDATE SKIP LOCKED 拉取一批待投递事件，把next_retry_at推迟ClaimTimeout后提交，
+	   多个实例可以同时运行；投递时不持有事务和行锁
+	2. 投递成功标记为已发送，失败按次数指数退避后重试，超过MaxAttempts标记为失败
+	3. 某个key投递失败后，该key后面的事件一起推迟到下次重试，保证同一key的顺序
+	4. 实例退出或超过ClaimTimeout没有投递完的事件，到期后会被重新拉取投递，事件可能重复投递
+*/
+
+const (
+	DefaultBatchSize       = 100
+	DefaultPollInterval    = time.Second
+	DefaultMaxAttempts     = 10
+	DefaultRetryBackoff    = time.Second
+	DefaultMaxRetryBackoff = 10 * time.Minute
+	DefaultClaimTimeout    = time.Minute
+	maxLastErrorLength     = 1024
+)
+
+type RelayConfig struct {
+	Table           string        // 默认outbox_events
+	BatchSize       int           // 每次拉取的事件数
+	PollInterval    time.Duration // 没有待投递事件时的轮询间隔
+	MaxAttempts     int           // 最大投递次数
+	RetryBackoff    time.Duration // 第一次重试间隔，之后每次翻倍
+	MaxRetryBackoff time.Duration // 最大重试间隔
+	ClaimTimeout    time.Duration // 拉取的一批事件需在此时间内投递完，超时后其他实例可重新拉取
+}
+
+type Relay struct {
+	db        *gorm.DB
+	publisher Publisher
+	cfg       RelayConfig
+}
+
+func NewRelay(db *gorm.DB, publisher Publisher, cfg *RelayConfig) (*Relay, error) {
+	if db == nil || publisher == nil {
+		return nil, errors.New("outbox relay db and publisher can't be nil")
+	}
+
+	relay := &Relay{
+		db:        db,
+		publisher: publisher,
+	}
+	if cfg != nil {
+		relay.cfg = *cfg
+	}
+
+	if relay.cfg.Table == "" {
+		relay.cfg.Table = gorm_tools.DefaultOutboxTable
+	}
+	if relay.cfg.BatchSize <= 0 {
+		relay.cfg.BatchSize = DefaultBatchSize
+	}
+	if relay.cfg.PollInterval <= 0 {
+		relay.cfg.PollInterval = DefaultPollInterval
+	}
+	if relay.cfg.MaxAttempts <= 0 {
+		relay.cfg.MaxAttempts = DefaultMaxAttempts
+	}
+	if relay.cfg.RetryBackoff <= 0 {
+		relay.cfg.RetryBackoff = DefaultRetryBackoff
+	}
+	if relay.cfg.MaxRetryBackoff <= 0 {
+		relay.cfg.MaxRetryBackoff = DefaultMaxRetryBackoff
+	}
+	if relay.cfg.ClaimTimeout <= 0 {
+		relay.cfg.ClaimTimeout = DefaultClaimTimeout
+	}
+
+	return relay, nil
+}
+
+// Run 持续投递直到ctx结束
+func (r *Relay) Run(ctx context.Context) error {
+	log.Infof("start relay outbox events from %s ...", r.cfg.Table)
+
+	for {
+		count, err := r.RelayOnce(ctx)
+		if err != nil {
+			log.WithError(err).Error("relay outbox events failed")
+		}
+		r.reportPending(ctx)
+
+		if ctx.Err() != nil {
+			log.Info("outbox relay quit")
+			return nil
+		}
+
+		// 拉满一批说明还有积压，立即继续
+		if err == nil && count == r.cfg.BatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info("outbox relay quit")
+			return nil
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+}
+
+// RelayOnce 投递一批事件，返回拉取到的事件数
+func (r *Relay) RelayOnce(ctx context.Context) (count int, err error) {
+	events, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count = len(events)
+
+	// 超过ClaimTimeout后事件可能已被其他实例拉取，不再继续投递
+	publishCtx, cancel := context.WithTimeout(ctx, r.cfg.ClaimTimeout)
+	defer cancel()
+
+	failedKeys := make(map[string]gorm_tools.Time) // key -> 失败事件的下次重试时间
+	for _, event := range events {
+		if publishCtx.Err() != nil {
+			return
+		}
+
+		if nextRetryAt, ok := failedKeys[event.Key]; ok && event.Key != "" {
+			// 同一key前面的事件失败，和它一起重试
+			if err := r.update(event, map[string]interface{}{"next_retry_at": nextRetryAt}); err != nil {
+				log.WithError(err).WithField("id", event.Id).Error("delay outbox event failed")
+			}
+			continue
+		}
+
+		nextRetryAt, err := r.publish(publishCtx, event)
+		if err != nil && event.Key != "" {
+			failedKeys[event.Key] = nextRetryAt
+		}
+	}
+
+	return
+}
+
+// claim 拉取一批待投递事件并推迟next_retry_at，提交后其他实例不会再拉取到
+func (r *Relay) claim(ctx context.Context) ([]*gorm_tools.OutboxEvent, error) {
+	var events []*gorm_tools.OutboxEvent
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+		err := gorm_tools.DB(tx.Table(r.cfg.Table), []gorm_tools.Option{
+			gorm_tools.Equal("status", gorm_tools.OutboxStatusPending),
+			gorm_tools.Lte("next_retry_at", gorm_tools.Time(now)),
+			gorm_tools.Limit(int32(r.cfg.BatchSize)),
+			gorm_tools.SkipLocked(),
+		}).Find(&events).Error
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		ids := make([]uint64, 0, len(events))
+		for _, event := range events {
+			ids = append(ids, event.Id)
+		}
+		return tx.Table(r.cfg.Table).
+			Where("id IN ?", ids).
+			Update("next_retry_at", gorm_tools.Time(now.Add(r.cfg.ClaimTimeout))).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// publish 投递并更新事件状态，失败时返回下次重试时间
+func (r *Relay) publish(ctx context.Context, event *gorm_tools.OutboxEvent) (gorm_tools.Time, error) {
+	startAt := time.Now()
+	publishErr := r.publisher.Publish(ctx, event)
+	now := gorm_tools.Time(time.Now().UTC())
+
+	if publishErr == nil {
+		monitor.ReportOutboxPublishTimeCost(startAt, event.Topic)
+		monitor.ReportOutboxPublishTotal(event.Topic, "success")
+
+		err := r.update(event, map[string]interface{}{
+			"status":   gorm_tools.OutboxStatusSent,
+			"attempts": event.Attempts + 1,
+			"sent_at":  now,
+		})
+		if err != nil {
+			log.WithError(err).WithField("id", event.Id).Error("mark outbox event sent failed")
+		}
+		return now, nil
+	}
+
+	monitor.ReportOutboxPublishTotal(event.Topic, "failed")
+
+	attempts := event.Attempts + 1
+	lastError := publishErr.Error()
+	if len(lastError) > maxLastErrorLength {
+		lastError = lastError[:maxLastErrorLength]
+	}
+
+	nextRetryAt := gorm_tools.Time(time.Time(now).Add(r.backoff(attempts)))
+	updates := map[string]interface{}{
+		"attempts":      attempts,
+		"last_error":    lastError,
+		"next_retry_at": nextRetryAt,
+	}
+	if attempts >= r.cfg.MaxAttempts {
+		updates["status"] = gorm_tools.OutboxStatusFailed
+	}
+
+	log.WithError(publishErr).WithFields(log.Fields{
+		"id":       event.Id,
+		"topic":    event.Topic,
+		"attempts": attempts,
+	}).Error("publish outbox event failed")
+
+	if err := r.update(event, updates); err != nil {
+		log.WithError(err).WithField("id", event.Id).Error("update failed outbox event failed")
+		return nextRetryAt, publishErr
+	}
+
+	if event.Key != "" {
+		// 同一key后面没有拉取到的事件一起推迟，保证顺序
+		err := r.db.Table(r.cfg.Table).
+			Where("`key` = ? AND status = ? AND id > ? AND next_retry_at < ?", event.Key, gorm_tools.OutboxStatusPending, event.Id, nextRetryAt).
+			Update("next_retry_at", nextRetryAt).Error
+		if err != nil {
+			log.WithError(err).WithField("key", event.Key).Error("delay outbox events failed")
+		}
+	}
+	return nextRetryAt, publishErr
+}
+
+// update 投递后更新事件，不使用投递的ctx，ctx结束时也要记录已经投递的结果
+func (r *Relay) update(event *gorm_tools.OutboxEvent, updates map[string]interface{}) error {
+	return r.db.Table(r.cfg.Table).
+		Where("id = ? AND status = ?", event.Id, gorm_tools.OutboxStatusPending).
+		Updates(updates).Error
+}
+
+func (r *Relay) backoff(attempts int) time.Duration {
+	backoff := r.cfg.RetryBackoff << uint(attempts-1)
+	if backoff <= 0 || backoff > r.cfg.MaxRetryBackoff {
+		backoff = r.cfg.MaxRetryBackoff
+	}
+	return backoff
+}
+
+func (r *Relay) reportPending(ctx context.Context) {
+	var stat struct {
+		Pending int64
+		Oldest  *gorm_tools.Time
+	}
+
+	err := r.db.WithContext(ctx).Table(r.cfg.Table).
+		Select("COUNT(*) AS pending, MIN(created_at) AS oldest").
+		Where("status = ?", gorm_tools.OutboxStatusPending).
+		Scan(&stat).Error
+	if err != nil {
+		if ctx.Err() == nil {
+			log.WithError(err).Error("count pending outbox events failed")
+		}
+		return
+	}
+
+	var lag time.Duration
+	if stat.Oldest != nil && !stat.Oldest.IsZero() {
+		lag = time.Since(time.Time(*stat.Oldest))
+	}
+	monitor.ReportOutboxPending(r.cfg.Table, stat.Pending, lag)
+}
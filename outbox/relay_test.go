@@ -0,0 +1,221 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/jiangfans/handy/gorm_tools"
+	"github.com/jiangfans/handy/kafka_tools/kafkatest"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 内存数据库每个连接独立，只用一个连接，投递时持有事务会导致其他查询阻塞
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	if err := db.AutoMigrate(&gorm_tools.OutboxEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func addEvents(t *testing.T, db *gorm.DB, keys ...string) []*gorm_tools.OutboxEvent {
+	t.Helper()
+
+	events := make([]*gorm_tools.OutboxEvent, 0, len(keys))
+	for i, key := range keys {
+		event, err := gorm_tools.NewOutboxEvent("topic", key, map[string]int{"seq": i}, map[string]string{"seq": key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+
+	err := gorm_tools.WithTx(context.Background(), db, func(ctx context.Context, tx *gorm.DB) error {
+		return gorm_tools.AddOutboxEvent(ctx, tx, events...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func loadEvent(t *testing.T, db *gorm.DB, id uint64) *gorm_tools.OutboxEvent {
+	t.Helper()
+
+	var event gorm_tools.OutboxEvent
+	if err := db.First(&event, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &event
+}
+
+type recordPublisher struct {
+	mu        sync.Mutex
+	published []uint64
+	fail      func(event *gorm_tools.OutboxEvent) error
+}
+
+func (p *recordPublisher) Publish(_ context.Context, event *gorm_tools.OutboxEvent) error {
+	if p.fail != nil {
+		if err := p.fail(event); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, event.Id)
+	return nil
+}
+
+func TestRelayOnce(t *testing.T) {
+	db := newTestDB(t)
+	events := addEvents(t, db, "a", "b", "a")
+
+	publisher := &recordPublisher{}
+	relay, err := NewRelay(db, publisher, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := relay.RelayOnce(context.Background())
+	if err != nil || count != 3 {
+		t.Fatalf("count = %d, err = %v", count, err)
+	}
+
+	if len(publisher.published) != 3 {
+		t.Fatalf("published = %v", publisher.published)
+	}
+	for i, event := range events {
+		if publisher.published[i] != event.Id {
+			t.Fatalf("published out of order: %v", publisher.published)
+		}
+
+		event = loadEvent(t, db, event.Id)
+		if event.Status != gorm_tools.OutboxStatusSent || event.Attempts != 1 || event.SentAt == nil {
+			t.Fatalf("event = %+v", event)
+		}
+	}
+
+	if count, err = relay.RelayOnce(context.Background()); err != nil || count != 0 {
+		t.Fatalf("count = %d, err = %v", count, err)
+	}
+}
+
+func TestRelayPublishOutsideTransaction(t *testing.T) {
+	db := newTestDB(t)
+	events := addEvents(t, db, "a", "b")
+
+	var relay *Relay
+	publisher := &recordPublisher{fail: func(event *gorm_tools.OutboxEvent) error {
+		// 只有一个连接，投递时持有事务的话这里会阻塞
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		// 已拉取的事件不会被再次拉取
+		count, err := relay.RelayOnce(ctx)
+		if err != nil {
+			return err
+		}
+		if count != 0 {
+			return errors.New("claimed event relayed twice")
+		}
+		return nil
+	}}
+
+	relay, err := NewRelay(db, publisher, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := relay.RelayOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if event = loadEvent(t, db, event.Id); event.Status != gorm_tools.OutboxStatusSent {
+			t.Fatalf("event = %+v", event)
+		}
+	}
+}
+
+func TestRelayKeyOrder(t *testing.T) {
+	db := newTestDB(t)
+	events := addEvents(t, db, "a", "a", "b")
+
+	publishErr := errors.New("broker down")
+	publisher := &recordPublisher{fail: func(event *gorm_tools.OutboxEvent) error {
+		if event.Key == "a" {
+			return publishErr
+		}
+		return nil
+	}}
+	relay, err := NewRelay(db, publisher, &RelayConfig{RetryBackoff: time.Hour, MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := relay.RelayOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(publisher.published) != 1 || publisher.published[0] != events[2].Id {
+		t.Fatalf("published = %v", publisher.published)
+	}
+
+	failed := loadEvent(t, db, events[0].Id)
+	if failed.Status != gorm_tools.OutboxStatusFailed || failed.Attempts != 1 || failed.LastError != publishErr.Error() {
+		t.Fatalf("failed = %+v", failed)
+	}
+
+	// 同一key后面的事件没有投递，和失败的事件一起推迟
+	delayed := loadEvent(t, db, events[1].Id)
+	if delayed.Status != gorm_tools.OutboxStatusPending || delayed.Attempts != 0 ||
+		!time.Time(*delayed.NextRetryAt).Equal(time.Time(*failed.NextRetryAt)) {
+		t.Fatalf("delayed = %+v, failed = %+v", delayed, failed)
+	}
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	cluster := kafkatest.NewCluster()
+	publisher := NewKafkaPublisher(cluster.SyncProducer())
+
+	event, err := gorm_tools.NewOutboxEvent("topic", "k", map[string]int{"seq": 1}, map[string]string{"h": "v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := publisher.Publish(ctx, event); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v", err)
+	}
+	if msgs := cluster.Messages("topic"); len(msgs) != 0 {
+		t.Fatalf("published after ctx canceled: %d", len(msgs))
+	}
+
+	if err := publisher.Publish(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	msgs := cluster.Messages("topic")
+	if len(msgs) != 1 || string(msgs[0].Key) != "k" || string(msgs[0].Value) != `{"seq":1}` ||
+		len(msgs[0].Headers) != 1 || string(msgs[0].Headers[0].Value) != "v" {
+		t.Fatalf("msgs = %+v", msgs)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/jiangfans/handy/monitor"
+	"github.com/jiangfans/handy/utils"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -237,7 +238,7 @@ func (r *Request) addReqInternalApiDigest() *Request {
 }
 
 func (r *Request) AddStoreIDHeader(storeID uint64) *Request {
-	r.AddHeader("store-id", strconv.FormatUint(storeID, 10))
+	r.AddHeader(utils.HeaderStoreId, strconv.FormatUint(storeID, 10))
 	return r
 }
 
@@ -0,0 +1,56 @@
+package sqs_tools
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/jiangfans/handy/idempotent"
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageIdFunc 取消息id用于去重
+type MessageIdFunc func(msg *types.Message) (string, error)
+
+// IdFromMessageId sqs的MessageId，只能去重同一条消息的重复投递，不能去重重复发送
+func IdFromMessageId(msg *types.Message) (string, error) {
+	if id := aws.ToString(msg.MessageId); id != "" {
+		return id, nil
+	}
+	return "", fmt.Errorf("%w: MessageId", idempotent.ErrMissingId)
+}
+
+// IdFromAttribute 字符串类型的消息属性
+func IdFromAttribute(name string) MessageIdFunc {
+	return func(msg *types.Message) (string, error) {
+		if attr, ok := msg.MessageAttributes[name]; ok {
+			if id := aws.ToString(attr.StringValue); id != "" {
+				return id, nil
+			}
+		}
+		return "", fmt.Errorf("%w: attribute %s", idempotent.ErrMissingId, name)
+	}
+}
+
+// IdFromJSONField json消息体中的字段，嵌套字段用.分隔
+func IdFromJSONField(path string) MessageIdFunc {
+	return func(msg *types.Message) (string, error) {
+		return idempotent.JSONField([]byte(aws.ToString(msg.Body)), path)
+	}
+}
+
+// Idempotent 按消息id去重，已处理的消息直接跳过，取不到id或其他消费者正在处理时按消费失败处理
+func Idempotent(d *idempotent.Deduplicator, idFunc MessageIdFunc, f ConsumeFunc) ConsumeFunc {
+	return func(ctx context.Context, msg *types.Message) error {
+		id, err := idFunc(msg)
+		if err != nil {
+			log.WithField("message_id", aws.ToString(msg.MessageId)).WithError(err).Error("get sqs msg id failed")
+			return err
+		}
+
+		return d.Do(ctx, id, func() error {
+			return f(ctx, msg)
+		})
+	}
+}
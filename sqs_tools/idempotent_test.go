@@ -0,0 +1,91 @@
+package sqs_tools
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/jiangfans/handy/idempotent"
+)
+
+func TestIdempotent(t *testing.T) {
+	store := idempotent.NewMemoryStore()
+	d, err := idempotent.NewDeduplicator(store, &idempotent.Config{TTL: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	consumeErr := errors.New("failed")
+	f := Idempotent(d, IdFromJSONField("order_id"), func(ctx context.Context, msg *types.Message) error {
+		calls++
+		switch aws.ToString(msg.MessageId) {
+		case "failed":
+			return consumeErr
+		case "panic":
+			panic("boom")
+		}
+		return nil
+	})
+	ctx := context.Background()
+
+	// 重复消息跳过
+	for _, messageId := range []string{"m1", "m1-redelivered"} {
+		if err := f(ctx, &types.Message{MessageId: aws.String(messageId), Body: aws.String(`{"order_id":1}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("calls = %d", calls)
+	}
+
+	// 处理中的消息返回错误，等待重新投递
+	if _, err := store.Acquire(ctx, "2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := f(ctx, &types.Message{Body: aws.String(`{"order_id":2}`)}); !errors.Is(err, idempotent.ErrProcessing) {
+		t.Fatalf("err = %v", err)
+	}
+
+	// 失败、panic后释放
+	if err := f(ctx, &types.Message{MessageId: aws.String("failed"), Body: aws.String(`{"order_id":3}`)}); !errors.Is(err, consumeErr) {
+		t.Fatalf("err = %v", err)
+	}
+	func() {
+		defer func() { _ = recover() }()
+		_ = f(ctx, &types.Message{MessageId: aws.String("panic"), Body: aws.String(`{"order_id":3}`)})
+	}()
+	if err := f(ctx, &types.Message{Body: aws.String(`{"order_id":3}`)}); err != nil || calls != 4 {
+		t.Fatalf("calls = %d, err = %v", calls, err)
+	}
+
+	// 记录过期后再处理
+	time.Sleep(30 * time.Millisecond)
+	if err := f(ctx, &types.Message{Body: aws.String(`{"order_id":1}`)}); err != nil || calls != 5 {
+		t.Fatalf("calls = %d, err = %v", calls, err)
+	}
+
+	if err := f(ctx, &types.Message{Body: aws.String(`{}`)}); !errors.Is(err, idempotent.ErrMissingId) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestIdFromMessage(t *testing.T) {
+	msg := &types.Message{
+		MessageId:         aws.String("m1"),
+		MessageAttributes: map[string]types.MessageAttributeValue{"event_id": {DataType: aws.String("String"), StringValue: aws.String("e1")}},
+	}
+
+	if id, err := IdFromMessageId(msg); err != nil || id != "m1" {
+		t.Fatalf("id = %s, err = %v", id, err)
+	}
+	if id, err := IdFromAttribute("event_id")(msg); err != nil || id != "e1" {
+		t.Fatalf("id = %s, err = %v", id, err)
+	}
+	if _, err := IdFromAttribute("missing")(msg); !errors.Is(err, idempotent.ErrMissingId) {
+		t.Fatalf("err = %v", err)
+	}
+}
@@ -2,8 +2,11 @@ package sqs_tools
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"runtime/debug"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -23,6 +26,7 @@ type ReceiveMsgOpts struct {
 	WaitTimeSeconds      int32           // 轮训消息间隔时间
 	HandleMsgConcurrency int             // 消费消息的并发goroutine数目
 	RetryIntervals       []time.Duration // 数组下标为重试次数，值为重试间隔时间
+	ShutdownTimeout      time.Duration   // ctx结束后等待处理中消息的最长时间
 }
 
 const (
@@ -30,8 +34,11 @@ const (
 	DefaultWaitTimeSeconds      = 5  // 5s
 	DefaultVisibilityTimeout    = 60 // 60s
 	DefaultHandleMsgConcurrency = 5
+	DefaultShutdownTimeout      = 30 * time.Second
 )
 
+var ErrShutdownTimeout = errors.New("wait in-flight messages timeout")
+
 type (
 	funcReceiveMsgOption struct {
 		f func(opts *ReceiveMsgOpts)
@@ -82,6 +89,12 @@ func HandleMsgConcurrency(concurrency int) ReceiveMsgOption {
 	})
 }
 
+func ShutdownTimeout(timeout time.Duration) ReceiveMsgOption {
+	return newReceiveMsgOption(func(opts *ReceiveMsgOpts) {
+		opts.ShutdownTimeout = timeout
+	})
+}
+
 func (sc *sqsClient) SendBytesMsg(ctx context.Context, msg []byte) error {
 	sMInput := &sqs.SendMessageInput{
 		MessageBody: aws.String(string(msg)),
@@ -107,28 +120,10 @@ func (sc *sqsClient) SendMsg(ctx context.Context, msg *sqs.SendMessageInput) err
 	return nil
 }
 
-func (sc *sqsClient) Run(ctx context.Context, f ConsumeFunc, opts ...ReceiveMsgOption) {
+// Run ctx结束后停止拉取，处理函数的ctx同时取消，等待处理中的消息结束（最多ShutdownTimeout）后返回，正常退出返回nil
+func (sc *sqsClient) Run(ctx context.Context, f ConsumeFunc, opts ...ReceiveMsgOption) error {
 	log.Info("😂😂😂start receive msg ...")
 
-	var programQuitNormal bool
-	defer func() {
-		if e := recover(); e != nil {
-			if programQuitNormal {
-				log.Info("😊program quit normal")
-			} else {
-				log.Errorf("😭program quit with panic: %v\n%s", e, string(debug.Stack()))
-			}
-		}
-	}()
-
-	go func() {
-		select {
-		case <-ctx.Done():
-			programQuitNormal = true
-			panic("👋ctx done, program quit")
-		}
-	}()
-
 	rMOpts := &ReceiveMsgOpts{}
 	for _, opt := range opts {
 		opt.apply(rMOpts)
@@ -160,38 +155,79 @@ func (sc *sqsClient) Run(ctx context.Context, f ConsumeFunc, opts ...ReceiveMsgO
 		concurrency = rMOpts.HandleMsgConcurrency
 	}
 
+	shutdownTimeout := DefaultShutdownTimeout
+	if rMOpts.ShutdownTimeout != 0 {
+		shutdownTimeout = rMOpts.ShutdownTimeout
+	}
+
+	// 处理函数使用ctx，退出时能感知到取消；删除消息和修改VisibilityTimeout不随ctx取消，超过ShutdownTimeout才取消
+	ackCtx, cancelAck := context.WithCancel(detachedContext{ctx})
+	defer cancelAck()
+
 	concurrencyChan := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
 
-	for {
+receive:
+	for ctx.Err() == nil {
 		rMOutput, err := sc.sqsClient.ReceiveMessage(ctx, gMInput)
+		if ctx.Err() != nil {
+			break
+		}
+
 		if err != nil {
 			log.Error(err.Error())
-			time.Sleep(2 * time.Second)
+			select {
+			case <-ctx.Done():
+			case <-time.After(2 * time.Second):
+			}
 			continue
 		}
 
 		log.Debugf("received number of msgs: %d", len(rMOutput.Messages))
 
 		for _, message := range rMOutput.Messages {
-			concurrencyChan <- struct{}{}
+			select {
+			case concurrencyChan <- struct{}{}:
+			case <-ctx.Done():
+				// 未处理的消息在VisibilityTimeout后会重新投递
+				break receive
+			}
 
+			wg.Add(1)
 			go func(msg types.Message) {
 				defer func() {
-					stackInfo := debug.Stack()
 					if e := recover(); e != nil {
-						log.WithField("stack", stackInfo).Error("😭consume sqs msg panic: ", e)
+						log.WithField("stack", string(debug.Stack())).Error("😭consume sqs msg panic: ", e)
 					}
 
 					<-concurrencyChan
+					wg.Done()
 				}()
 
-				sc.consumeMsg(ctx, &msg, f, opts...)
+				sc.consumeMsg(ctx, ackCtx, &msg, f, opts...)
 			}(message)
 		}
 	}
+
+	log.Info("ctx done, wait in-flight messages ...")
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info("😊program quit normal")
+		return nil
+	case <-time.After(shutdownTimeout):
+		cancelAck()
+		return fmt.Errorf("sqs consumer quit: %w", ErrShutdownTimeout)
+	}
 }
 
-func (sc *sqsClient) consumeMsg(ctx context.Context, msg *types.Message, f ConsumeFunc, opts ...ReceiveMsgOption) {
+func (sc *sqsClient) consumeMsg(ctx, ackCtx context.Context, msg *types.Message, f ConsumeFunc, opts ...ReceiveMsgOption) {
 	defer func() {
 		if e := recover(); e != nil {
 			log.Error("😭consume sqs msg panic: ", e)
@@ -206,6 +242,11 @@ func (sc *sqsClient) consumeMsg(ctx context.Context, msg *types.Message, f Consu
 	if err := f(ctx, msg); err != nil {
 		log.Info(err.Error())
 
+		// 退出导致的失败不删除消息，VisibilityTimeout后会重新投递
+		if ctx.Err() != nil {
+			return
+		}
+
 		// 如果需要重试，更改VisibilityTimeout
 		// 获取已经接收到的消息次数
 		if len(rMOpts.RetryIntervals) != 0 {
@@ -222,7 +263,7 @@ func (sc *sqsClient) consumeMsg(ctx context.Context, msg *types.Message, f Consu
 				}
 
 				if retryTimes < len(rMOpts.RetryIntervals)-1 {
-					sc.changeMessageVisibility(ctx, msg, int32(rMOpts.RetryIntervals[retryTimes]/time.Second))
+					sc.changeMessageVisibility(ackCtx, msg, int32(rMOpts.RetryIntervals[retryTimes]/time.Second))
 					return
 				} else {
 					log.Info("retry over allow times")
@@ -234,7 +275,7 @@ func (sc *sqsClient) consumeMsg(ctx context.Context, msg *types.Message, f Consu
 	}
 
 	// 删除消息
-	sc.deleteMessage(ctx, msg)
+	sc.deleteMessage(ackCtx, msg)
 }
 
 func (sc *sqsClient) changeMessageVisibility(ctx context.Context, msg *types.Message, visibilityTimeout int32) {
@@ -269,3 +310,24 @@ func (sc *sqsClient) deleteMessage(ctx context.Context, msg *types.Message) {
 func (sc *sqsClient) SqsClient() *sqs.Client {
 	return sc.sqsClient
 }
+
+// detachedContext 保留ctx中的值，但不随ctx取消
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
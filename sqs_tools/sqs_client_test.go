@@ -0,0 +1,149 @@
+package sqs_tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// fakeSqs 只投递一条消息，记录删除的消息
+type fakeSqs struct {
+	mu       sync.Mutex
+	received bool
+	deleted  []string
+}
+
+func (fs *fakeSqs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch action := r.PostForm.Get("Action"); action {
+	case "ReceiveMessage":
+		var message string
+		if !fs.received {
+			fs.received = true
+			message = "<Message><MessageId>m1</MessageId><ReceiptHandle>r1</ReceiptHandle><Body>b</Body></Message>"
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "<ReceiveMessageResponse><ReceiveMessageResult>%s</ReceiveMessageResult></ReceiveMessageResponse>", message)
+	case "DeleteMessage":
+		fs.deleted = append(fs.deleted, r.PostForm.Get("ReceiptHandle"))
+		fmt.Fprint(w, "<DeleteMessageResponse></DeleteMessageResponse>")
+	default:
+		fmt.Fprintf(w, "<%sResponse></%sResponse>", action, action)
+	}
+}
+
+func (fs *fakeSqs) deletedHandles() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]string(nil), fs.deleted...)
+}
+
+func newFakeSqsClient(t *testing.T) (*sqsClient, *fakeSqs) {
+	t.Helper()
+
+	fs := &fakeSqs{}
+	server := httptest.NewServer(fs)
+	t.Cleanup(server.Close)
+
+	client := sqs.New(sqs.Options{
+		Region:           "us-east-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("ak", "sk", ""),
+		EndpointResolver: sqs.EndpointResolverFromURL(server.URL),
+		Retryer:          aws.NopRetryer{},
+	})
+	return &sqsClient{sqsClient: client, queueUrl: server.URL + "/queue"}, fs
+}
+
+// runUntilHandled 消息开始处理后结束ctx，返回Run的结果
+func runUntilHandled(t *testing.T, sc *sqsClient, f ConsumeFunc, opts ...ReceiveMsgOption) error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handling := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- sc.Run(ctx, func(ctx context.Context, msg *types.Message) error {
+			close(handling)
+			return f(ctx, msg)
+		}, opts...)
+	}()
+
+	select {
+	case <-handling:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+	cancel()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("run not return")
+		return nil
+	}
+}
+
+func TestRunCancelHandler(t *testing.T) {
+	sc, fs := newFakeSqsClient(t)
+
+	// 处理函数感知到退出后正常处理完，消息仍然删除
+	err := runUntilHandled(t, sc, func(ctx context.Context, msg *types.Message) error {
+		<-ctx.Done()
+		return nil
+	}, ShutdownTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted := fs.deletedHandles(); len(deleted) != 1 || deleted[0] != "r1" {
+		t.Fatalf("deleted = %v", deleted)
+	}
+}
+
+func TestRunCanceledHandlerFailed(t *testing.T) {
+	sc, fs := newFakeSqsClient(t)
+
+	// 因退出失败的消息不删除，等待重新投递
+	err := runUntilHandled(t, sc, func(ctx context.Context, msg *types.Message) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, ShutdownTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted := fs.deletedHandles(); len(deleted) != 0 {
+		t.Fatalf("deleted = %v", deleted)
+	}
+}
+
+func TestRunShutdownTimeout(t *testing.T) {
+	sc, _ := newFakeSqsClient(t)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	err := runUntilHandled(t, sc, func(ctx context.Context, msg *types.Message) error {
+		<-release
+		return nil
+	}, ShutdownTimeout(50*time.Millisecond))
+	if !errors.Is(err, ErrShutdownTimeout) {
+		t.Fatalf("err = %v", err)
+	}
+}
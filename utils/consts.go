@@ -11,3 +11,7 @@ const (
 	LanguageEnUS = "en-US"
 	LanguageZhCN = "zh-CN"
 )
+
+const (
+	HeaderStoreId = "store-id"
+)